@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	"popovka-bot/internal/bot"
 	"popovka-bot/internal/config"
 	"popovka-bot/internal/database"
 	"popovka-bot/internal/payment"
 	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/tariff"
 	"popovka-bot/internal/worker"
 )
 
@@ -27,39 +34,115 @@ func main() {
 	if err != nil {
 		log.Fatalf("Could not connect to redis: %v", err)
 	}
-	_ = rdb
 
 	// Initialize Remnawave Client
 	remnawaveClient := remnawave.NewClient(cfg.RemnawaveURL, cfg.RemnawaveKey)
 	log.Printf("Initialized Remnawave Client with URL: %s", remnawaveClient.BaseURL)
 
 	// Initialize Payment Client
-	paymentClient := payment.NewClient(cfg.YookassaShopID, cfg.YookassaKey)
+	paymentClient := payment.NewClient(cfg.YookassaShopID, cfg.YookassaKey, cfg.YookassaAPIURL)
+
+	// Initialize Tariff Catalog
+	tariffService := tariff.NewService(db, cfg.RemnawaveSquadID)
+	if err := tariffService.SeedDefaults(); err != nil {
+		log.Fatalf("Could not seed plans: %v", err)
+	}
+
+	// Initialize Subscription Service
+	subscriptionService := subscription.NewService(remnawaveClient, tariffService)
 
 	// Initialize Bot
-	tgBot, err := bot.NewBot(cfg.BotToken, paymentClient, remnawaveClient, db, cfg.RemnawaveSquadID)
+	tgBot, err := bot.NewBot(cfg.BotToken, paymentClient, remnawaveClient, db, rdb, tariffService, subscriptionService, cfg.RemnawaveSquadID, cfg)
 	if err != nil {
 		log.Fatalf("Could not initialize bot: %v", err)
 	}
 
 	// Initialize Handler
-	paymentHandler := payment.NewHandler(remnawaveClient, db, tgBot.Instance, cfg.RemnawaveSquadID, cfg)
+	paymentHandler := payment.NewHandler(remnawaveClient, paymentClient, subscriptionService, db, tgBot.Instance, cfg.RemnawaveSquadID, cfg)
+	tgBot.Payments = paymentHandler
 
-	// Start Webhook Server
+	// Everything below stops on SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Start Webhook Server (YooKassa, and Telegram in webhook mode)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/yookassa-webhook", paymentHandler.HandleWebhook)
+	server := &http.Server{Addr: ":10000", Handler: mux}
 	go func() {
-		http.HandleFunc("/yookassa-webhook", paymentHandler.HandleWebhook)
 		log.Println("Starting Webhook Server on :10000")
-		if err := http.ListenAndServe(":10000", nil); err != nil {
-			log.Fatalf("Webhook server failed: %v", err)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Webhook server failed: %v", err)
+			stop()
 		}
 	}()
 
+	var workers sync.WaitGroup
+
 	// Start Background Checker
 	checker := worker.NewChecker(db, rdb, remnawaveClient, tgBot.Instance)
-	go checker.Start()
+	workers.Go(func() { checker.Start(ctx) })
+
+	// Start Payment Reconciler
+	reconciler := worker.NewReconciler(db, paymentClient, paymentHandler, cfg.PaymentReconcileAfter, cfg.PaymentExpireAfter)
+	workers.Go(func() { reconciler.Start(ctx) })
+
+	// Start Auto-Renewal Worker
+	if cfg.AutoRenewEnabled {
+		renewer := worker.NewRenewer(db, rdb, paymentClient, paymentHandler, tariffService, cfg, tgBot.Instance)
+		workers.Go(func() { renewer.Start(ctx) })
+	}
+
+	// Start Broadcast Sender
+	broadcaster := worker.NewBroadcaster(db, tgBot.Broadcasts, tgBot.Instance)
+	workers.Go(func() { broadcaster.Start(ctx) })
 
 	log.Println("Service started successfully")
 
-	// Start Bot
-	tgBot.Start()
+	// Start Bot, blocks until shutdown
+	if err := tgBot.Start(ctx, mux, cfg.ShutdownTimeout); err != nil {
+		log.Printf("Bot stopped with error: %v", err)
+	}
+	stop() // in case the bot stopped on its own
+
+	// Close connections only after nothing uses them anymore; a worker still
+	// busy with its current item keeps them until the process exits
+	if shutdown(server, &workers, cfg) {
+		if sqlDB, err := db.DB(); err == nil {
+			if err := sqlDB.Close(); err != nil {
+				log.Printf("Failed to close PostgreSQL connection: %v", err)
+			}
+		}
+		if err := rdb.Close(); err != nil {
+			log.Printf("Failed to close Redis connection: %v", err)
+		}
+	}
+
+	log.Println("Service stopped")
+}
+
+// shutdown drains the webhook server and waits for the workers to finish
+// their current item, within cfg.ShutdownTimeout in total. It reports
+// whether all workers have returned.
+func shutdown(server *http.Server, workers *sync.WaitGroup, cfg *config.Config) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Webhook server shutdown: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		log.Println("Background workers did not stop in time")
+		return false
+	}
 }
@@ -0,0 +1,432 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/fsm"
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"gorm.io/gorm"
+)
+
+// maxAdminExtendDays caps a single manual extension
+const maxAdminExtendDays = 3650
+
+// rejectBanned is a middleware dropping updates from banned users
+func (b *Bot) rejectBanned(ctx *th.Context, update telego.Update) error {
+	var from *telego.User
+	switch {
+	case update.Message != nil:
+		from = update.Message.From
+	case update.CallbackQuery != nil:
+		from = &update.CallbackQuery.From
+	case update.PreCheckoutQuery != nil:
+		from = &update.PreCheckoutQuery.From
+	}
+	if from == nil {
+		return ctx.Next(update)
+	}
+
+	// One lookup per update; admins are never blocked
+	var flags struct {
+		Banned  bool
+		IsAdmin bool
+	}
+	if err := b.DB.Model(&models.User{}).Where("telegram_id = ?", from.ID).Select("banned, is_admin").Scan(&flags).Error; err != nil {
+		log.Printf("Failed to check ban of %d: %v", from.ID, err)
+	}
+	if !flags.Banned || flags.IsAdmin || slices.Contains(b.Config.AdminIDs, from.ID) {
+		return ctx.Next(update)
+	}
+
+	const text = "⛔ Доступ к боту ограничен."
+	switch {
+	case update.CallbackQuery != nil:
+		_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(update.CallbackQuery.ID).WithText(text))
+	case update.PreCheckoutQuery != nil:
+		_ = ctx.Bot().AnswerPreCheckoutQuery(ctx.Context(), tu.PreCheckoutQuery(update.PreCheckoutQuery.ID, false).WithErrorMessage(text))
+	default:
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(from.ID), text))
+	}
+	return nil
+}
+
+// handleAdminCommand opens the admin panel: /admin [telegram_id|@username]
+func (b *Bot) handleAdminCommand(ctx *th.Context, update telego.Update) error {
+	message := update.Message
+	telegramID := message.From.ID
+
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	_, _, args := tu.ParseCommand(message.Text)
+	if len(args) == 1 {
+		return b.lookupUser(ctx, telegramID, args[0])
+	}
+
+	if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateAdminWaitingUserQuery, nil); err != nil {
+		log.Printf("Failed to set state for %d: %v", telegramID, err)
+	}
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "🛠 Админ-панель\n\nОтправьте Telegram ID или @username пользователя:"))
+	return nil
+}
+
+// handleAdminCallback handles the buttons of the user card: adm_<action>_<user id>
+func (b *Bot) handleAdminCallback(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	action, idText, _ := strings.Cut(strings.TrimPrefix(callback.Data, "adm_"), "_")
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	var user models.User
+	if err := b.DB.First(&user, id).Error; err != nil {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Пользователь не найден."))
+		return nil
+	}
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+	payload := fsm.AdminPayload{UserID: user.ID}
+
+	switch action {
+	case "user":
+		return b.sendAdminUserCard(ctx, telegramID, &user)
+
+	case "balance":
+		if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateAdminWaitingBalance, payload); err != nil {
+			log.Printf("Failed to set state for %d: %v", telegramID, err)
+		}
+		return reply(fmt.Sprintf("💰 Баланс %d: %s₽\n\nВведите сумму изменения и причину, например:\n+500 компенсация за простой\n-100 ошибочное начисление\n\n/cancel — отмена", user.TelegramID, utils.FormatRub(user.Balance)))
+
+	case "extend":
+		if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateAdminWaitingExtendDays, payload); err != nil {
+			log.Printf("Failed to set state for %d: %v", telegramID, err)
+		}
+		return reply(fmt.Sprintf("➕ На сколько дней продлить подписку %d?\n\n/cancel — отмена", user.TelegramID))
+
+	case "revoke":
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🚫 Да, отозвать").WithCallbackData(fmt.Sprintf("adm_revokeok_%d", user.ID)),
+			tu.InlineKeyboardButton("« Назад").WithCallbackData(fmt.Sprintf("adm_user_%d", user.ID)),
+		))
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), fmt.Sprintf("Отозвать подписку %d? Доступ к VPN будет отключён сразу, деньги не возвращаются.", user.TelegramID)).WithReplyMarkup(keyboard))
+		return nil
+
+	case "revokeok":
+		var sub models.Subscription
+		if err := b.DB.Where("user_id = ?", user.ID).First(&sub).Error; err != nil {
+			return reply("❌ У пользователя нет подписки.")
+		}
+		err := b.DB.Transaction(func(tx *gorm.DB) error {
+			return b.Subscriptions.Revoke(ctx.Context(), tx, &user, &sub)
+		})
+		if err != nil {
+			log.Printf("Admin %d failed to revoke subscription of %d: %v", telegramID, user.TelegramID, err)
+			return reply("❌ Не удалось отозвать подписку. Подробности в логах.")
+		}
+		log.Printf("Admin %d revoked subscription of user %d", telegramID, user.TelegramID)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(user.TelegramID), "❌ Ваша подписка отключена администратором."))
+		return b.sendAdminUserCard(ctx, telegramID, &user)
+
+	case "ban", "unban":
+		banned := action == "ban"
+		if err := b.setBanned(ctx, &user, banned); err != nil {
+			log.Printf("Admin %d failed to %s user %d: %v", telegramID, action, user.TelegramID, err)
+			return reply("❌ Не удалось изменить блокировку. Подробности в логах.")
+		}
+		log.Printf("Admin %d set banned=%t for user %d", telegramID, banned, user.TelegramID)
+		return b.sendAdminUserCard(ctx, telegramID, &user)
+	}
+	return nil
+}
+
+// setBanned bans or unbans the user. A ban also disables the user on the
+// panel; unbanning enables them again if the subscription has not expired.
+func (b *Bot) setBanned(ctx *th.Context, user *models.User, banned bool) error {
+	if err := b.DB.Model(user).Update("banned", banned).Error; err != nil {
+		return fmt.Errorf("failed to update user: %w", err)
+	}
+	if banned {
+		if err := b.FSM.Clear(ctx.Context(), user.TelegramID); err != nil {
+			log.Printf("Failed to clear state for %d: %v", user.TelegramID, err)
+		}
+	}
+
+	var sub models.Subscription
+	if err := b.DB.Where("user_id = ? AND remnawave_id <> ''", user.ID).First(&sub).Error; err != nil {
+		return nil // Nothing on the panel
+	}
+	if sub.ExpirationDate.Before(time.Now()) {
+		return nil // The checker has disabled it already
+	}
+
+	var err error
+	if banned {
+		err = b.RemnawaveClient.DisableUser(ctx.Context(), sub.RemnawaveID)
+	} else {
+		err = b.RemnawaveClient.EnableUser(ctx.Context(), sub.RemnawaveID)
+	}
+	if err != nil && !errors.Is(err, remnawave.ErrNotFound) {
+		return fmt.Errorf("failed to update panel user %s: %w", sub.RemnawaveID, err)
+	}
+	return nil
+}
+
+// handleAdminInput processes text sent by an admin in one of the admin states
+func (b *Bot) handleAdminInput(ctx *th.Context, message *telego.Message, session fsm.Session) error {
+	telegramID := message.From.ID
+	text := strings.TrimSpace(message.Text)
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	if !b.isAdmin(telegramID) {
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		return nil
+	}
+
+	if session.State == fsm.StateAdminWaitingUserQuery {
+		return b.lookupUser(ctx, telegramID, text)
+	}
+
+	var payload fsm.AdminPayload
+	if err := session.Decode(&payload); err != nil {
+		log.Printf("Bad admin state payload of %d: %v", telegramID, err)
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		return reply("❌ Действие устарело, откройте карточку пользователя заново.")
+	}
+
+	var user models.User
+	if err := b.DB.First(&user, payload.UserID).Error; err != nil {
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		return reply("❌ Пользователь не найден.")
+	}
+
+	switch session.State {
+	case fsm.StateAdminWaitingBalance:
+		amount, reason, err := parseAdjustment(text)
+		if err != nil {
+			return reply("❌ Формат: <сумма> <причина>, например: +500 компенсация за простой")
+		}
+
+		var updated *models.User
+		err = b.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			updated, err = ledger.Post(tx, ledger.Entry{
+				UserID:        user.ID,
+				Amount:        amount,
+				Kind:          models.LedgerKindAdminAdjustment,
+				ReferenceType: "admin",
+				ReferenceID:   strconv.FormatInt(telegramID, 10),
+				Comment:       reason,
+			})
+			return err
+		})
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			return reply(fmt.Sprintf("❌ Баланс не может стать отрицательным (сейчас %s₽). Введите другую сумму:", utils.FormatRub(user.Balance)))
+		}
+		if err != nil {
+			log.Printf("Admin %d failed to adjust balance of %d: %v", telegramID, user.TelegramID, err)
+			return reply("❌ Не удалось изменить баланс. Подробности в логах.")
+		}
+
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		log.Printf("Admin %d adjusted balance of user %d by %d: %s", telegramID, user.TelegramID, amount, reason)
+
+		sign := ""
+		if amount > 0 {
+			sign = "+"
+		}
+		notice := fmt.Sprintf("💰 Баланс изменён администратором: %s%s₽\nПричина: %s\nТекущий баланс: %s₽", sign, utils.FormatRub(amount), reason, utils.FormatRub(updated.Balance))
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(user.TelegramID), notice))
+		return b.sendAdminUserCard(ctx, telegramID, updated)
+
+	case fsm.StateAdminWaitingExtendDays:
+		days, err := strconv.Atoi(text)
+		if err != nil || days <= 0 || days > maxAdminExtendDays {
+			return reply(fmt.Sprintf("❌ Введите число дней от 1 до %d:", maxAdminExtendDays))
+		}
+
+		var sub *models.Subscription
+		err = b.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+			sub, err = b.Subscriptions.Extend(ctx.Context(), tx, &user, days, nil)
+			return err
+		})
+		if remnawave.IsTransient(err) {
+			return reply("⏳ VPN-панель недоступна, попробуйте позже.")
+		}
+		if err != nil {
+			log.Printf("Admin %d failed to extend subscription of %d: %v", telegramID, user.TelegramID, err)
+			return reply("❌ Не удалось продлить подписку. Подробности в логах.")
+		}
+
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		log.Printf("Admin %d extended subscription of user %d by %d days", telegramID, user.TelegramID, days)
+
+		notice := fmt.Sprintf("🎁 Подписка продлена администратором на %d дн.\n\n📅 Действует до: %s\n\n🔗 Ссылка на VPN:\n%s", days, sub.ExpirationDate.Format("02.01.2006"), sub.SubscriptionURL)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(user.TelegramID), notice))
+		return b.sendAdminUserCard(ctx, telegramID, &user)
+	}
+	return nil
+}
+
+// lookupUser finds a user by the admin's query and shows their card
+func (b *Bot) lookupUser(ctx *th.Context, adminID int64, query string) error {
+	user, err := b.findUser(query)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(adminID), "❌ Пользователь не найден. Отправьте другой ID или /cancel."))
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to look up user %q: %v", query, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(adminID), "❌ Ошибка поиска. Подробности в логах."))
+		return nil
+	}
+
+	if err := b.FSM.Clear(ctx.Context(), adminID); err != nil {
+		log.Printf("Failed to clear state for %d: %v", adminID, err)
+	}
+	return b.sendAdminUserCard(ctx, adminID, user)
+}
+
+// findUser looks a user up by Telegram ID or username (with or without @)
+func (b *Bot) findUser(query string) (*models.User, error) {
+	query = strings.TrimSpace(query)
+
+	var user models.User
+	var err error
+	if id, parseErr := strconv.ParseInt(query, 10, 64); parseErr == nil {
+		err = b.DB.Where("telegram_id = ?", id).First(&user).Error
+	} else {
+		username := strings.TrimPrefix(query, "@")
+		if username == "" {
+			return nil, gorm.ErrRecordNotFound
+		}
+		err = b.DB.Where("LOWER(username) = LOWER(?)", username).First(&user).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// sendAdminUserCard shows balance, subscription and recent payments of a user
+// with the admin actions
+func (b *Bot) sendAdminUserCard(ctx *th.Context, adminID int64, user *models.User) error {
+	// Reload, the caller's copy may predate the action just taken
+	if err := b.DB.First(user, user.ID).Error; err != nil {
+		log.Printf("Failed to reload user %d: %v", user.ID, err)
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "👤 Пользователь %d", user.TelegramID)
+	if user.Username != "" {
+		fmt.Fprintf(&sb, " (@%s)", user.Username)
+	}
+	fmt.Fprintf(&sb, "\n\n🔹 Статус: %s", user.Status)
+	if user.Banned {
+		sb.WriteString(", ⛔ заблокирован")
+	}
+	if user.IsAdmin {
+		sb.WriteString(", 🛠 админ")
+	}
+	fmt.Fprintf(&sb, "\n🔹 Баланс: %s₽", utils.FormatRub(user.Balance))
+	fmt.Fprintf(&sb, "\n🔹 Зарегистрирован: %s", user.CreatedAt.Format("02.01.2006"))
+	if user.PaymentMethodID != "" {
+		fmt.Fprintf(&sb, "\n🔹 Карта: %s, автопродление: %t", user.PaymentMethodTitle, user.AutoRenew)
+	}
+
+	var sub models.Subscription
+	hasSub := b.DB.Where("user_id = ?", user.ID).First(&sub).Error == nil
+	if hasSub {
+		state := "активна"
+		if sub.ExpirationDate.Before(time.Now()) {
+			state = "истекла"
+		}
+		fmt.Fprintf(&sb, "\n\n📅 Подписка: %s, до %s (%s)\n🔹 Remnawave: %s", sub.PlanType, sub.ExpirationDate.Format("02.01.2006 15:04"), state, sub.RemnawaveID)
+	} else {
+		sb.WriteString("\n\n📅 Подписки нет")
+	}
+
+	var payments []models.Payment
+	if err := b.DB.Where("user_id = ?", user.ID).Order("created_at DESC").Limit(5).Find(&payments).Error; err != nil {
+		log.Printf("Failed to load payments of %d: %v", user.ID, err)
+	}
+	if len(payments) > 0 {
+		sb.WriteString("\n\n💳 Последние платежи:")
+		for _, p := range payments {
+			id := p.YooKassaID
+			if id == "" {
+				id = p.ChargeID
+			}
+			fmt.Fprintf(&sb, "\n• %s %s₽ %s, %s (%s) %s", p.CreatedAt.Format("02.01.2006"), utils.FormatRub(p.Amount), p.Type, p.Status, p.Provider, id)
+		}
+	}
+
+	rows := [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("💰 Баланс").WithCallbackData(fmt.Sprintf("adm_balance_%d", user.ID)),
+			tu.InlineKeyboardButton("➕ Продлить").WithCallbackData(fmt.Sprintf("adm_extend_%d", user.ID)),
+		),
+	}
+	if hasSub && sub.ExpirationDate.After(time.Now()) {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🚫 Отозвать подписку").WithCallbackData(fmt.Sprintf("adm_revoke_%d", user.ID)),
+		))
+	}
+	ban := tu.InlineKeyboardButton("⛔ Заблокировать").WithCallbackData(fmt.Sprintf("adm_ban_%d", user.ID))
+	if user.Banned {
+		ban = tu.InlineKeyboardButton("✅ Разблокировать").WithCallbackData(fmt.Sprintf("adm_unban_%d", user.ID))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(
+		ban,
+		tu.InlineKeyboardButton("🔄 Обновить").WithCallbackData(fmt.Sprintf("adm_user_%d", user.ID)),
+	))
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(adminID), sb.String()).WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return nil
+}
+
+// parseAdjustment parses "<signed amount in rubles> <reason>"
+func parseAdjustment(text string) (int64, string, error) {
+	amountText, reason, _ := strings.Cut(strings.TrimSpace(text), " ")
+	amount, err := utils.ParseRub(amountText)
+	if err != nil {
+		return 0, "", err
+	}
+	if amount == 0 {
+		return 0, "", errors.New("amount must not be zero")
+	}
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		return 0, "", errors.New("reason is required")
+	}
+	return amount, reason, nil
+}
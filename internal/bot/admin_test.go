@@ -0,0 +1,85 @@
+package bot
+
+import (
+	"errors"
+	"testing"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/testutil"
+
+	"gorm.io/gorm"
+)
+
+func TestParseAdjustment(t *testing.T) {
+	tests := []struct {
+		text       string
+		wantAmount int64
+		wantReason string
+		wantErr    bool
+	}{
+		{text: "+500 компенсация за простой", wantAmount: 50000, wantReason: "компенсация за простой"},
+		{text: "-99.50 ошибочное начисление", wantAmount: -9950, wantReason: "ошибочное начисление"},
+		{text: "  250,5   бонус  ", wantAmount: 25050, wantReason: "бонус"},
+		{text: "500", wantErr: true},
+		{text: "0 ничего", wantErr: true},
+		{text: "много денег", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		amount, reason, err := parseAdjustment(tt.text)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseAdjustment(%q) = %d, %q, want error", tt.text, amount, reason)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseAdjustment(%q): %v", tt.text, err)
+			continue
+		}
+		if amount != tt.wantAmount || reason != tt.wantReason {
+			t.Errorf("parseAdjustment(%q) = %d, %q, want %d, %q", tt.text, amount, reason, tt.wantAmount, tt.wantReason)
+		}
+	}
+}
+
+func TestFindUserAndIsAdmin(t *testing.T) {
+	db := testutil.DB(t)
+	b := &Bot{DB: db, Config: &config.Config{AdminIDs: []int64{1}}}
+
+	users := []models.User{
+		{TelegramID: 3001, Username: "Alice_VPN", ReferralCode: "ref_3001"},
+		{TelegramID: 3002, Username: "bob", ReferralCode: "ref_3002", IsAdmin: true},
+	}
+	if err := db.Create(&users).Error; err != nil {
+		t.Fatalf("create users: %v", err)
+	}
+
+	for query, want := range map[string]int64{
+		"3001":       3001,
+		"@alice_vpn": 3001,
+		"Alice_VPN":  3001,
+		" @bob ":     3002,
+	} {
+		user, err := b.findUser(query)
+		if err != nil {
+			t.Errorf("findUser(%q): %v", query, err)
+			continue
+		}
+		if user.TelegramID != want {
+			t.Errorf("findUser(%q) = %d, want %d", query, user.TelegramID, want)
+		}
+	}
+	for _, query := range []string{"3003", "@carol", "@"} {
+		if _, err := b.findUser(query); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Errorf("findUser(%q) error = %v, want not found", query, err)
+		}
+	}
+
+	for id, want := range map[int64]bool{1: true, 3001: false, 3002: true, 4000: false} {
+		if got := b.isAdmin(id); got != want {
+			t.Errorf("isAdmin(%d) = %t, want %t", id, got, want)
+		}
+	}
+}
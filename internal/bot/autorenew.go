@@ -0,0 +1,53 @@
+package bot
+
+import (
+	"log"
+
+	"popovka-bot/internal/models"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// handleAutoRenewToggle switches auto-renewal for a user with a saved card
+func (b *Bot) handleAutoRenewToggle(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	var user models.User
+	if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil || user.PaymentMethodID == "" {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "💳 Сохранённой карты нет. Пополните баланс картой с автопродлением."))
+		return nil
+	}
+
+	if err := b.DB.Model(&user).Update("auto_renew", !user.AutoRenew).Error; err != nil {
+		log.Printf("Failed to toggle auto-renewal for %d: %v", telegramID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось изменить настройку. Попробуйте позже."))
+		return nil
+	}
+
+	text := "✅ Автопродление включено. Мы спишем оплату с карты незадолго до окончания подписки."
+	if !user.AutoRenew {
+		text = "⏸ Автопродление выключено. Карта остаётся сохранённой."
+	}
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+	return nil
+}
+
+// handleUnlinkCard forgets the saved card
+func (b *Bot) handleUnlinkCard(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	if err := b.Payments.UnlinkPaymentMethod(telegramID); err != nil {
+		log.Printf("Failed to unlink payment method of %d: %v", telegramID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось отвязать карту. Попробуйте позже."))
+		return nil
+	}
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "🗑 Карта отвязана, автопродление выключено."))
+	return nil
+}
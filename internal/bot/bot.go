@@ -2,54 +2,114 @@ package bot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
-	"strconv"
+	"net/http"
 	"strings"
-	"sync"
 	"time"
 
+	"popovka-bot/internal/broadcast"
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/fsm"
+	"popovka-bot/internal/gift"
+	"popovka-bot/internal/ledger"
 	"popovka-bot/internal/models"
 	"popovka-bot/internal/payment"
+	"popovka-bot/internal/promo"
 	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/tariff"
+	"popovka-bot/internal/utils"
 
 	"github.com/mymmrac/telego"
 	th "github.com/mymmrac/telego/telegohandler"
 	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/redis/go-redis/v9"
 	"gorm.io/gorm"
 )
 
+// panelUnavailableText is shown when the VPN panel is down; nothing is charged
+const panelUnavailableText = "⏳ VPN-панель временно недоступна. Средства не списаны, попробуйте через несколько минут."
+
+// minTopUpAmount is the smallest balance top-up in kopecks (100₽)
+const minTopUpAmount = 10000
+
+// usageCacheTTL is how long the profile shows the same traffic figures
+const usageCacheTTL = time.Minute
+
 type Bot struct {
 	Instance        *telego.Bot
 	PaymentClient   *payment.Client
-	RemnawaveClient *remnawave.Client
+	Providers       []payment.Provider
+	Payments        *payment.Handler // Set after creation, the handler needs the bot instance
+	RemnawaveClient remnawave.API
 	DB              *gorm.DB
-	UserStates      map[int64]string
-	StatesMu        sync.RWMutex
+	Tariffs         *tariff.Service
+	Subscriptions   *subscription.Service
+	FSM             *fsm.Store
+	Broadcasts      *broadcast.Service
+	Gifts           *gift.Service
+	Usage           *remnawave.UsageCache
 	SquadID         string
+	Config          *config.Config
 }
 
-func NewBot(token string, paymentClient *payment.Client, remnawaveClient *remnawave.Client, db *gorm.DB, squadID string) (*Bot, error) {
+func NewBot(token string, paymentClient *payment.Client, remnawaveClient remnawave.API, db *gorm.DB, rdb *redis.Client, tariffs *tariff.Service, subscriptions *subscription.Service, squadID string, cfg *config.Config) (*Bot, error) {
 	tgBot, err := telego.NewBot(token)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create bot: %w", err)
 	}
 
+	providers := []payment.Provider{payment.NewYooKassaProvider(paymentClient, db, cfg, false)}
+	if cfg.AutoRenewEnabled {
+		providers = append(providers, payment.NewYooKassaProvider(paymentClient, db, cfg, true))
+	}
+	if cfg.StarsEnabled {
+		providers = append(providers, payment.NewStarsProvider(tgBot, cfg.StarsKopecksPerStar))
+	}
+
 	return &Bot{
 		Instance:        tgBot,
 		PaymentClient:   paymentClient,
+		Providers:       providers,
 		RemnawaveClient: remnawaveClient,
 		DB:              db,
-		UserStates:      make(map[int64]string),
+		Tariffs:         tariffs,
+		Subscriptions:   subscriptions,
+		FSM:             fsm.NewStore(rdb),
+		Broadcasts:      broadcast.NewService(db, rdb, cfg.BroadcastRate),
+		Gifts:           gift.NewService(db, subscriptions, time.Duration(cfg.GiftValidityDays)*24*time.Hour),
+		Usage:           remnawave.NewUsageCache(remnawaveClient, rdb, usageCacheTTL),
 		SquadID:         squadID,
+		Config:          cfg,
 	}, nil
 }
 
-func (b *Bot) Start() {
-	// Correct signature: context, params, options
-	updates, _ := b.Instance.UpdatesViaLongPolling(context.Background(), nil)
+// Start receives updates until ctx is canceled. In webhook mode they arrive
+// on mux. On shutdown it stops receiving and waits up to drainTimeout for
+// handlers that are still running; handlers not done by then have their
+// context canceled.
+func (b *Bot) Start(ctx context.Context, mux *http.ServeMux, drainTimeout time.Duration) error {
+	updates, stopUpdates, err := b.receiveUpdates(ctx, mux)
+	if err != nil {
+		return err
+	}
+
+	handler, err := th.NewBotHandler(b.Instance, updates)
+	if err != nil {
+		stopUpdates()
+		return fmt.Errorf("failed to create bot handler: %w", err)
+	}
 
-	handler, _ := th.NewBotHandler(b.Instance, updates)
+	// Handlers run on their own context so stopping the handler does not
+	// abort a purchase halfway; it is canceled only if draining times out
+	handlersCtx, cancelHandlers := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelHandlers()
+	handler.Use(func(ctx *th.Context, update telego.Update) error {
+		return ctx.WithContext(handlersCtx).Next(update)
+	})
+	handler.Use(b.rejectBanned)
 
 	// /start command
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
@@ -68,6 +128,13 @@ func (b *Bot) Start() {
 			log.Printf("Failed to get/create user: %v", err)
 		}
 
+		// Back after blocking the bot, include in broadcasts again
+		if user.BlockedBot {
+			if err := b.DB.Model(&user).Update("blocked_bot", false).Error; err != nil {
+				log.Printf("Failed to reset blocked flag of %d: %v", telegramID, err)
+			}
+		}
+
 		// Generate Referral Code if missing
 		if user.ReferralCode == "" {
 			user.ReferralCode = fmt.Sprintf("ref_%d", telegramID)
@@ -78,7 +145,8 @@ func (b *Bot) Start() {
 		}
 
 		// Process Referral (only if new user or no referrer set)
-		if args != "" && user.ReferrerID == nil && args != user.ReferralCode {
+		giftCode, isGift := strings.CutPrefix(args, gift.StartPrefix)
+		if args != "" && !isGift && user.ReferrerID == nil && args != user.ReferralCode {
 			var referrer models.User
 			if err := b.DB.Where("referral_code = ?", args).First(&referrer).Error; err == nil {
 				// Referrer found
@@ -90,54 +158,83 @@ func (b *Bot) Start() {
 			}
 		}
 
-		keyboard := tu.InlineKeyboard(
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("👤 Личный кабинет").WithCallbackData("profile"),
-				tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
-			),
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("🚀 Купить VPN (255₽)").WithCallbackData("buy_subscription_balance"),
-			),
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("🤝 Партнерская программа").WithCallbackData("invite_friend"),
-			),
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("📖 Инструкция").WithCallbackData("instruction"),
-			),
-		)
+		keyboard := b.mainMenu(&user)
 
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
 			tu.ID(message.Chat.ID),
 			fmt.Sprintf("Привет, %s! 👋\n\nЯ помогу тебе с VPN через Remnawave.", message.From.FirstName),
 		).WithReplyMarkup(keyboard))
+
+		if isGift {
+			b.redeemGift(ctx, &user, giftCode)
+		}
 		return nil
 	}, th.CommandEqual("start"))
 
 	// Callback for "Buy VPN" - Selection of tariffs
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
 		callback := update.CallbackQuery
-		keyboard := tu.InlineKeyboard(
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("🚀 VPN 30 дней - 255₽").WithCallbackData("buy_subscription_balance"),
-			),
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("« Назад").WithCallbackData("start_back"),
-			),
+
+		plans, err := b.Tariffs.ActivePlans()
+		if err != nil {
+			log.Printf("Failed to load plans: %v", err)
+		}
+		if len(plans) == 0 {
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(callback.From.ID), "❌ Сейчас нет доступных тарифов. Попробуйте позже."))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+			return nil
+		}
+
+		// Prices with the promo code the user has entered
+		code := b.pendingPromo(callback.From.ID)
+
+		var rows [][]telego.InlineKeyboardButton
+		for _, plan := range plans {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(planButtonText(&plan, promo.Apply(code, &plan))).WithCallbackData(planCallback(&plan, promo.Apply(code, &plan))),
+			))
+		}
+		rows = append(rows,
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton("🎁 Подарить подписку").WithCallbackData("gift_menu")),
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton("🎟 Ввести промокод").WithCallbackData("promo_enter")),
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton("« Назад").WithCallbackData("start_back")),
 		)
 
-		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
-			tu.ID(callback.From.ID),
-			"📊 Тарифный план:\nVPN на 30 дней за 255 рублей.\nОплата списывается с внутреннего баланса.",
-		).WithReplyMarkup(keyboard))
+		msg := "📊 Выберите тарифный план:\nОплата списывается с внутреннего баланса."
+		if code != nil {
+			msg += fmt.Sprintf("\n\n🎟 Промокод %s: %s", code.Code, promo.Describe(code))
+		}
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(callback.From.ID), msg).WithReplyMarkup(tu.InlineKeyboard(rows...)))
 		_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
 		return nil
 	}, th.CallbackDataEqual("buy_vpn"))
 
-	// Callback for buying subscription from balance
+	// Callback for buying a plan from balance
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
 		callback := update.CallbackQuery
 		telegramID := callback.From.ID
 
+		// The price the user is charged must be the price they saw
+		priceChanged := func() error {
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Цена изменилась: промокод больше не действует или был заменён. Средства не списаны, выберите тариф заново.").
+				WithReplyMarkup(tu.InlineKeyboard(tu.InlineKeyboardRow(tu.InlineKeyboardButton("« К тарифам").WithCallbackData("buy_vpn")))))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+			return nil
+		}
+
+		planID, expected, ok := parsePlanCallback(callback.Data)
+		if !ok {
+			return priceChanged() // A button from before prices were attached
+		}
+
+		plan, err := b.Tariffs.GetActivePlan(planID)
+		if err != nil {
+			log.Printf("Failed to get plan %d: %v", planID, err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Тариф недоступен. Выберите другой."))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+			return nil
+		}
+
 		// Get User
 		var user models.User
 		if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
@@ -145,11 +242,19 @@ func (b *Bot) Start() {
 			return nil
 		}
 
-		price := 255.0
-		durationDays := 30
+		quote, err := promo.QuotePlan(b.DB, user.ID, plan)
+		if err != nil {
+			log.Printf("Failed to apply promo code for %d: %v", telegramID, err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось рассчитать стоимость. Попробуйте позже."))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+			return nil
+		}
+		if !quote.Same(expected) {
+			return priceChanged()
+		}
+		price := quote.Price
 
-		// Check Balance
-		if user.Balance < price {
+		insufficientFunds := func(balance int64) error {
 			keyboard := tu.InlineKeyboard(
 				tu.InlineKeyboardRow(
 					tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
@@ -158,90 +263,47 @@ func (b *Bot) Start() {
 					tu.InlineKeyboardButton("« Назад").WithCallbackData("buy_vpn"),
 				),
 			)
-			msg := fmt.Sprintf("❌ Недостаточно средств.\nВаш баланс: %.2f₽\nСтоимость: %.2f₽", user.Balance, price)
+			msg := fmt.Sprintf("❌ Недостаточно средств.\nВаш баланс: %s₽\nСтоимость: %s₽", utils.FormatRub(balance), utils.FormatRub(price))
 			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(keyboard))
 			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
 			return nil
 		}
 
+		// Check Balance
+		if user.Balance < price {
+			return insufficientFunds(user.Balance)
+		}
+
 		// Process Purchase
-		// 1. Deduct Balance
-		user.Balance -= price
-		if err := b.DB.Save(&user).Error; err != nil {
-			log.Printf("Failed to update balance: %v", err)
-			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при списании средств."))
+		sub, err := b.Subscriptions.Purchase(ctx.Context(), b.DB, &user, plan, expected)
+		if errors.Is(err, ledger.ErrInsufficientFunds) {
+			var fresh models.User
+			b.DB.First(&fresh, user.ID)
+			return insufficientFunds(fresh.Balance)
+		}
+		if promo.IsInvalid(err) {
+			return priceChanged()
+		}
+		if remnawave.IsTransient(err) {
+			log.Printf("Panel unavailable, purchase for %d postponed: %v", telegramID, err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), panelUnavailableText))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
 			return nil
 		}
-
-		// 2. Activate/Extend Subscription
-		var sub models.Subscription
-		dbResult := b.DB.Where("user_id = ?", user.ID).First(&sub)
-
-		var vpnLink string
-		var expireDate time.Time
-
-		if dbResult.Error == gorm.ErrRecordNotFound {
-			// New Subscription
-			rwUser, err := b.RemnawaveClient.CreateUser(telegramID, fmt.Sprintf("user_%d", telegramID), durationDays, b.SquadID)
-			if err != nil {
-				// Rollback balance (simple manual rollback)
-				user.Balance += price
-				b.DB.Save(&user)
-				log.Printf("Failed to create Remnawave user: %v", err)
-				_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при активации VPN. Средства возвращены."))
-				return nil
-			}
-
-			vpnLink = rwUser.SubscriptionURL
-			expireDate = time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
-
-			newSub := models.Subscription{
-				UserID:          user.ID,
-				RemnawaveID:     rwUser.UUID,
-				SubscriptionURL: rwUser.SubscriptionURL,
-				ExpirationDate:  expireDate,
-				PlanType:        "standard",
-			}
-			b.DB.Create(&newSub)
-
-		} else {
-			// Extend Subscription
-			if err := b.RemnawaveClient.ExtendSubscription(sub.RemnawaveID, durationDays); err != nil {
-				// Rollback
-				user.Balance += price
-				b.DB.Save(&user)
-				log.Printf("Failed to extend Remnawave user: %v", err)
-				_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при продлении VPN. Средства возвращены."))
-				return nil
-			}
-
-			// Calculate new expiry
-			if sub.ExpirationDate.Before(time.Now()) {
-				expireDate = time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
-			} else {
-				expireDate = sub.ExpirationDate.Add(time.Duration(durationDays) * 24 * time.Hour)
-			}
-
-			sub.ExpirationDate = expireDate
-			b.DB.Save(&sub)
-
-			// Try get link if missing
-			if sub.SubscriptionURL == "" {
-				if rwUser, err := b.RemnawaveClient.GetUser(sub.RemnawaveID); err == nil {
-					sub.SubscriptionURL = rwUser.SubscriptionURL
-					b.DB.Save(&sub)
-				}
-			}
-			vpnLink = sub.SubscriptionURL
+		if err != nil {
+			log.Printf("Failed to process purchase for %d: %v", telegramID, err)
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при активации VPN. Средства не списаны."))
+			_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+			return nil
 		}
 
 		// Success Message
-		msg := fmt.Sprintf("✅ Подписка активирована!\n\n📅 Действует до: %s\n\n🔗 *Ссылка на VPN:*\n%s", expireDate.Format("02.01.2006"), vpnLink)
+		msg := fmt.Sprintf("✅ Подписка активирована!\n\n📅 Действует до: %s\n\n🔗 *Ссылка на VPN:*\n%s", sub.ExpirationDate.Format("02.01.2006"), sub.SubscriptionURL)
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown))
 		_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
 		return nil
 
-	}, th.CallbackDataEqual("buy_subscription_balance"))
+	}, th.CallbackDataPrefix("buy_plan_"))
 
 	// Callback for Profile
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
@@ -267,15 +329,24 @@ func (b *Bot) Start() {
 			if sub.ExpirationDate.Before(time.Now()) {
 				status = "⚠️ Истекла"
 			}
+			if sub.PlanType == models.PlanTypeTrial {
+				status += " (пробный период)"
+			}
 		}
 
-		msg := fmt.Sprintf("👤 *Личный кабинет:*\n\n🔹 ID: `%d`\n🔹 Баланс: %.2f₽\n🔹 Статус: %s\n🔹 Действует до: %s", telegramID, user.Balance, status, expiry)
+		msg := fmt.Sprintf("👤 *Личный кабинет:*\n\n🔹 ID: `%d`\n🔹 Баланс: %s₽\n🔹 Статус: %s\n🔹 Действует до: %s", telegramID, utils.FormatRub(user.Balance), status, expiry)
+		if err == nil && sub.RemnawaveID != "" {
+			msg += b.usageText(ctx, &sub)
+		}
+		if code := b.pendingPromo(telegramID); code != nil {
+			msg += fmt.Sprintf("\n🎟 Промокод: %s", promo.Describe(code))
+		}
 
 		// Add VPN link if subscription is active
 		if err == nil {
 			if sub.SubscriptionURL == "" && sub.RemnawaveID != "" {
 				// URL missing in DB (legacy record), try to fetch it
-				rwUser, err := b.RemnawaveClient.GetUser(sub.RemnawaveID)
+				rwUser, err := b.RemnawaveClient.GetUser(ctx.Context(), sub.RemnawaveID)
 				if err != nil {
 					log.Printf("Failed to fetch user %s from Remnawave: %v", sub.RemnawaveID, err)
 				} else {
@@ -292,11 +363,36 @@ func (b *Bot) Start() {
 			}
 		}
 
-		keyboard := tu.InlineKeyboard(
+		rows := [][]telego.InlineKeyboardButton{
 			tu.InlineKeyboardRow(
 				tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
 			),
-		)
+			tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("🎟 Ввести промокод").WithCallbackData("promo_enter"),
+			),
+		}
+		if err == nil && sub.RemnawaveID != "" {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("📱 Мои устройства").WithCallbackData("devices"),
+			))
+		}
+
+		// Saved card for auto-renewal
+		if user.PaymentMethodID != "" {
+			autoRenew := "выключено"
+			toggle := "🔁 Включить автопродление"
+			if user.AutoRenew {
+				autoRenew = "включено"
+				toggle = "⏸ Выключить автопродление"
+			}
+			msg += fmt.Sprintf("\n\n💳 Карта: `%s`\n🔁 Автопродление: %s", user.PaymentMethodTitle, autoRenew)
+			rows = append(rows,
+				tu.InlineKeyboardRow(tu.InlineKeyboardButton(toggle).WithCallbackData("autorenew_toggle")),
+				tu.InlineKeyboardRow(tu.InlineKeyboardButton("🗑 Отвязать карту").WithCallbackData("unlink_card")),
+			)
+		}
+
+		keyboard := tu.InlineKeyboard(rows...)
 
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(keyboard))
 		_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
@@ -342,20 +438,16 @@ func (b *Bot) Start() {
 		var invitedCount int64
 		b.DB.Model(&models.User{}).Where("referrer_id = ?", user.ID).Count(&invitedCount)
 
-		var totalEarned float64
+		var totalEarned int64
 		b.DB.Model(&models.ReferralTransaction{}).Where("referrer_id = ?", user.ID).Select("COALESCE(SUM(amount), 0)").Scan(&totalEarned)
 
-		botUsername := "popovka_bot" // TODO: Get from config or context
-		if info, err := b.Instance.GetMe(ctx.Context()); err == nil {
-			botUsername = info.Username
-		}
-		refLink := fmt.Sprintf("https://t.me/%s?start=%s", botUsername, user.ReferralCode)
+		refLink := b.startLink(ctx, user.ReferralCode)
 
 		msg := fmt.Sprintf("🤝 *Партнерская программа*\n\n"+
 			"Приглашай друзей и получай бонусы!\n\n"+
 			"👥 Приглашено: %d\n"+
-			"💰 Заработано: %.2f₽\n\n"+
-			"🔗 *Твоя ссылка:*\n`%s`", invitedCount, totalEarned, refLink)
+			"💰 Заработано: %s₽\n\n"+
+			"🔗 *Твоя ссылка:*\n`%s`", invitedCount, utils.FormatRub(totalEarned), refLink)
 
 		// Keyboard with Back button
 		keyboard := tu.InlineKeyboard(
@@ -372,16 +464,14 @@ func (b *Bot) Start() {
 	// Callback for Back to Start
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
 		callback := update.CallbackQuery
-		keyboard := tu.InlineKeyboard(
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("👤 Личный кабинет").WithCallbackData("profile"),
-				tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
-			),
-			tu.InlineKeyboardRow(
-				tu.InlineKeyboardButton("🚀 Купить VPN").WithCallbackData("buy_subscription_balance"),
-				tu.InlineKeyboardButton("🤝 Партнерам").WithCallbackData("invite_friend"),
-			),
-		)
+
+		var user models.User
+		var keyboard *telego.InlineKeyboardMarkup
+		if err := b.DB.Where("telegram_id = ?", callback.From.ID).First(&user).Error; err == nil {
+			keyboard = b.mainMenu(&user)
+		} else {
+			keyboard = b.mainMenu(nil)
+		}
 
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
 			tu.ID(callback.From.ID),
@@ -391,13 +481,75 @@ func (b *Bot) Start() {
 		return nil
 	}, th.CallbackDataEqual("start_back"))
 
+	// One-time free trial from the /start menu
+	handler.Handle(b.handleTrial, th.CallbackDataEqual("trial"))
+
+	// Payment method chosen for a top-up
+	handler.Handle(b.handleTopUpProvider, th.CallbackDataPrefix("topup_pay_"))
+
+	// Telegram Stars checkout
+	handler.Handle(b.handlePreCheckout, th.AnyPreCheckoutQuery())
+	handler.Handle(b.handleSuccessfulPayment, th.SuccessPayment())
+
+	// Auto-renewal settings from the profile
+	handler.Handle(b.handleAutoRenewToggle, th.CallbackDataEqual("autorenew_toggle"))
+	handler.Handle(b.handleUnlinkCard, th.CallbackDataEqual("unlink_card"))
+
+	// Admin: /refund <payment_id> [amount]
+	handler.Handle(b.handleRefundCommand, th.CommandEqual("refund"))
+
+	// Admin panel: /admin [telegram_id|@username] and the user card buttons
+	handler.Handle(b.handleAdminCommand, th.CommandEqual("admin"))
+	handler.Handle(b.handleAdminCallback, th.CallbackDataPrefix("adm_"))
+
+	// Promo codes: entering one, and /promo for admins
+	handler.Handle(b.handlePromoEnter, th.CallbackDataEqual("promo_enter"))
+	handler.Handle(b.handlePromoCommand, th.CommandEqual("promo"))
+
+	// Devices connected to the subscription, removal and extra slots
+	handler.Handle(b.handleDevices, th.CallbackDataEqual("devices"))
+	handler.Handle(b.handleDeviceCallback, th.CallbackDataPrefix("dev_"))
+
+	// Gift subscriptions: plan choice, purchase, the buyer's list and refunds
+	handler.Handle(b.handleGiftCallback, th.CallbackDataPrefix("gift_"))
+
+	// Admin: /broadcast, its segment/confirm buttons and photo content
+	handler.Handle(b.handleBroadcastCommand, th.CommandEqual("broadcast"))
+	handler.Handle(b.handleBroadcastCallback, th.CallbackDataPrefix("bc_"))
+	handler.Handle(b.handleBroadcastPhoto, messageWithPhoto)
+
+	// /cancel leaves whatever input the bot is waiting for
+	handler.Handle(func(ctx *th.Context, update telego.Update) error {
+		telegramID := update.Message.From.ID
+
+		session, err := b.FSM.Get(ctx.Context(), telegramID)
+		if err != nil {
+			log.Printf("Failed to get state for %d: %v", telegramID, err)
+		}
+		if err := b.FSM.Clear(ctx.Context(), telegramID); err != nil {
+			log.Printf("Failed to clear state for %d: %v", telegramID, err)
+		}
+
+		text := "❌ Действие отменено."
+		if err == nil && session.State == fsm.StateNone {
+			text = "Нечего отменять."
+		}
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}, th.CommandEqual("cancel"))
+
 	// Callback for Top Up Balance Request
 	handler.Handle(func(ctx *th.Context, update telego.Update) error {
 		telegramID := update.CallbackQuery.From.ID
 
-		b.StatesMu.Lock()
-		b.UserStates[telegramID] = "WAITING_TOPUP_AMOUNT"
-		b.StatesMu.Unlock()
+		var user models.User
+		if err := b.DB.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
+			log.Printf("Failed to get/create user: %v", err)
+		}
+
+		if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateWaitingTopUpAmount, nil); err != nil {
+			log.Printf("Failed to set state for %d: %v", telegramID, err)
+		}
 
 		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "💰 Введите сумму пополнения (минимум 100₽):"))
 		_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(update.CallbackQuery.ID))
@@ -409,45 +561,115 @@ func (b *Bot) Start() {
 		telegramID := update.Message.From.ID
 		text := update.Message.Text
 
-		b.StatesMu.RLock()
-		state, ok := b.UserStates[telegramID]
-		b.StatesMu.RUnlock()
+		session, err := b.FSM.Get(ctx.Context(), telegramID)
+		if err != nil {
+			log.Printf("Failed to get state for %d: %v", telegramID, err)
+			return nil
+		}
 
-		if !ok || state != "WAITING_TOPUP_AMOUNT" {
+		switch session.State {
+		case fsm.StateAdminWaitingUserQuery, fsm.StateAdminWaitingBalance, fsm.StateAdminWaitingExtendDays:
+			return b.handleAdminInput(ctx, update.Message, session)
+		case fsm.StateBroadcastWaitingContent:
+			return b.handleBroadcastContent(ctx, update.Message)
+		case fsm.StateWaitingPromoCode:
+			return b.handlePromoInput(ctx, update.Message)
+		case fsm.StateWaitingContact:
+			return b.handleReceiptContact(ctx, telegramID, text, session)
+		}
+
+		if session.State != fsm.StateWaitingTopUpAmount {
 			return nil // Pass to next handler if any
 		}
 
 		// Process Amount
-		amount, err := strconv.ParseFloat(text, 64)
-		if err != nil || amount < 100 {
+		amount, err := utils.ParseRub(text)
+		if err != nil || amount < minTopUpAmount {
 			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Некорректная сумма. Введите число не меньше 100."))
 			return nil
 		}
 
-		// Create Payment
-		metadata := map[string]string{
-			"telegram_id": strconv.FormatInt(telegramID, 10),
-			"type":        "balance_topup",
+		// Reset State
+		if err := b.FSM.Clear(ctx.Context(), telegramID); err != nil {
+			log.Printf("Failed to clear state for %d: %v", telegramID, err)
 		}
 
-		paymentResp, err := b.PaymentClient.CreatePayment(fmt.Sprintf("%.2f", amount), "RUB", "Пополнение баланса", "https://t.me/your_bot_name", metadata)
-		if err != nil {
-			log.Printf("Failed to create topup payment: %v", err)
-			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при создании платежа."))
-		} else {
-			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
-				tu.ID(telegramID),
-				fmt.Sprintf("💳 Ссылка для пополнения на %.2f₽:\n%s", amount, paymentResp.Confirmation.ConfirmationURL),
-			))
+		if len(b.Providers) == 1 {
+			return b.startTopUp(ctx, telegramID, b.Providers[0], amount)
 		}
 
-		// Reset State
-		b.StatesMu.Lock()
-		delete(b.UserStates, telegramID)
-		b.StatesMu.Unlock()
+		// Let the user pick a payment method
+		var rows [][]telego.InlineKeyboardButton
+		for _, provider := range b.Providers {
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(provider.Title()).WithCallbackData(fmt.Sprintf("topup_pay_%s_%d", provider.Name(), amount)),
+			))
+		}
 
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
+			tu.ID(telegramID),
+			fmt.Sprintf("💰 Пополнение на %s₽\nВыберите способ оплаты:", utils.FormatRub(amount)),
+		).WithReplyMarkup(tu.InlineKeyboard(rows...)))
 		return nil
 	}, th.AnyMessageWithText())
 
-	handler.Start()
+	go func() {
+		if err := handler.Start(); err != nil {
+			log.Printf("Bot handler stopped: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+	log.Println("Stopping bot, waiting for running handlers...")
+	stopUpdates()
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := handler.StopWithContext(stopCtx); err != nil {
+		return fmt.Errorf("bot handlers did not finish in time: %w", err)
+	}
+	return nil
+}
+
+// mainMenu builds the start menu. The trial button is offered only while the
+// user may still claim it; user may be nil if they are not registered yet.
+func (b *Bot) mainMenu(user *models.User) *telego.InlineKeyboardMarkup {
+	rows := [][]telego.InlineKeyboardButton{
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("👤 Личный кабинет").WithCallbackData("profile"),
+			tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🚀 Купить VPN").WithCallbackData("buy_vpn"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🤝 Партнерская программа").WithCallbackData("invite_friend"),
+		),
+		tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("📖 Инструкция").WithCallbackData("instruction"),
+		),
+	}
+	if user != nil && b.trialAvailable(user) {
+		rows = append([][]telego.InlineKeyboardButton{
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton(b.trialTitle()).WithCallbackData("trial")),
+		}, rows...)
+	}
+	return tu.InlineKeyboard(rows...)
+}
+
+// isAdmin reports whether the Telegram user is allowed to run admin commands:
+// listed in ADMIN_TELEGRAM_IDS or flagged in the database
+func (b *Bot) isAdmin(telegramID int64) bool {
+	for _, adminID := range b.Config.AdminIDs {
+		if adminID == telegramID {
+			return true
+		}
+	}
+
+	var count int64
+	if err := b.DB.Model(&models.User{}).Where("telegram_id = ? AND is_admin = ?", telegramID, true).Count(&count).Error; err != nil {
+		log.Printf("Failed to check admin flag of %d: %v", telegramID, err)
+		return false
+	}
+	return count > 0
 }
@@ -0,0 +1,247 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"popovka-bot/internal/broadcast"
+	"popovka-bot/internal/fsm"
+	"popovka-bot/internal/models"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// Telegram limits on message text and photo caption length
+const (
+	maxMessageLength = 4096
+	maxCaptionLength = 1024
+)
+
+// segmentTitles are the segment names shown to admins
+var segmentTitles = map[broadcast.Segment]string{
+	broadcast.SegmentAll:       "Все",
+	broadcast.SegmentActive:    "С активной подпиской",
+	broadcast.SegmentExpired:   "С истёкшей подпиской",
+	broadcast.SegmentNeverPaid: "Не платили",
+	broadcast.SegmentReferrers: "Приглашали друзей",
+}
+
+// messageWithPhoto matches messages carrying a photo
+func messageWithPhoto(_ context.Context, update telego.Update) bool {
+	return update.Message != nil && len(update.Message.Photo) > 0
+}
+
+// handleBroadcastCommand starts composing a broadcast: /broadcast
+func (b *Bot) handleBroadcastCommand(ctx *th.Context, update telego.Update) error {
+	telegramID := update.Message.From.ID
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateBroadcastWaitingContent, nil); err != nil {
+		log.Printf("Failed to set state for %d: %v", telegramID, err)
+	}
+
+	msg := "📣 Новая рассылка\n\n" +
+		"Отправьте текст или фото с подписью.\n" +
+		"Кнопки-ссылки добавьте последними строками в формате:\n" +
+		"Текст кнопки | https://example.com\n\n" +
+		"/cancel — отмена"
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg))
+	return nil
+}
+
+// handleBroadcastPhoto accepts a photo as broadcast content
+func (b *Bot) handleBroadcastPhoto(ctx *th.Context, update telego.Update) error {
+	telegramID := update.Message.From.ID
+
+	session, err := b.FSM.Get(ctx.Context(), telegramID)
+	if err != nil {
+		log.Printf("Failed to get state for %d: %v", telegramID, err)
+		return nil
+	}
+	if session.State != fsm.StateBroadcastWaitingContent {
+		return nil
+	}
+	return b.handleBroadcastContent(ctx, update.Message)
+}
+
+// handleBroadcastContent saves the admin's message as a draft and asks for
+// the segment
+func (b *Bot) handleBroadcastContent(ctx *th.Context, message *telego.Message) error {
+	telegramID := message.From.ID
+	if !b.isAdmin(telegramID) {
+		_ = b.FSM.Clear(ctx.Context(), telegramID)
+		return nil
+	}
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	text := message.Text
+	var photoID string
+	if len(message.Photo) > 0 {
+		text = message.Caption
+		photoID = message.Photo[len(message.Photo)-1].FileID // Largest size
+	}
+
+	body, buttons := broadcast.ParseButtons(text)
+	if body == "" && photoID == "" {
+		return reply("❌ Сообщение пустое. Отправьте текст или фото:")
+	}
+	limit := maxMessageLength
+	if photoID != "" {
+		limit = maxCaptionLength
+	}
+	if utf8.RuneCountInString(body) > limit {
+		return reply(fmt.Sprintf("❌ Слишком длинный текст, максимум %d символов. Отправьте сообщение заново:", limit))
+	}
+
+	encoded, err := broadcast.EncodeButtons(buttons)
+	if err != nil {
+		log.Printf("Failed to encode broadcast buttons: %v", err)
+		return reply("❌ Не удалось сохранить кнопки.")
+	}
+
+	bc := models.Broadcast{
+		AdminID:     telegramID,
+		Text:        body,
+		PhotoFileID: photoID,
+		Buttons:     encoded,
+		Status:      models.BroadcastStatusDraft,
+	}
+	if err := b.DB.Create(&bc).Error; err != nil {
+		log.Printf("Failed to save broadcast draft: %v", err)
+		return reply("❌ Не удалось сохранить рассылку. Подробности в логах.")
+	}
+	if err := b.FSM.Clear(ctx.Context(), telegramID); err != nil {
+		log.Printf("Failed to clear state for %d: %v", telegramID, err)
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, segment := range broadcast.Segments {
+		count, err := b.Broadcasts.Count(segment)
+		if err != nil {
+			log.Printf("Failed to count segment %s: %v", segment, err)
+		}
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("%s (%d)", segmentTitles[segment], count)).WithCallbackData(fmt.Sprintf("bc_seg_%d_%s", bc.ID, segment)),
+		))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(
+		tu.InlineKeyboardButton("❌ Отмена").WithCallbackData(fmt.Sprintf("bc_cancel_%d", bc.ID)),
+	))
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "👥 Кому отправить?").WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return nil
+}
+
+// handleBroadcastCallback handles segment choice, confirmation and
+// cancellation: bc_seg_<id>_<segment>, bc_send_<id>, bc_cancel_<id>
+func (b *Bot) handleBroadcastCallback(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	parts := strings.SplitN(callback.Data, "_", 4)
+	if len(parts) < 3 {
+		return nil
+	}
+	id, err := strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return nil
+	}
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	var bc models.Broadcast
+	if err := b.DB.First(&bc, id).Error; err != nil {
+		return reply("❌ Рассылка не найдена.")
+	}
+	if bc.Status != models.BroadcastStatusDraft {
+		return reply(fmt.Sprintf("Рассылка #%d уже %s.", bc.ID, broadcastStatusText(bc.Status)))
+	}
+
+	switch parts[1] {
+	case "seg":
+		if len(parts) != 4 || !broadcast.Segment(parts[3]).Valid() {
+			return nil
+		}
+		segment := broadcast.Segment(parts[3])
+		if err := b.DB.Model(&bc).Update("segment", segment).Error; err != nil {
+			log.Printf("Failed to update broadcast %d: %v", bc.ID, err)
+			return reply("❌ Не удалось сохранить сегмент.")
+		}
+		bc.Segment = string(segment)
+
+		// Preview exactly what recipients will get
+		if err := broadcast.Send(ctx.Context(), ctx.Bot(), &bc, telegramID); err != nil {
+			log.Printf("Failed to send broadcast preview: %v", err)
+			return reply(fmt.Sprintf("❌ Telegram не принял сообщение: %v", err))
+		}
+
+		count, err := b.Broadcasts.Count(segment)
+		if err != nil {
+			log.Printf("Failed to count segment %s: %v", segment, err)
+		}
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton("🚀 Отправить").WithCallbackData(fmt.Sprintf("bc_send_%d", bc.ID)),
+			tu.InlineKeyboardButton("❌ Отмена").WithCallbackData(fmt.Sprintf("bc_cancel_%d", bc.ID)),
+		))
+		msg := fmt.Sprintf("👆 Так сообщение увидят получатели.\n\nСегмент: %s\nПолучателей: %d\n\nОтправить?", segmentTitles[segment], count)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(keyboard))
+		return nil
+
+	case "send":
+		if bc.Segment == "" {
+			return reply("❌ Сначала выберите сегмент.")
+		}
+		err := b.Broadcasts.Launch(ctx.Context(), &bc)
+		if errors.Is(err, broadcast.ErrNotDraft) {
+			return reply(fmt.Sprintf("Рассылка #%d уже запущена или отменена.", bc.ID))
+		}
+		if err != nil {
+			log.Printf("Failed to launch broadcast %d: %v", bc.ID, err)
+			return reply("❌ Не удалось запустить рассылку. Подробности в логах.")
+		}
+		log.Printf("Admin %d launched broadcast %d to %d recipients (%s)", telegramID, bc.ID, bc.Total, bc.Segment)
+		return reply(fmt.Sprintf("🚀 Рассылка #%d запущена: %d получателей. Отчёт придёт по завершении.", bc.ID, bc.Total))
+
+	case "cancel":
+		if err := b.DB.Model(&models.Broadcast{}).
+			Where("id = ? AND status = ?", bc.ID, models.BroadcastStatusDraft).
+			Update("status", models.BroadcastStatusCanceled).Error; err != nil {
+			log.Printf("Failed to cancel broadcast %d: %v", bc.ID, err)
+		}
+		return reply("❌ Рассылка отменена.")
+	}
+	return nil
+}
+
+func broadcastStatusText(status string) string {
+	switch status {
+	case models.BroadcastStatusSending:
+		return "отправляется"
+	case models.BroadcastStatusDone:
+		return "отправлена"
+	case models.BroadcastStatusCanceled:
+		return "отменена"
+	}
+	return status
+}
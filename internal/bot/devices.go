@@ -0,0 +1,238 @@
+package bot
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// deviceKey identifies a device in callback data, which is too short for
+// a full HWID
+func deviceKey(hwid string) string {
+	sum := sha256.Sum256([]byte(hwid))
+	return hex.EncodeToString(sum[:8])
+}
+
+// deviceTitle names a device for users
+func deviceTitle(device remnawave.Device) string {
+	title := device.DeviceModel
+	if title == "" {
+		title = device.Platform
+	}
+	if title == "" {
+		title = "Устройство"
+	}
+	if device.OSVersion != "" {
+		title += " " + device.OSVersion
+	}
+	return title
+}
+
+// userSubscription loads the user's subscription with its plan; the plan is
+// nil for legacy subscriptions
+func (b *Bot) userSubscription(telegramID int64) (*models.User, *models.Subscription, *models.Plan, error) {
+	var user models.User
+	if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		return nil, nil, nil, err
+	}
+	var sub models.Subscription
+	if err := b.DB.Where("user_id = ?", user.ID).First(&sub).Error; err != nil {
+		return &user, nil, nil, err
+	}
+	if sub.PlanID == nil {
+		return &user, &sub, nil, nil
+	}
+	plan, err := b.Tariffs.GetPlan(*sub.PlanID)
+	if err != nil {
+		log.Printf("Failed to get plan %d: %v", *sub.PlanID, err)
+		return &user, &sub, nil, nil
+	}
+	return &user, &sub, plan, nil
+}
+
+// handleDevices shows the devices connected with the user's link
+func (b *Bot) handleDevices(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+	return b.sendDevices(ctx, callback.From.ID)
+}
+
+func (b *Bot) sendDevices(ctx *th.Context, telegramID int64) error {
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	_, sub, plan, err := b.userSubscription(telegramID)
+	if err != nil || sub.RemnawaveID == "" {
+		return reply("❌ У вас нет подписки.")
+	}
+
+	devices, err := b.RemnawaveClient.GetDevices(ctx.Context(), sub.RemnawaveID)
+	if err != nil {
+		log.Printf("Failed to get devices of %s: %v", sub.RemnawaveID, err)
+		return reply("⏳ Не удалось получить список устройств. Попробуйте через несколько минут.")
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📱 Мои устройства\n\n")
+	limit, err := b.Subscriptions.CurrentDeviceLimit(ctx.Context(), sub, plan)
+	if err != nil {
+		log.Printf("Failed to get device limit of %s: %v", sub.RemnawaveID, err)
+	}
+	if limit > 0 {
+		fmt.Fprintf(&sb, "Подключено: %d из %d", len(devices), limit)
+		if sub.ExtraDevices > 0 {
+			fmt.Fprintf(&sb, " (докуплено: %d)", sub.ExtraDevices)
+		}
+		sb.WriteString("\n")
+	} else {
+		fmt.Fprintf(&sb, "Подключено: %d (без ограничений)\n", len(devices))
+	}
+	if len(devices) == 0 {
+		sb.WriteString("\nУстройства появятся здесь после первого подключения.")
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for i, device := range devices {
+		fmt.Fprintf(&sb, "\n%d. %s", i+1, deviceTitle(device))
+		if added, err := time.Parse(time.RFC3339, device.CreatedAt); err == nil {
+			fmt.Fprintf(&sb, ", с %s", added.Local().Format("02.01.2006"))
+		}
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🗑 Удалить %d. %s", i+1, deviceTitle(device))).WithCallbackData("dev_del_"+deviceKey(device.HWID)),
+		))
+	}
+	if len(devices) > 0 {
+		sb.WriteString("\n\nУдалённое устройство освобождает место и сможет подключиться снова.")
+	}
+
+	if limit > 0 && b.Config.DeviceSlotPrice > 0 && sub.ExtraDevices < b.Config.MaxExtraDevices {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("➕ Ещё одно устройство — %s₽", utils.FormatRub(b.Config.DeviceSlotPrice))).WithCallbackData("dev_buy"),
+		))
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("« Назад").WithCallbackData("profile")))
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), sb.String()).WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return nil
+}
+
+// handleDeviceCallback removes a device or sells an extra slot:
+// dev_del_<key>, dev_buy (confirmation) and dev_buyok
+func (b *Bot) handleDeviceCallback(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	action := strings.TrimPrefix(callback.Data, "dev_")
+	switch {
+	case strings.HasPrefix(action, "del_"):
+		return b.deleteDevice(ctx, telegramID, strings.TrimPrefix(action, "del_"))
+
+	case action == "buy":
+		if b.Config.DeviceSlotPrice <= 0 {
+			return nil
+		}
+		keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("✅ Купить за %s₽", utils.FormatRub(b.Config.DeviceSlotPrice))).WithCallbackData("dev_buyok"),
+			tu.InlineKeyboardButton("« Назад").WithCallbackData("devices"),
+		))
+		msg := fmt.Sprintf("➕ Дополнительное устройство\n\nСтоимость: %s₽, списывается с баланса.\n"+
+			"Место остаётся за подпиской и сохраняется при продлении.", utils.FormatRub(b.Config.DeviceSlotPrice))
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(keyboard))
+		return nil
+
+	case action == "buyok":
+		if b.Config.DeviceSlotPrice <= 0 {
+			return nil
+		}
+		user, _, _, _ := b.userSubscription(telegramID)
+		if user == nil {
+			return reply("❌ Ошибка: пользователь не найден. Нажмите /start")
+		}
+
+		_, err := b.Subscriptions.AddDeviceSlot(ctx.Context(), b.DB, user, b.Config.DeviceSlotPrice, b.Config.MaxExtraDevices)
+		switch {
+		case errors.Is(err, ledger.ErrInsufficientFunds):
+			keyboard := tu.InlineKeyboard(tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance"),
+			))
+			msg := fmt.Sprintf("❌ Недостаточно средств.\nВаш баланс: %s₽\nСтоимость: %s₽", utils.FormatRub(user.Balance), utils.FormatRub(b.Config.DeviceSlotPrice))
+			_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(keyboard))
+			return nil
+		case errors.Is(err, subscription.ErrNoActiveSubscription):
+			return reply("❌ Дополнительные устройства доступны только при активной подписке.")
+		case errors.Is(err, subscription.ErrNoDeviceLimit):
+			return reply("✅ На вашем тарифе количество устройств не ограничено.")
+		case errors.Is(err, subscription.ErrDeviceSlotsExhausted):
+			return reply(fmt.Sprintf("❌ Можно докупить не больше %d устройств.", b.Config.MaxExtraDevices))
+		case remnawave.IsTransient(err):
+			log.Printf("Panel unavailable, device slot for %d postponed: %v", telegramID, err)
+			return reply(panelUnavailableText)
+		case err != nil:
+			// The panel may already have the new limit if only the commit failed
+			log.Printf("Failed to add device slot for %d, check the panel limit against the ledger: %v", telegramID, err)
+			return reply("❌ Не удалось добавить устройство. Проверьте баланс и список устройств; если что-то не так, напишите в поддержку.")
+		}
+		log.Printf("User %d bought an extra device slot", telegramID)
+
+		_ = reply("✅ Место для ещё одного устройства добавлено.")
+		return b.sendDevices(ctx, telegramID)
+	}
+	return nil
+}
+
+// deleteDevice removes the device with the given key from the panel
+func (b *Bot) deleteDevice(ctx *th.Context, telegramID int64, key string) error {
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	_, sub, _, err := b.userSubscription(telegramID)
+	if err != nil || sub.RemnawaveID == "" {
+		return reply("❌ У вас нет подписки.")
+	}
+
+	devices, err := b.RemnawaveClient.GetDevices(ctx.Context(), sub.RemnawaveID)
+	if err != nil {
+		log.Printf("Failed to get devices of %s: %v", sub.RemnawaveID, err)
+		return reply("⏳ Не удалось удалить устройство. Попробуйте через несколько минут.")
+	}
+
+	for _, device := range devices {
+		if deviceKey(device.HWID) != key {
+			continue
+		}
+		if err := b.RemnawaveClient.DeleteDevice(ctx.Context(), sub.RemnawaveID, device.HWID); err != nil {
+			log.Printf("Failed to delete device of %s: %v", sub.RemnawaveID, err)
+			return reply("⏳ Не удалось удалить устройство. Попробуйте через несколько минут.")
+		}
+		log.Printf("User %d removed device %s", telegramID, deviceTitle(device))
+		_ = reply(fmt.Sprintf("✅ Устройство «%s» удалено.", deviceTitle(device)))
+		return b.sendDevices(ctx, telegramID)
+	}
+
+	_ = reply("Это устройство уже удалено.")
+	return b.sendDevices(ctx, telegramID)
+}
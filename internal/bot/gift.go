@@ -0,0 +1,258 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/gift"
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// giftListLimit is how many gifts "My gifts" shows
+const giftListLimit = 10
+
+// startLink returns a t.me link opening the bot with a /start parameter
+func (b *Bot) startLink(ctx *th.Context, param string) string {
+	botUsername := "popovka_bot" // TODO: Get from config or context
+	if info, err := b.Instance.GetMe(ctx.Context()); err == nil {
+		botUsername = info.Username
+	}
+	return fmt.Sprintf("https://t.me/%s?start=%s", botUsername, param)
+}
+
+// handleGiftCallback handles the gift screens: gift_menu, gift_buy_<plan>,
+// gift_list and gift_refund_<gift>
+func (b *Bot) handleGiftCallback(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	var user models.User
+	if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		return reply("❌ Ошибка: пользователь не найден. Нажмите /start")
+	}
+
+	action := strings.TrimPrefix(callback.Data, "gift_")
+	switch {
+	case action == "menu":
+		return b.sendGiftMenu(ctx, telegramID)
+	case action == "list":
+		return b.sendGiftList(ctx, &user)
+	case strings.HasPrefix(action, "buy_"):
+		planID, err := strconv.ParseUint(strings.TrimPrefix(action, "buy_"), 10, 64)
+		if err != nil {
+			return nil
+		}
+		return b.buyGift(ctx, &user, uint(planID))
+	case strings.HasPrefix(action, "refund_"):
+		giftID, err := strconv.ParseUint(strings.TrimPrefix(action, "refund_"), 10, 64)
+		if err != nil {
+			return nil
+		}
+		return b.refundGift(ctx, &user, uint(giftID))
+	}
+	return nil
+}
+
+// sendGiftMenu lists plans that can be gifted
+func (b *Bot) sendGiftMenu(ctx *th.Context, telegramID int64) error {
+	plans, err := b.Tariffs.ActivePlans()
+	if err != nil {
+		log.Printf("Failed to load plans: %v", err)
+	}
+	if len(plans) == 0 {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Сейчас нет доступных тарифов. Попробуйте позже."))
+		return nil
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, plan := range plans {
+		rows = append(rows, tu.InlineKeyboardRow(
+			tu.InlineKeyboardButton(fmt.Sprintf("🎁 %s - %s₽", plan.Name, utils.FormatRub(plan.Price))).WithCallbackData(fmt.Sprintf("gift_buy_%d", plan.ID)),
+		))
+	}
+	rows = append(rows,
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("📦 Мои подарки").WithCallbackData("gift_list")),
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("« Назад").WithCallbackData("buy_vpn")),
+	)
+
+	msg := "🎁 *Подарить подписку*\n\n" +
+		"Оплатите тариф с баланса и отправьте ссылку другу. " +
+		"Подписка активируется у того, кто первым откроет ссылку.\n\n" +
+		fmt.Sprintf("Если подарок не активируют за %d дн., деньги можно вернуть на баланс.", b.Config.GiftValidityDays)
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return nil
+}
+
+// buyGift pays for a gift from the balance and sends the link to share
+func (b *Bot) buyGift(ctx *th.Context, user *models.User, planID uint) error {
+	telegramID := user.TelegramID
+
+	plan, err := b.Tariffs.GetActivePlan(planID)
+	if err != nil {
+		log.Printf("Failed to get plan %d: %v", planID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Тариф недоступен. Выберите другой."))
+		return nil
+	}
+
+	g, err := b.Gifts.Buy(user, plan)
+	if errors.Is(err, ledger.ErrInsufficientFunds) {
+		var fresh models.User
+		b.DB.First(&fresh, user.ID)
+		keyboard := tu.InlineKeyboard(
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance")),
+			tu.InlineKeyboardRow(tu.InlineKeyboardButton("« Назад").WithCallbackData("gift_menu")),
+		)
+		msg := fmt.Sprintf("❌ Недостаточно средств.\nВаш баланс: %s₽\nСтоимость: %s₽", utils.FormatRub(fresh.Balance), utils.FormatRub(plan.Price))
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(keyboard))
+		return nil
+	}
+	if err != nil {
+		log.Printf("Failed to buy gift for %d: %v", telegramID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось оформить подарок. Средства не списаны."))
+		return nil
+	}
+	log.Printf("User %d bought gift %d (%s)", telegramID, g.ID, plan.Name)
+
+	msg := fmt.Sprintf("🎁 Подарок оплачен: %s\n\n"+
+		"Перешлите эту ссылку получателю:\n`%s`\n\n"+
+		"Ссылка действует до %s и срабатывает один раз. Вы получите уведомление, когда подарок активируют.",
+		plan.Name, b.startLink(ctx, gift.StartPrefix+g.Code), g.ExpiresAt.Format("02.01.2006"))
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown))
+	return nil
+}
+
+// sendGiftList shows the buyer's latest gifts with refund buttons for
+// expired ones
+func (b *Bot) sendGiftList(ctx *th.Context, user *models.User) error {
+	telegramID := user.TelegramID
+
+	var gifts []models.Gift
+	if err := b.DB.Where("buyer_id = ?", user.ID).Order("id DESC").Limit(giftListLimit).Find(&gifts).Error; err != nil {
+		log.Printf("Failed to load gifts of %d: %v", telegramID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось загрузить подарки."))
+		return nil
+	}
+	if len(gifts) == 0 {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "📦 Вы ещё не дарили подписки."))
+		return nil
+	}
+
+	var sb strings.Builder
+	sb.WriteString("📦 *Мои подарки:*\n")
+	var rows [][]telego.InlineKeyboardButton
+	for _, g := range gifts {
+		var status string
+		switch {
+		case g.Status == models.GiftStatusRedeemed:
+			status = "✅ активирован"
+		case g.Status == models.GiftStatusRefunded:
+			status = "↩️ возвращён на баланс"
+		case time.Now().After(g.ExpiresAt):
+			status = "⌛️ срок истёк"
+			rows = append(rows, tu.InlineKeyboardRow(
+				tu.InlineKeyboardButton(fmt.Sprintf("↩️ Вернуть %s₽ (%s)", utils.FormatRub(g.Price), g.PlanName)).WithCallbackData(fmt.Sprintf("gift_refund_%d", g.ID)),
+			))
+		default:
+			status = fmt.Sprintf("⏳ ждёт активации до %s\n`%s`", g.ExpiresAt.Format("02.01.2006"), b.startLink(ctx, gift.StartPrefix+g.Code))
+		}
+		fmt.Fprintf(&sb, "\n🎁 %s, %s — %s\n", g.PlanName, g.CreatedAt.Format("02.01.2006"), status)
+	}
+	rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton("« Назад").WithCallbackData("gift_menu")))
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), sb.String()).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(tu.InlineKeyboard(rows...)))
+	return nil
+}
+
+// refundGift returns an expired gift to the buyer's balance
+func (b *Bot) refundGift(ctx *th.Context, user *models.User, giftID uint) error {
+	telegramID := user.TelegramID
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	g, err := b.Gifts.Refund(giftID, user.ID)
+	switch {
+	case errors.Is(err, gift.ErrNotFound):
+		return reply("❌ Подарок не найден.")
+	case errors.Is(err, gift.ErrNotExpired):
+		return reply(fmt.Sprintf("⏳ Подарок ещё можно активировать до %s. Вернуть деньги можно после этой даты.", g.ExpiresAt.Format("02.01.2006")))
+	case errors.Is(err, gift.ErrNotRefundable):
+		return reply("❌ Подарок уже активирован или возвращён.")
+	case err != nil:
+		log.Printf("Failed to refund gift %d: %v", giftID, err)
+		return reply("❌ Не удалось вернуть средства. Попробуйте позже.")
+	}
+	log.Printf("Gift %d refunded to %d", g.ID, telegramID)
+
+	var fresh models.User
+	b.DB.First(&fresh, user.ID)
+	return reply(fmt.Sprintf("↩️ %s₽ за подарок «%s» возвращены на баланс.\nТекущий баланс: %s₽", utils.FormatRub(g.Price), g.PlanName, utils.FormatRub(fresh.Balance)))
+}
+
+// redeemGift activates a gift opened via /start gift_<code> and notifies
+// the buyer
+func (b *Bot) redeemGift(ctx *th.Context, user *models.User, code string) {
+	telegramID := user.TelegramID
+
+	reply := func(text string) {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+	}
+
+	g, sub, err := b.Gifts.Redeem(ctx.Context(), code, user)
+	switch {
+	case errors.Is(err, gift.ErrNotFound):
+		reply("❌ Подарок не найден. Проверьте ссылку.")
+		return
+	case errors.Is(err, gift.ErrRedeemed):
+		reply("❌ Этот подарок уже активирован.")
+		return
+	case errors.Is(err, gift.ErrExpired):
+		reply("❌ Срок действия подарка истёк.")
+		return
+	case errors.Is(err, gift.ErrOwnGift):
+		reply("🎁 Это ваш подарок — перешлите ссылку тому, кому хотите подарить подписку.")
+		return
+	case remnawave.IsTransient(err):
+		log.Printf("Panel unavailable, gift for %d postponed: %v", telegramID, err)
+		reply("⏳ VPN-панель временно недоступна. Откройте ссылку на подарок ещё раз через несколько минут.")
+		return
+	case err != nil:
+		log.Printf("Failed to redeem gift %s for %d: %v", code, telegramID, err)
+		reply("❌ Не удалось активировать подарок. Попробуйте открыть ссылку ещё раз позже.")
+		return
+	}
+	log.Printf("Gift %d redeemed by %d", g.ID, telegramID)
+
+	msg := fmt.Sprintf("🎁 Вам подарили подписку «%s»!\n\n📅 Действует до: %s\n\n🔗 *Ссылка на VPN:*\n%s", g.PlanName, sub.ExpirationDate.Format("02.01.2006"), sub.SubscriptionURL)
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown))
+
+	var buyer models.User
+	if err := b.DB.First(&buyer, g.BuyerID).Error; err != nil {
+		log.Printf("Failed to load buyer of gift %d: %v", g.ID, err)
+		return
+	}
+	recipient := "Получатель"
+	if user.Username != "" {
+		recipient = "@" + user.Username
+	}
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(buyer.TelegramID), fmt.Sprintf("🎉 %s активировал(а) ваш подарок «%s».", recipient, g.PlanName)))
+}
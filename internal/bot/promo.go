@@ -0,0 +1,334 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/fsm"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// promoUsage is the /promo help shown to admins
+const promoUsage = "Использование:\n" +
+	"/promo add <КОД> <percent|credit|days> <значение> [max=N] [per_user=N] [from=ГГГГ-ММ-ДД] [until=ГГГГ-ММ-ДД] [plans=1,2]\n" +
+	"/promo list\n" +
+	"/promo off <КОД>\n\n" +
+	"percent — скидка в %, credit — бонус в ₽ к пополнению, days — дни к покупке тарифа."
+
+// promoListLimit is how many codes /promo list shows
+const promoListLimit = 20
+
+// pendingPromo returns the promo code the user has entered, or nil
+func (b *Bot) pendingPromo(telegramID int64) *models.PromoCode {
+	var user models.User
+	if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		return nil
+	}
+	code, err := promo.Pending(b.DB, user.ID)
+	if err != nil {
+		log.Printf("Failed to load promo code of %d: %v", telegramID, err)
+	}
+	return code
+}
+
+// planButtonText is a plan in the purchase list, priced with the quote
+func planButtonText(plan *models.Plan, quote promo.Quote) string {
+	switch {
+	case quote.Discount > 0:
+		return fmt.Sprintf("🚀 %s - %s₽ (вместо %s₽)", plan.Name, utils.FormatRub(quote.Price), utils.FormatRub(plan.Price))
+	case quote.BonusDays > 0:
+		return fmt.Sprintf("🚀 %s - %s₽ (+%d дн.)", plan.Name, utils.FormatRub(quote.Price), quote.BonusDays)
+	}
+	return fmt.Sprintf("🚀 %s - %s₽", plan.Name, utils.FormatRub(quote.Price))
+}
+
+// planCallback is the callback data of a plan button. It carries the price
+// and code shown, so the purchase charges exactly what the user agreed to.
+func planCallback(plan *models.Plan, quote promo.Quote) string {
+	var codeID uint
+	if quote.Code != nil {
+		codeID = quote.Code.ID
+	}
+	return fmt.Sprintf("buy_plan_%d_%d_%d", plan.ID, quote.Price, codeID)
+}
+
+// parsePlanCallback reverses planCallback. The expected quote has only the
+// price and the code ID set.
+func parsePlanCallback(data string) (planID uint, expected promo.Quote, ok bool) {
+	parts := strings.Split(strings.TrimPrefix(data, "buy_plan_"), "_")
+	if len(parts) != 3 {
+		return 0, promo.Quote{}, false
+	}
+	id, err1 := strconv.ParseUint(parts[0], 10, 64)
+	price, err2 := strconv.ParseInt(parts[1], 10, 64)
+	codeID, err3 := strconv.ParseUint(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return 0, promo.Quote{}, false
+	}
+
+	expected = promo.Quote{Price: price}
+	if codeID != 0 {
+		expected.Code = &models.PromoCode{ID: uint(codeID)}
+	}
+	return uint(id), expected, true
+}
+
+// handlePromoEnter asks the user for a promo code
+func (b *Bot) handlePromoEnter(ctx *th.Context, update telego.Update) error {
+	telegramID := update.CallbackQuery.From.ID
+
+	if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateWaitingPromoCode, nil); err != nil {
+		log.Printf("Failed to set state for %d: %v", telegramID, err)
+	}
+
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "🎟 Введите промокод:\n\n/cancel — отмена"))
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(update.CallbackQuery.ID))
+	return nil
+}
+
+// handlePromoInput activates the code the user has sent
+func (b *Bot) handlePromoInput(ctx *th.Context, message *telego.Message) error {
+	telegramID := message.From.ID
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	var user models.User
+	if err := b.DB.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
+		log.Printf("Failed to get/create user: %v", err)
+		return reply("❌ Ошибка. Попробуйте позже.")
+	}
+
+	code, err := promo.Activate(b.DB, &user, message.Text)
+	switch {
+	case errors.Is(err, promo.ErrNotFound):
+		return reply("❌ Промокод не найден. Проверьте написание и отправьте ещё раз:")
+	case errors.Is(err, promo.ErrNotStarted):
+		return reply("❌ Промокод ещё не действует.")
+	case errors.Is(err, promo.ErrExpired):
+		return reply("❌ Срок действия промокода истёк.")
+	case errors.Is(err, promo.ErrExhausted):
+		return reply("❌ Промокод больше недоступен: все активации использованы.")
+	case errors.Is(err, promo.ErrAlreadyUsed):
+		return reply("❌ Вы уже использовали этот промокод.")
+	case err != nil:
+		log.Printf("Failed to activate promo code for %d: %v", telegramID, err)
+		return reply("❌ Не удалось применить промокод. Попробуйте позже.")
+	}
+
+	if err := b.FSM.Clear(ctx.Context(), telegramID); err != nil {
+		log.Printf("Failed to clear state for %d: %v", telegramID, err)
+	}
+
+	next := "Он будет применён к следующей покупке тарифа."
+	button := tu.InlineKeyboardButton("🚀 Купить VPN").WithCallbackData("buy_vpn")
+	if code.Type == models.PromoTypeCredit {
+		next = "Бонус будет начислен при следующем пополнении баланса."
+		button = tu.InlineKeyboardButton("💰 Пополнить баланс").WithCallbackData("topup_balance")
+	}
+
+	msg := fmt.Sprintf("✅ Промокод %s активирован: %s.\n%s", code.Code, promo.Describe(code), next)
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithReplyMarkup(tu.InlineKeyboard(tu.InlineKeyboardRow(button))))
+	return nil
+}
+
+// handlePromoCommand manages promo codes: /promo add|list|off
+func (b *Bot) handlePromoCommand(ctx *th.Context, update telego.Update) error {
+	telegramID := update.Message.From.ID
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	_, _, args := tu.ParseCommand(update.Message.Text)
+	if len(args) == 0 {
+		return reply(promoUsage)
+	}
+
+	switch args[0] {
+	case "add":
+		code, err := parsePromoArgs(args[1:])
+		if err != nil {
+			return reply(fmt.Sprintf("❌ %v\n\n%s", err, promoUsage))
+		}
+		code.CreatedBy = telegramID
+
+		var count int64
+		b.DB.Model(&models.PromoCode{}).Where("code = ?", code.Code).Count(&count)
+		if count > 0 {
+			return reply(fmt.Sprintf("❌ Промокод %s уже существует.", code.Code))
+		}
+		if err := b.DB.Create(&code).Error; err != nil {
+			log.Printf("Failed to create promo code %s: %v", code.Code, err)
+			return reply("❌ Не удалось создать промокод. Подробности в логах.")
+		}
+		log.Printf("Admin %d created promo code %s (%s %d)", telegramID, code.Code, code.Type, code.Value)
+		return reply(fmt.Sprintf("✅ Промокод %s создан: %s.", code.Code, promo.Describe(&code)))
+
+	case "list":
+		return reply(b.promoList())
+
+	case "off":
+		if len(args) != 2 {
+			return reply(promoUsage)
+		}
+		name := promo.Normalize(args[1])
+		result := b.DB.Model(&models.PromoCode{}).Where("code = ?", name).Update("is_active", false)
+		if result.Error != nil {
+			log.Printf("Failed to disable promo code %s: %v", name, result.Error)
+			return reply("❌ Не удалось отключить промокод.")
+		}
+		if result.RowsAffected == 0 {
+			return reply(fmt.Sprintf("❌ Промокод %s не найден.", name))
+		}
+		log.Printf("Admin %d disabled promo code %s", telegramID, name)
+		return reply(fmt.Sprintf("⏸ Промокод %s отключён.", name))
+	}
+	return reply(promoUsage)
+}
+
+// promoList reports the latest codes with their redemption totals
+func (b *Bot) promoList() string {
+	var codes []models.PromoCode
+	if err := b.DB.Order("id DESC").Limit(promoListLimit).Find(&codes).Error; err != nil {
+		log.Printf("Failed to load promo codes: %v", err)
+		return "❌ Не удалось загрузить промокоды."
+	}
+	if len(codes) == 0 {
+		return "Промокодов пока нет."
+	}
+
+	var sb strings.Builder
+	sb.WriteString("🎟 Промокоды:\n")
+	for _, code := range codes {
+		var total struct {
+			Amount int64
+			Days   int64
+		}
+		if err := b.DB.Model(&models.PromoRedemption{}).
+			Select("COALESCE(SUM(amount), 0) AS amount, COALESCE(SUM(days), 0) AS days").
+			Where("promo_code_id = ?", code.ID).
+			Scan(&total).Error; err != nil {
+			log.Printf("Failed to sum redemptions of %s: %v", code.Code, err)
+		}
+
+		limit := "∞"
+		if code.MaxUses > 0 {
+			limit = strconv.Itoa(code.MaxUses)
+		}
+		status := ""
+		if !code.IsActive {
+			status = " ⏸"
+		}
+		fmt.Fprintf(&sb, "\n%s%s — %s\nИспользований: %d/%s", code.Code, status, promo.Describe(&code), code.Uses, limit)
+		switch {
+		case total.Amount > 0:
+			fmt.Fprintf(&sb, ", всего %s₽", utils.FormatRub(total.Amount))
+		case total.Days > 0:
+			fmt.Fprintf(&sb, ", всего %d дн.", total.Days)
+		}
+		if code.ValidUntil != nil {
+			fmt.Fprintf(&sb, "\nДо: %s", code.ValidUntil.Format("02.01.2006"))
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// parsePromoArgs parses the arguments of /promo add
+func parsePromoArgs(args []string) (models.PromoCode, error) {
+	if len(args) < 3 {
+		return models.PromoCode{}, errors.New("не хватает аргументов")
+	}
+
+	code := models.PromoCode{
+		Code:           promo.Normalize(args[0]),
+		Type:           strings.ToLower(args[1]),
+		MaxUsesPerUser: 1,
+		IsActive:       true,
+	}
+	if len(code.Code) > 64 {
+		return code, errors.New("слишком длинный код")
+	}
+
+	var err error
+	switch code.Type {
+	case models.PromoTypePercent:
+		code.Value, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || code.Value < 1 || code.Value > 100 {
+			return code, errors.New("скидка должна быть от 1 до 100%")
+		}
+	case models.PromoTypeCredit:
+		code.Value, err = utils.ParseRub(args[2])
+		if err != nil || code.Value <= 0 {
+			return code, errors.New("некорректная сумма бонуса")
+		}
+	case models.PromoTypeDays:
+		code.Value, err = strconv.ParseInt(args[2], 10, 64)
+		if err != nil || code.Value < 1 || code.Value > maxAdminExtendDays {
+			return code, fmt.Errorf("количество дней должно быть от 1 до %d", maxAdminExtendDays)
+		}
+	default:
+		return code, fmt.Errorf("неизвестный тип %q", args[1])
+	}
+
+	for _, option := range args[3:] {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok {
+			return code, fmt.Errorf("некорректный параметр %q", option)
+		}
+		switch key {
+		case "max":
+			code.MaxUses, err = strconv.Atoi(value)
+			if err != nil || code.MaxUses < 0 {
+				return code, errors.New("некорректный max")
+			}
+		case "per_user":
+			code.MaxUsesPerUser, err = strconv.Atoi(value)
+			if err != nil || code.MaxUsesPerUser < 0 {
+				return code, errors.New("некорректный per_user")
+			}
+		case "from", "until":
+			day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return code, fmt.Errorf("некорректная дата %q", value)
+			}
+			if key == "from" {
+				code.ValidFrom = &day
+			} else {
+				end := day.AddDate(0, 0, 1).Add(-time.Second) // The whole last day
+				code.ValidUntil = &end
+			}
+		case "plans":
+			for _, item := range strings.Split(value, ",") {
+				if _, err := strconv.ParseUint(item, 10, 64); err != nil {
+					return code, fmt.Errorf("некорректный тариф %q", item)
+				}
+			}
+			code.PlanIDs = value
+		default:
+			return code, fmt.Errorf("неизвестный параметр %q", key)
+		}
+	}
+
+	if code.ValidFrom != nil && code.ValidUntil != nil && code.ValidUntil.Before(*code.ValidFrom) {
+		return code, errors.New("дата окончания раньше даты начала")
+	}
+	return code, nil
+}
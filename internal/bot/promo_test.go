@@ -0,0 +1,78 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
+)
+
+func TestParsePromoArgs(t *testing.T) {
+	code, err := parsePromoArgs(strings.Fields("spring percent 15 max=100 per_user=0 from=2026-03-01 until=2026-03-31 plans=1,2"))
+	if err != nil {
+		t.Fatalf("parsePromoArgs: %v", err)
+	}
+	if code.Code != "SPRING" || code.Type != models.PromoTypePercent || code.Value != 15 {
+		t.Errorf("code = %s %s %d, want SPRING percent 15", code.Code, code.Type, code.Value)
+	}
+	if code.MaxUses != 100 || code.MaxUsesPerUser != 0 || code.PlanIDs != "1,2" {
+		t.Errorf("limits = %d/%d plans %q, want 100/0 plans \"1,2\"", code.MaxUses, code.MaxUsesPerUser, code.PlanIDs)
+	}
+	wantUntil := time.Date(2026, 3, 31, 23, 59, 59, 0, time.Local)
+	if code.ValidFrom == nil || code.ValidUntil == nil || !code.ValidUntil.Equal(wantUntil) {
+		t.Errorf("window = %v..%v, want until %v", code.ValidFrom, code.ValidUntil, wantUntil)
+	}
+
+	credit, err := parsePromoArgs(strings.Fields("GIFT credit 150.50"))
+	if err != nil {
+		t.Fatalf("parsePromoArgs: %v", err)
+	}
+	if credit.Value != 15050 || credit.MaxUsesPerUser != 1 {
+		t.Errorf("credit = %d per user %d, want 15050 per user 1", credit.Value, credit.MaxUsesPerUser)
+	}
+
+	for _, args := range []string{
+		"CODE percent",
+		"CODE percent 150",
+		"CODE days 0",
+		"CODE free 10",
+		"CODE days 7 max=-1",
+		"CODE days 7 plans=1,x",
+		"CODE days 7 color=red",
+		"CODE days 7 from=2026-05-01 until=2026-04-01",
+	} {
+		if _, err := parsePromoArgs(strings.Fields(args)); err == nil {
+			t.Errorf("parsePromoArgs(%q) succeeded, want error", args)
+		}
+	}
+}
+
+func TestPlanCallback(t *testing.T) {
+	plan := &models.Plan{ID: 3, Price: 29900}
+	code := &models.PromoCode{ID: 7, Type: models.PromoTypePercent, Value: 50, IsActive: true}
+
+	for _, shown := range []promo.Quote{promo.Apply(nil, plan), promo.Apply(code, plan)} {
+		data := planCallback(plan, shown)
+		if len(data) > 64 {
+			t.Errorf("callback data %q is longer than Telegram allows", data)
+		}
+		planID, expected, ok := parsePlanCallback(data)
+		if !ok || planID != plan.ID || !expected.Same(shown) {
+			t.Errorf("parsePlanCallback(%q) = %d, %+v, %v, want plan %d and the shown quote", data, planID, expected, ok, plan.ID)
+		}
+	}
+
+	// The code expired after the menu was shown: full price no longer matches
+	_, expected, _ := parsePlanCallback(planCallback(plan, promo.Apply(code, plan)))
+	if expected.Same(promo.Apply(nil, plan)) {
+		t.Error("a discounted button matches the full price")
+	}
+
+	for _, data := range []string{"buy_plan_3", "buy_plan_3_x_0", "buy_plan_3_100"} {
+		if _, _, ok := parsePlanCallback(data); ok {
+			t.Errorf("parsePlanCallback(%q) accepted malformed data", data)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"popovka-bot/internal/payment"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// handleRefundCommand issues a full or partial YooKassa refund:
+// /refund <payment_id> [amount]
+func (b *Bot) handleRefundCommand(ctx *th.Context, update telego.Update) error {
+	message := update.Message
+	telegramID := message.From.ID
+
+	if !b.isAdmin(telegramID) {
+		return nil
+	}
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(message.Chat.ID), text))
+		return nil
+	}
+
+	_, _, args := tu.ParseCommand(message.Text)
+	if len(args) < 1 || len(args) > 2 {
+		return reply("Использование: /refund <payment_id> [сумма]\nБез суммы оформляется полный возврат.")
+	}
+
+	var amount int64 // 0 means the whole refundable amount
+	if len(args) == 2 {
+		parsed, err := utils.ParseRub(args[1])
+		if err != nil || parsed <= 0 {
+			return reply("❌ Некорректная сумма.")
+		}
+		amount = parsed
+	}
+
+	refund, err := b.Payments.RequestRefund(ctx.Context(), args[0], amount, fmt.Sprintf("Возврат по обращению в поддержку (admin %d)", telegramID))
+	switch {
+	case errors.Is(err, payment.ErrPaymentNotFound):
+		return reply("❌ Успешный платёж с таким ID не найден.")
+	case errors.Is(err, payment.ErrInvalidRefundAmount):
+		return reply(fmt.Sprintf("❌ %v", err))
+	case err != nil && refund == nil:
+		log.Printf("Failed to create refund for %s: %v", args[0], err)
+		return reply("❌ Не удалось оформить возврат. Подробности в логах.")
+	case err != nil:
+		log.Printf("Refund %s created but not applied: %v", refund.ID, err)
+		return reply(fmt.Sprintf("⚠️ Возврат %s создан в ЮKassa, но не применён к балансу/подписке. Он будет применён по вебхуку.", refund.ID))
+	}
+
+	return reply(fmt.Sprintf("✅ Возврат %s на %s₽ оформлен (статус: %s).", refund.ID, refund.Amount.Value, refund.Status))
+}
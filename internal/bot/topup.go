@@ -0,0 +1,147 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"popovka-bot/internal/fsm"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/payment"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// provider returns the enabled payment provider with the given name
+func (b *Bot) provider(name string) payment.Provider {
+	for _, p := range b.Providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// startTopUp creates a top-up with the provider and sends the payment link
+func (b *Bot) startTopUp(ctx *th.Context, telegramID int64, provider payment.Provider, amount int64) error {
+	var user models.User
+	if err := b.DB.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
+		log.Printf("Failed to get/create user: %v", err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при создании платежа."))
+		return nil
+	}
+
+	// Receipts need a contact, ask for it once before the first payment that
+	// has a receipt; the top-up continues once it is saved
+	if provider.NeedsReceiptContact() && user.Email == "" && user.Phone == "" {
+		payload := fsm.TopUpPayload{Provider: provider.Name(), Amount: amount}
+		if err := b.FSM.Set(ctx.Context(), telegramID, fsm.StateWaitingContact, payload); err != nil {
+			log.Printf("Failed to set state for %d: %v", telegramID, err)
+		}
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "🧾 Укажите email или номер телефона для получения электронного чека:"))
+		return nil
+	}
+
+	paymentURL, err := provider.CreateTopUp(ctx.Context(), &user, amount)
+	if err != nil {
+		log.Printf("Failed to create %s topup payment: %v", provider.Name(), err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Ошибка при создании платежа."))
+		return nil
+	}
+
+	// Providers like Stars have already sent the payment form to the chat
+	if paymentURL != "" {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
+			tu.ID(telegramID),
+			fmt.Sprintf("💳 Ссылка для пополнения на %s₽:\n%s", utils.FormatRub(amount), paymentURL),
+		))
+	}
+	return nil
+}
+
+// handleReceiptContact saves the email or phone for receipts and starts the
+// top-up that asked for it
+func (b *Bot) handleReceiptContact(ctx *th.Context, telegramID int64, text string, session fsm.Session) error {
+	email, phone, ok := payment.ParseReceiptContact(text)
+	if !ok {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Некорректный email или номер телефона. Попробуйте ещё раз:"))
+		return nil
+	}
+
+	column, value := "email", email
+	if phone != "" {
+		column, value = "phone", phone
+	}
+	if err := b.DB.Model(&models.User{}).Where("telegram_id = ?", telegramID).Update(column, value).Error; err != nil {
+		log.Printf("Failed to save receipt contact for %d: %v", telegramID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Не удалось сохранить контакт. Попробуйте позже."))
+		return nil
+	}
+	if err := b.FSM.Clear(ctx.Context(), telegramID); err != nil {
+		log.Printf("Failed to clear state for %d: %v", telegramID, err)
+	}
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "✅ Контакт для чеков сохранён."))
+
+	var payload fsm.TopUpPayload
+	if err := session.Decode(&payload); err != nil {
+		log.Printf("Failed to decode top-up of %d: %v", telegramID, err)
+	}
+	provider := b.provider(payload.Provider)
+	if provider == nil || payload.Amount < minTopUpAmount {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), "❌ Способ оплаты недоступен. Начните пополнение заново."))
+		return nil
+	}
+	return b.startTopUp(ctx, telegramID, provider, payload.Amount)
+}
+
+// handleTopUpProvider handles topup_pay_<provider>_<amount> callbacks
+func (b *Bot) handleTopUpProvider(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	// Provider names may contain underscores, the amount is always last
+	data := strings.TrimPrefix(callback.Data, "topup_pay_")
+	sep := strings.LastIndex(data, "_")
+	name, amountStr := data[:max(sep, 0)], data[sep+1:]
+	amount, err := strconv.ParseInt(amountStr, 10, 64)
+	provider := b.provider(name)
+	if sep < 0 || err != nil || amount < minTopUpAmount || provider == nil {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(callback.From.ID), "❌ Способ оплаты недоступен. Начните пополнение заново."))
+		return nil
+	}
+
+	return b.startTopUp(ctx, callback.From.ID, provider, amount)
+}
+
+// handlePreCheckout confirms Telegram Stars invoices before the user is charged
+func (b *Bot) handlePreCheckout(ctx *th.Context, update telego.Update) error {
+	query := update.PreCheckoutQuery
+
+	if err := b.Payments.ValidateStarsCheckout(query); err != nil {
+		log.Printf("Rejected pre-checkout %s from %d: %v", query.ID, query.From.ID, err)
+		_ = ctx.Bot().AnswerPreCheckoutQuery(ctx.Context(), tu.PreCheckoutQuery(query.ID, false).
+			WithErrorMessage("Счёт устарел. Пожалуйста, начните пополнение заново."))
+		return nil
+	}
+
+	_ = ctx.Bot().AnswerPreCheckoutQuery(ctx.Context(), tu.PreCheckoutQuery(query.ID, true))
+	return nil
+}
+
+// handleSuccessfulPayment credits a paid Telegram Stars invoice
+func (b *Bot) handleSuccessfulPayment(ctx *th.Context, update telego.Update) error {
+	message := update.Message
+
+	if err := b.Payments.ProcessStarsPayment(ctx.Context(), message.From.ID, message.SuccessfulPayment); err != nil {
+		log.Printf("Failed to process stars payment %s: %v", message.SuccessfulPayment.TelegramPaymentChargeID, err)
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(
+			tu.ID(message.Chat.ID),
+			"⚠️ Оплата получена, но не зачислена автоматически. Напишите в поддержку, мы всё исправим.",
+		))
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
+
+	"github.com/mymmrac/telego"
+	th "github.com/mymmrac/telego/telegohandler"
+	tu "github.com/mymmrac/telego/telegoutil"
+)
+
+// trialAvailable reports whether the user may still claim the free trial
+func (b *Bot) trialAvailable(user *models.User) bool {
+	if b.Config.TrialDays <= 0 || user.TrialUsedAt != nil {
+		return false
+	}
+
+	var count int64
+	if err := b.DB.Model(&models.Subscription{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+		log.Printf("Failed to check subscriptions of %d: %v", user.TelegramID, err)
+		return false
+	}
+	return count == 0
+}
+
+// trialTitle describes the trial on its button
+func (b *Bot) trialTitle() string {
+	if b.Config.TrialTrafficLimitBytes > 0 {
+		return fmt.Sprintf("🎁 Попробовать бесплатно: %d дн., %d ГБ", b.Config.TrialDays, b.Config.TrialTrafficLimitBytes>>30)
+	}
+	return fmt.Sprintf("🎁 Попробовать бесплатно: %d дн.", b.Config.TrialDays)
+}
+
+// handleTrial activates the one-time free trial
+func (b *Bot) handleTrial(ctx *th.Context, update telego.Update) error {
+	callback := update.CallbackQuery
+	telegramID := callback.From.ID
+	_ = ctx.Bot().AnswerCallbackQuery(ctx.Context(), tu.CallbackQuery(callback.ID))
+
+	reply := func(text string) error {
+		_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), text))
+		return nil
+	}
+
+	if b.Config.TrialDays <= 0 {
+		return reply("❌ Пробный период сейчас недоступен.")
+	}
+
+	var user models.User
+	if err := b.DB.Where("telegram_id = ?", telegramID).First(&user).Error; err != nil {
+		return reply("❌ Ошибка: пользователь не найден. Нажмите /start")
+	}
+
+	sub, err := b.Subscriptions.StartTrial(ctx.Context(), b.DB, &user, b.Config.TrialDays, b.Config.TrialTrafficLimitBytes)
+	if errors.Is(err, subscription.ErrTrialUnavailable) {
+		return reply("❌ Пробный период можно активировать только один раз и только до первой покупки.")
+	}
+	if remnawave.IsTransient(err) {
+		log.Printf("Panel unavailable, trial for %d postponed: %v", telegramID, err)
+		return reply("⏳ VPN-панель временно недоступна, попробуйте через несколько минут.")
+	}
+	if err != nil {
+		log.Printf("Failed to start trial for %d: %v", telegramID, err)
+		return reply("❌ Ошибка при активации пробного периода. Попробуйте позже.")
+	}
+
+	msg := fmt.Sprintf("🎁 Пробный период активирован!\n\n📅 Действует до: %s", sub.ExpirationDate.Format("02.01.2006"))
+	if b.Config.TrialTrafficLimitBytes > 0 {
+		msg += fmt.Sprintf("\n📶 Трафик: %d ГБ", b.Config.TrialTrafficLimitBytes>>30)
+	}
+	msg += fmt.Sprintf("\n\n🔗 *Ссылка на VPN:*\n%s\n\nПосле покупки тарифа эта же ссылка продолжит работать.", sub.SubscriptionURL)
+
+	keyboard := tu.InlineKeyboard(
+		tu.InlineKeyboardRow(tu.InlineKeyboardButton("📖 Инструкция").WithCallbackData("instruction")),
+	)
+	_, _ = ctx.Bot().SendMessage(ctx.Context(), tu.Message(tu.ID(telegramID), msg).WithParseMode(telego.ModeMarkdown).WithReplyMarkup(keyboard))
+	return nil
+}
@@ -0,0 +1,124 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/mymmrac/telego"
+)
+
+// webhookPath is where Telegram delivers updates in webhook mode
+const webhookPath = "/telegram-webhook"
+
+// receiveUpdates subscribes to Telegram updates: through a webhook on mux
+// when TelegramWebhookURL is configured, otherwise by long polling. The
+// returned function stops receiving and closes the channel.
+//
+// In webhook mode the webhook is (re)set on every start and never deleted on
+// shutdown, so replicas behind a load balancer can restart one by one. Long
+// polling mode deletes any webhook left over, as getUpdates fails while one
+// is set.
+func (b *Bot) receiveUpdates(ctx context.Context, mux *http.ServeMux) (<-chan telego.Update, func(), error) {
+	// Receiving is stopped explicitly, after the bot stopped accepting updates
+	updatesCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+
+	if b.Config.TelegramWebhookURL == "" {
+		if err := b.Instance.DeleteWebhook(ctx, &telego.DeleteWebhookParams{}); err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to delete webhook: %w", err)
+		}
+
+		updates, err := b.Instance.UpdatesViaLongPolling(updatesCtx, nil)
+		if err != nil {
+			cancel()
+			return nil, nil, fmt.Errorf("failed to start long polling: %w", err)
+		}
+		log.Println("Receiving Telegram updates via long polling")
+		return updates, cancel, nil
+	}
+
+	if b.Config.TelegramWebhookSecret == "" {
+		cancel()
+		return nil, nil, errors.New("TELEGRAM_WEBHOOK_SECRET is required in webhook mode")
+	}
+
+	receiver := &webhookReceiver{secret: b.Config.TelegramWebhookSecret}
+	url := strings.TrimRight(b.Config.TelegramWebhookURL, "/") + webhookPath
+	updates, err := b.Instance.UpdatesViaWebhook(updatesCtx,
+		receiver.register(mux, "POST "+webhookPath),
+		telego.WithWebhookSet(ctx, &telego.SetWebhookParams{
+			URL:         url,
+			SecretToken: b.Config.TelegramWebhookSecret,
+		}),
+	)
+	if err != nil {
+		cancel()
+		return nil, nil, fmt.Errorf("failed to set webhook: %w", err)
+	}
+
+	log.Printf("Receiving Telegram updates via webhook at %s", url)
+	return updates, func() {
+		receiver.close()
+		cancel()
+	}, nil
+}
+
+// webhookReceiver serves Telegram webhook requests. After close it answers
+// 503, so Telegram redelivers the update later (to another replica).
+type webhookReceiver struct {
+	secret string
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// maxUpdateSize limits the webhook request body
+const maxUpdateSize = 1 << 20
+
+func (w *webhookReceiver) register(mux *http.ServeMux, pattern string) func(handler telego.WebhookHandler) error {
+	return func(handler telego.WebhookHandler) error {
+		mux.HandleFunc(pattern, func(rw http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get(telego.WebhookSecretTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(token), []byte(w.secret)) != 1 {
+				http.Error(rw, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			data, err := io.ReadAll(io.LimitReader(r.Body, maxUpdateSize))
+			if err != nil {
+				http.Error(rw, "Bad request", http.StatusBadRequest)
+				return
+			}
+
+			// Holding the read lock keeps the updates channel open until the
+			// update is handed over
+			w.mu.RLock()
+			defer w.mu.RUnlock()
+			if w.closed {
+				http.Error(rw, "Shutting down", http.StatusServiceUnavailable)
+				return
+			}
+
+			if err := handler(r.Context(), data); err != nil {
+				log.Printf("Failed to accept Telegram update: %v", err)
+				http.Error(rw, "Internal server error", http.StatusInternalServerError)
+				return
+			}
+			rw.WriteHeader(http.StatusOK)
+		})
+		return nil
+	}
+}
+
+func (w *webhookReceiver) close() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+}
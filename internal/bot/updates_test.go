@@ -0,0 +1,80 @@
+package bot
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/testutil"
+
+	"github.com/mymmrac/telego"
+)
+
+func TestWebhookReceivesUpdates(t *testing.T) {
+	tg := testutil.NewTelegram(t)
+	b := &Bot{
+		Instance: tg.Bot,
+		Config: &config.Config{
+			TelegramWebhookURL:    "https://bot.example.com/",
+			TelegramWebhookSecret: "s3cret",
+		},
+	}
+
+	mux := http.NewServeMux()
+	updates, stop, err := b.receiveUpdates(context.Background(), mux)
+	if err != nil {
+		t.Fatalf("receiveUpdates: %v", err)
+	}
+	if n := tg.Calls("setWebhook"); n != 1 {
+		t.Errorf("setWebhook called %d times, want 1", n)
+	}
+
+	post := func(secret string) int {
+		req := httptest.NewRequest(http.MethodPost, webhookPath, strings.NewReader(`{"update_id": 42}`))
+		req.Header.Set(telego.WebhookSecretTokenHeader, secret)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d, want 401", code)
+	}
+
+	if code := post("s3cret"); code != http.StatusOK {
+		t.Fatalf("valid update: status %d, want 200", code)
+	}
+	select {
+	case update := <-updates:
+		if update.UpdateID != 42 {
+			t.Errorf("update ID = %d, want 42", update.UpdateID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("update was not delivered")
+	}
+
+	// After shutdown updates are refused so Telegram redelivers them
+	stop()
+	if code := post("s3cret"); code != http.StatusServiceUnavailable {
+		t.Errorf("after stop: status %d, want 503", code)
+	}
+}
+
+func TestWebhookRequiresSecret(t *testing.T) {
+	tg := testutil.NewTelegram(t)
+	b := &Bot{
+		Instance: tg.Bot,
+		Config:   &config.Config{TelegramWebhookURL: "https://bot.example.com"},
+	}
+
+	if _, _, err := b.receiveUpdates(context.Background(), http.NewServeMux()); err == nil {
+		t.Fatal("webhook mode started without a secret")
+	}
+	if n := tg.Calls("setWebhook"); n != 0 {
+		t.Errorf("setWebhook called %d times, want 0", n)
+	}
+}
@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/utils"
+
+	th "github.com/mymmrac/telego/telegohandler"
+)
+
+// usageText describes traffic and connections of the subscription for the
+// profile, or returns "" if the panel can't be reached
+func (b *Bot) usageText(ctx *th.Context, sub *models.Subscription) string {
+	usage, err := b.Usage.Get(ctx.Context(), sub.RemnawaveID)
+	if err != nil {
+		log.Printf("Failed to get usage of %s: %v", sub.RemnawaveID, err)
+		return ""
+	}
+	return formatUsage(usage, time.Now())
+}
+
+func formatUsage(usage *remnawave.Usage, now time.Time) string {
+	traffic := utils.FormatBytes(usage.UsedTrafficBytes) + " (безлимит)"
+	if remaining := usage.RemainingBytes(); remaining >= 0 {
+		traffic = fmt.Sprintf("%s из %s, осталось %s", utils.FormatBytes(usage.UsedTrafficBytes), utils.FormatBytes(usage.TrafficLimitBytes), utils.FormatBytes(remaining))
+	}
+	text := fmt.Sprintf("\n🔹 Трафик: %s", traffic)
+
+	switch {
+	case usage.Online(now):
+		text += "\n🔹 Статус подключения: 🟢 онлайн"
+	case usage.OnlineAt != nil:
+		text += fmt.Sprintf("\n🔹 Статус подключения: ⚪️ не в сети\n🔹 Последнее подключение: %s", usage.OnlineAt.Local().Format("02.01.2006 15:04"))
+	default:
+		text += "\n🔹 Статус подключения: ⚪️ ещё не подключались"
+	}
+	if usage.LastNode != "" {
+		text += "\n🔹 Сервер: " + escapeMarkdown(usage.LastNode)
+	}
+	return text
+}
+
+// markdownEscaper escapes the characters legacy Markdown treats as markup
+var markdownEscaper = strings.NewReplacer("_", "\\_", "*", "\\*", "`", "\\`", "[", "\\[")
+
+// escapeMarkdown makes panel-provided text safe to send with ModeMarkdown
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
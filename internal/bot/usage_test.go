@@ -0,0 +1,46 @@
+package bot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/remnawave"
+)
+
+func TestFormatUsage(t *testing.T) {
+	now := time.Now()
+	recently := now.Add(-time.Minute)
+	yesterday := now.Add(-24 * time.Hour)
+
+	tests := []struct {
+		usage remnawave.Usage
+		want  []string
+	}{
+		{
+			usage: remnawave.Usage{UsedTrafficBytes: 3 << 29, TrafficLimitBytes: 10 << 30, OnlineAt: &recently, LastNode: "Frankfurt"},
+			want:  []string{"1.50 ГБ из 10.00 ГБ, осталось 8.50 ГБ", "онлайн", "Frankfurt"},
+		},
+		{
+			usage: remnawave.Usage{UsedTrafficBytes: 200 << 20, OnlineAt: &yesterday},
+			want:  []string{"200.0 МБ (безлимит)", "не в сети", yesterday.Format("02.01.2006 15:04")},
+		},
+		{
+			usage: remnawave.Usage{},
+			want:  []string{"0 КБ (безлимит)", "ещё не подключались"},
+		},
+		{
+			usage: remnawave.Usage{LastNode: "de_fra*1 `[main]"},
+			want:  []string{"Сервер: de\\_fra\\*1 \\`\\[main]"},
+		},
+	}
+
+	for _, tt := range tests {
+		text := formatUsage(&tt.usage, now)
+		for _, want := range tt.want {
+			if !strings.Contains(text, want) {
+				t.Errorf("formatUsage(%+v) = %q, want it to contain %q", tt.usage, text, want)
+			}
+		}
+	}
+}
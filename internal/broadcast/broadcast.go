@@ -0,0 +1,412 @@
+// Package broadcast sends admin messages to segments of users through a
+// Redis queue shared by all replicas, under a global rate limit.
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/models"
+
+	"github.com/mymmrac/telego"
+	ta "github.com/mymmrac/telego/telegoapi"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// ErrNotDraft is returned when launching a broadcast that was already
+// launched or canceled
+var ErrNotDraft = errors.New("broadcast is not a draft")
+
+// Segment selects the recipients of a broadcast
+type Segment string
+
+const (
+	SegmentAll       Segment = "all"
+	SegmentActive    Segment = "active"     // Subscription not expired yet
+	SegmentExpired   Segment = "expired"    // Subscription expired
+	SegmentNeverPaid Segment = "never_paid" // No successful payment
+	SegmentReferrers Segment = "referrers"  // Invited at least one user
+)
+
+// Segments lists all segments in display order
+var Segments = []Segment{SegmentAll, SegmentActive, SegmentExpired, SegmentNeverPaid, SegmentReferrers}
+
+// Valid reports whether s is a known segment
+func (s Segment) Valid() bool {
+	for _, segment := range Segments {
+		if segment == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Recipients returns a query on users in the segment. Banned users and
+// users who blocked the bot are never included.
+func Recipients(db *gorm.DB, segment Segment) *gorm.DB {
+	q := db.Model(&models.User{}).Where("users.banned = ? AND users.blocked_bot = ?", false, false)
+	now := time.Now()
+
+	switch segment {
+	case SegmentActive:
+		q = q.Where("EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = users.id AND s.expiration_date > ?)", now)
+	case SegmentExpired:
+		q = q.Where("EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = users.id AND s.expiration_date <= ?)", now)
+	case SegmentNeverPaid:
+		q = q.Where("NOT EXISTS (SELECT 1 FROM payments p WHERE p.user_id = users.id AND p.status = ?)", models.PaymentStatusSucceeded)
+	case SegmentReferrers:
+		q = q.Where("EXISTS (SELECT 1 FROM users r WHERE r.referrer_id = users.id)")
+	}
+	return q
+}
+
+// Button is a URL button under the broadcast message
+type Button struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// ParseButtons splits trailing "Text | https://..." lines off the message
+// text and returns the remaining text and the buttons in order
+func ParseButtons(text string) (string, []Button) {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+
+	var buttons []Button
+	for len(lines) > 0 {
+		label, url, ok := strings.Cut(lines[len(lines)-1], "|")
+		label, url = strings.TrimSpace(label), strings.TrimSpace(url)
+		if !ok || label == "" || !(strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "tg://")) {
+			break
+		}
+		buttons = append([]Button{{Text: label, URL: url}}, buttons...)
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.TrimSpace(strings.Join(lines, "\n")), buttons
+}
+
+// EncodeButtons returns the value stored in models.Broadcast.Buttons
+func EncodeButtons(buttons []Button) (string, error) {
+	if len(buttons) == 0 {
+		return "", nil
+	}
+	raw, err := json.Marshal(buttons)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal buttons: %w", err)
+	}
+	return string(raw), nil
+}
+
+func keyboard(bc *models.Broadcast) (*telego.InlineKeyboardMarkup, error) {
+	if bc.Buttons == "" {
+		return nil, nil
+	}
+
+	var buttons []Button
+	if err := json.Unmarshal([]byte(bc.Buttons), &buttons); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal buttons: %w", err)
+	}
+
+	var rows [][]telego.InlineKeyboardButton
+	for _, button := range buttons {
+		rows = append(rows, tu.InlineKeyboardRow(tu.InlineKeyboardButton(button.Text).WithURL(button.URL)))
+	}
+	return tu.InlineKeyboard(rows...), nil
+}
+
+// Send delivers the broadcast message to a single chat
+func Send(ctx context.Context, bot *telego.Bot, bc *models.Broadcast, chatID int64) error {
+	markup, err := keyboard(bc)
+	if err != nil {
+		return err
+	}
+
+	if bc.PhotoFileID != "" {
+		params := tu.Photo(tu.ID(chatID), tu.FileFromID(bc.PhotoFileID)).WithCaption(bc.Text)
+		if markup != nil {
+			params = params.WithReplyMarkup(markup)
+		}
+		_, err = bot.SendPhoto(ctx, params)
+		return err
+	}
+
+	params := tu.Message(tu.ID(chatID), bc.Text)
+	if markup != nil {
+		params = params.WithReplyMarkup(markup)
+	}
+	_, err = bot.SendMessage(ctx, params)
+	return err
+}
+
+// RetryAfter returns how long Telegram asked to wait before sending again,
+// or 0 if err is not a flood control error
+func RetryAfter(err error) time.Duration {
+	var apiErr *ta.Error
+	if errors.As(err, &apiErr) && apiErr.ErrorCode == 429 && apiErr.Parameters != nil {
+		return time.Duration(apiErr.Parameters.RetryAfter) * time.Second
+	}
+	return 0
+}
+
+// IsBlocked reports whether Telegram refused delivery for good: the user
+// blocked the bot or deleted their account
+func IsBlocked(err error) bool {
+	var apiErr *ta.Error
+	return errors.As(err, &apiErr) && apiErr.ErrorCode == 403
+}
+
+// Service launches broadcasts and hands their recipients out to senders
+type Service struct {
+	DB    *gorm.DB
+	Redis *redis.Client
+	Rate  int // Messages per second across all replicas
+}
+
+func NewService(db *gorm.DB, rdb *redis.Client, rate int) *Service {
+	return &Service{DB: db, Redis: rdb, Rate: rate}
+}
+
+const (
+	activeKey = "broadcast:active" // IDs of broadcasts being sent, oldest first
+	pauseKey  = "broadcast:pause"  // Set while Telegram asks us to back off
+)
+
+// inFlightTTL drops the in-flight count of a sender that died mid-send, so
+// its broadcast still finishes
+const inFlightTTL = 5 * time.Minute
+
+func recipientsKey(id uint) string {
+	return fmt.Sprintf("broadcast:%d:recipients", id)
+}
+
+// inFlightKey counts recipients popped but not yet recorded or requeued
+func inFlightKey(id uint) string {
+	return fmt.Sprintf("broadcast:%d:inflight", id)
+}
+
+var (
+	// KEYS: recipients, in-flight; ARGV: in-flight TTL in ms
+	popScript = redis.NewScript(`
+local chatID = redis.call('LPOP', KEYS[1])
+if chatID then
+	redis.call('INCR', KEYS[2])
+	redis.call('PEXPIRE', KEYS[2], ARGV[1])
+end
+return chatID`)
+
+	// KEYS: active, recipients, in-flight; ARGV: broadcast ID
+	finishScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[2]) > 0 then return 0 end
+if tonumber(redis.call('GET', KEYS[3]) or '0') > 0 then return 0 end
+local removed = redis.call('LREM', KEYS[1], 1, ARGV[1])
+redis.call('DEL', KEYS[3])
+return removed`)
+)
+
+// Count returns the number of recipients in a segment
+func (s *Service) Count(segment Segment) (int64, error) {
+	var count int64
+	if err := Recipients(s.DB, segment).Count(&count).Error; err != nil {
+		return 0, fmt.Errorf("failed to count recipients: %w", err)
+	}
+	return count, nil
+}
+
+// Launch queues the broadcast for sending to its segment. It returns
+// ErrNotDraft if the broadcast has been launched or canceled already.
+func (s *Service) Launch(ctx context.Context, bc *models.Broadcast) error {
+	var chatIDs []int64
+	if err := Recipients(s.DB, Segment(bc.Segment)).Order("users.id").Pluck("users.telegram_id", &chatIDs).Error; err != nil {
+		return fmt.Errorf("failed to load recipients: %w", err)
+	}
+
+	// Claim the draft, a double click must not send twice
+	result := s.DB.Model(&models.Broadcast{}).
+		Where("id = ? AND status = ?", bc.ID, models.BroadcastStatusDraft).
+		Updates(map[string]interface{}{"status": models.BroadcastStatusSending, "total": len(chatIDs)})
+	if result.Error != nil {
+		return fmt.Errorf("failed to update broadcast: %w", result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return ErrNotDraft
+	}
+	bc.Status = models.BroadcastStatusSending
+	bc.Total = len(chatIDs)
+
+	_, err := s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for start := 0; start < len(chatIDs); start += 1000 {
+			end := min(start+1000, len(chatIDs))
+			values := make([]interface{}, 0, end-start)
+			for _, chatID := range chatIDs[start:end] {
+				values = append(values, chatID)
+			}
+			pipe.RPush(ctx, recipientsKey(bc.ID), values...)
+		}
+		pipe.RPush(ctx, activeKey, bc.ID)
+		return nil
+	})
+	if err != nil {
+		// Nothing was queued, let the admin try again
+		s.DB.Model(bc).Update("status", models.BroadcastStatusDraft)
+		bc.Status = models.BroadcastStatusDraft
+		return fmt.Errorf("failed to queue recipients: %w", err)
+	}
+	return nil
+}
+
+// Current returns the ID of the broadcast being sent, or 0 if there is none
+func (s *Service) Current(ctx context.Context) (uint, error) {
+	id, err := s.Redis.LIndex(ctx, activeKey, 0).Uint64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get active broadcast: %w", err)
+	}
+	return uint(id), nil
+}
+
+// Pop takes the next recipient of a broadcast and counts it in flight until
+// Release or Requeue; ok is false once all recipients have been handed out
+func (s *Service) Pop(ctx context.Context, id uint) (chatID int64, ok bool, err error) {
+	keys := []string{recipientsKey(id), inFlightKey(id)}
+	chatID, err = popScript.Run(ctx, s.Redis, keys, inFlightTTL.Milliseconds()).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to pop recipient: %w", err)
+	}
+	return chatID, true, nil
+}
+
+// Requeue puts a popped recipient back at the front of the queue
+func (s *Service) Requeue(ctx context.Context, id uint, chatID int64) error {
+	_, err := s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, recipientsKey(id), chatID)
+		pipe.Decr(ctx, inFlightKey(id))
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to requeue recipient %d: %w", chatID, err)
+	}
+	return nil
+}
+
+// Release marks a popped recipient as handled
+func (s *Service) Release(ctx context.Context, id uint) error {
+	if err := s.Redis.Decr(ctx, inFlightKey(id)).Err(); err != nil {
+		return fmt.Errorf("failed to release recipient: %w", err)
+	}
+	return nil
+}
+
+// Record counts the outcome of sending to one recipient. Recipients who
+// blocked the bot are marked so later broadcasts skip them.
+func (s *Service) Record(id uint, chatID int64, sendErr error) error {
+	column := "sent"
+	switch {
+	case IsBlocked(sendErr):
+		column = "blocked"
+		if err := s.DB.Model(&models.User{}).Where("telegram_id = ?", chatID).Update("blocked_bot", true).Error; err != nil {
+			return fmt.Errorf("failed to mark user %d: %w", chatID, err)
+		}
+	case sendErr != nil:
+		column = "failed"
+	}
+
+	if err := s.DB.Model(&models.Broadcast{}).Where("id = ?", id).Update(column, gorm.Expr(column+" + 1")).Error; err != nil {
+		return fmt.Errorf("failed to count delivery: %w", err)
+	}
+	return nil
+}
+
+// Finish marks a broadcast as done once its queue is empty and no recipient
+// is in flight. Exactly one caller gets the finished broadcast back; the
+// others, and callers while sends are still in flight, get nil.
+func (s *Service) Finish(ctx context.Context, id uint) (*models.Broadcast, error) {
+	keys := []string{activeKey, recipientsKey(id), inFlightKey(id)}
+	removed, err := finishScript.Run(ctx, s.Redis, keys, id).Int64()
+	if err != nil {
+		return nil, fmt.Errorf("failed to remove active broadcast: %w", err)
+	}
+	if removed == 0 {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if err := s.DB.Model(&models.Broadcast{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"status":      models.BroadcastStatusDone,
+		"finished_at": now,
+	}).Error; err != nil {
+		return nil, fmt.Errorf("failed to finish broadcast %d: %w", id, err)
+	}
+
+	var bc models.Broadcast
+	if err := s.DB.First(&bc, id).Error; err != nil {
+		return nil, fmt.Errorf("failed to load broadcast %d: %w", id, err)
+	}
+	return &bc, nil
+}
+
+// Pause stops all senders for d, as Telegram asks after a 429
+func (s *Service) Pause(ctx context.Context, d time.Duration) error {
+	if err := s.Redis.Set(ctx, pauseKey, "1", d).Err(); err != nil {
+		return fmt.Errorf("failed to pause broadcasts: %w", err)
+	}
+	return nil
+}
+
+// Throttle blocks until a message may be sent: no pause is in effect and
+// fewer than Rate messages have been sent in the current second
+func (s *Service) Throttle(ctx context.Context) error {
+	for {
+		pause, err := s.Redis.PTTL(ctx, pauseKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to check pause: %w", err)
+		}
+		if pause > 0 {
+			if err := sleep(ctx, pause); err != nil {
+				return err
+			}
+			continue
+		}
+
+		now := time.Now()
+		key := fmt.Sprintf("broadcast:rate:%d", now.Unix())
+		var incr *redis.IntCmd
+		if _, err := s.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			incr = pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, 2*time.Second)
+			return nil
+		}); err != nil {
+			return fmt.Errorf("failed to count sent messages: %w", err)
+		}
+		if incr.Val() <= int64(s.Rate) {
+			return nil
+		}
+
+		// Over the limit, wait for the next second
+		if err := sleep(ctx, now.Truncate(time.Second).Add(time.Second).Sub(now)); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
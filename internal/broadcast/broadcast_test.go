@@ -0,0 +1,168 @@
+package broadcast
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestParseButtons(t *testing.T) {
+	tests := []struct {
+		text        string
+		wantBody    string
+		wantButtons []Button
+	}{
+		{text: "Привет!", wantBody: "Привет!"},
+		{
+			text:     "Скидка 20%\nтолько сегодня\nКупить | https://t.me/bot?start=sale\nКанал | https://t.me/channel",
+			wantBody: "Скидка 20%\nтолько сегодня",
+			wantButtons: []Button{
+				{Text: "Купить", URL: "https://t.me/bot?start=sale"},
+				{Text: "Канал", URL: "https://t.me/channel"},
+			},
+		},
+		{
+			// Only trailing lines are buttons
+			text:        "a | https://example.com\nтекст\nb | https://example.org",
+			wantBody:    "a | https://example.com\nтекст",
+			wantButtons: []Button{{Text: "b", URL: "https://example.org"}},
+		},
+		{text: "Цена | 100₽", wantBody: "Цена | 100₽"},
+	}
+
+	for _, tt := range tests {
+		body, buttons := ParseButtons(tt.text)
+		if body != tt.wantBody || !reflect.DeepEqual(buttons, tt.wantButtons) {
+			t.Errorf("ParseButtons(%q) = %q, %v, want %q, %v", tt.text, body, buttons, tt.wantBody, tt.wantButtons)
+		}
+	}
+}
+
+func TestRecipients(t *testing.T) {
+	db := testutil.DB(t)
+
+	newUser := func(telegramID int64, mutate func(u *models.User)) *models.User {
+		t.Helper()
+		user := models.User{TelegramID: telegramID, ReferralCode: fmt.Sprintf("ref_%d", telegramID)}
+		if mutate != nil {
+			mutate(&user)
+		}
+		if err := db.Create(&user).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+		return &user
+	}
+
+	active := newUser(1, nil)
+	expired := newUser(2, nil)
+	newUser(3, func(u *models.User) { u.ReferrerID = &active.ID })
+	newUser(4, func(u *models.User) { u.Banned = true })
+	newUser(5, func(u *models.User) { u.BlockedBot = true })
+
+	subs := []models.Subscription{
+		{UserID: active.ID, ExpirationDate: time.Now().Add(24 * time.Hour)},
+		{UserID: expired.ID, ExpirationDate: time.Now().Add(-24 * time.Hour)},
+	}
+	if err := db.Create(&subs).Error; err != nil {
+		t.Fatalf("create subscriptions: %v", err)
+	}
+	if err := db.Create(&models.Payment{UserID: active.ID, Amount: 100, Status: models.PaymentStatusSucceeded}).Error; err != nil {
+		t.Fatalf("create payment: %v", err)
+	}
+
+	want := map[Segment][]int64{
+		SegmentAll:       {1, 2, 3},
+		SegmentActive:    {1},
+		SegmentExpired:   {2},
+		SegmentNeverPaid: {2, 3},
+		SegmentReferrers: {1},
+	}
+	for segment, wantIDs := range want {
+		var ids []int64
+		if err := Recipients(db, segment).Order("telegram_id").Pluck("telegram_id", &ids).Error; err != nil {
+			t.Fatalf("Recipients(%s): %v", segment, err)
+		}
+		if !reflect.DeepEqual(ids, wantIDs) {
+			t.Errorf("Recipients(%s) = %v, want %v", segment, ids, wantIDs)
+		}
+	}
+}
+
+func TestFinishWaitsForInFlightSends(t *testing.T) {
+	db := testutil.DB(t)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	s := NewService(db, rdb, 30)
+	ctx := context.Background()
+
+	testutil.NewUser(t, db, 1, 0)
+	bc := models.Broadcast{Text: "Новости", Segment: string(SegmentAll), Status: models.BroadcastStatusDraft}
+	if err := db.Create(&bc).Error; err != nil {
+		t.Fatalf("create broadcast: %v", err)
+	}
+	if err := s.Launch(ctx, &bc); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+
+	if _, ok, err := s.Pop(ctx, bc.ID); err != nil || !ok {
+		t.Fatalf("Pop = %v, %v, want a recipient", ok, err)
+	}
+	if _, ok, _ := s.Pop(ctx, bc.ID); ok {
+		t.Fatal("Pop returned a recipient from an empty queue")
+	}
+
+	// Another sender sees the empty queue while the last message is sent
+	if done, err := s.Finish(ctx, bc.ID); err != nil || done != nil {
+		t.Fatalf("Finish while in flight = %v, %v, want nil", done, err)
+	}
+
+	if err := s.Release(ctx, bc.ID); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	done, err := s.Finish(ctx, bc.ID)
+	if err != nil || done == nil || done.Status != models.BroadcastStatusDone {
+		t.Fatalf("Finish = %+v, %v, want the done broadcast", done, err)
+	}
+	if again, err := s.Finish(ctx, bc.ID); err != nil || again != nil {
+		t.Errorf("second Finish = %v, %v, want nil", again, err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+	s := NewService(nil, rdb, 2)
+	ctx := context.Background()
+
+	// Start right after a second boundary so all calls fit in one second
+	time.Sleep(time.Until(time.Now().Truncate(time.Second).Add(time.Second)))
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := s.Throttle(ctx); err != nil {
+			t.Fatalf("Throttle: %v", err)
+		}
+	}
+	if time.Now().Unix() == start.Unix() {
+		t.Error("third message was allowed in the same second with a rate of 2")
+	}
+
+	// A pause holds everyone back
+	if err := s.Pause(ctx, 200*time.Millisecond); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	cancelCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if err := s.Throttle(cancelCtx); err == nil {
+		t.Error("Throttle returned during a pause")
+	}
+}
@@ -3,6 +3,9 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -22,7 +25,46 @@ type Config struct {
 	RemnawaveSquadID string
 	YookassaShopID   string
 	YookassaKey      string
+	YookassaAPIURL   string
 	AllowedYooIp     []string
+	TrustedProxies   []string
+	AdminIDs         []int64
+
+	// Telegram Stars top-ups
+	StarsEnabled        bool
+	StarsKopecksPerStar int64 // Balance credited per star, in kopecks
+
+	// Fiscal receipts (54-FZ)
+	ReceiptEnabled        bool
+	ReceiptVatCode        int    // 1 = без НДС, 2 = 0%, 3 = 10%, 4 = 20%, ...
+	ReceiptTaxSystemCode  int    // 0 = not sent (single tax system), 1..6 per YooKassa docs
+	ReceiptPaymentSubject string // service, payment, ...
+	ReceiptPaymentMode    string // full_prepayment, full_payment, advance, ...
+
+	PaymentReconcileAfter time.Duration // Pending payments older than this are polled
+	PaymentExpireAfter    time.Duration // Pending payments older than this are marked expired
+
+	// Auto-renewal with saved YooKassa payment methods
+	AutoRenewEnabled bool
+	AutoRenewBefore  time.Duration // Saved methods are charged this long before expiry
+
+	ShutdownTimeout time.Duration // How long in-flight work may take to finish on shutdown
+
+	// Telegram webhook mode; long polling is used when the URL is empty
+	TelegramWebhookURL    string // Public base URL of the HTTP server, e.g. https://bot.example.com
+	TelegramWebhookSecret string // Checked against X-Telegram-Bot-Api-Secret-Token
+
+	BroadcastRate int // Broadcast messages per second, Telegram allows about 30
+
+	// Free trial for users without a subscription; 0 days disables it
+	TrialDays              int
+	TrialTrafficLimitBytes int64 // 0 means unlimited
+
+	GiftValidityDays int // Days a gift can be redeemed before it is refundable
+
+	// Extra device slots on plans with a device limit; 0 price disables them
+	DeviceSlotPrice int64 // Kopecks per slot
+	MaxExtraDevices int   // Paid slots per subscription
 }
 
 func LoadConfig() *Config {
@@ -45,6 +87,7 @@ func LoadConfig() *Config {
 		RemnawaveSquadID: getEnv("REMNAWAVE_SQUAD_ID", ""),
 		YookassaShopID:   getEnv("YOOKASSA_SHOP_ID", ""),
 		YookassaKey:      getEnv("YOOKASSA_SECRET_KEY", ""),
+		YookassaAPIURL:   getEnv("YOOKASSA_API_URL", "https://api.yookassa.ru/v3"),
 		AllowedYooIp: []string{
 			"185.71.76.0/27",
 			"185.71.77.0/27",
@@ -53,6 +96,40 @@ func LoadConfig() *Config {
 			"77.75.154.128/25",
 			"2a02:5180::/32",
 		},
+		// Reverse proxies allowed to set X-Forwarded-For (comma-separated IPs or CIDRs)
+		TrustedProxies: getEnvList("TRUSTED_PROXIES", []string{"127.0.0.1/32", "::1/128"}),
+		AdminIDs:       getEnvIDs("ADMIN_TELEGRAM_IDS"),
+
+		StarsEnabled:        getEnv("STARS_ENABLED", "false") == "true",
+		StarsKopecksPerStar: int64(getEnvInt("STARS_KOPECKS_PER_STAR", 150)),
+
+		ReceiptEnabled:        getEnv("RECEIPT_ENABLED", "false") == "true",
+		ReceiptVatCode:        getEnvInt("RECEIPT_VAT_CODE", 1),
+		ReceiptTaxSystemCode:  getEnvInt("RECEIPT_TAX_SYSTEM_CODE", 0),
+		ReceiptPaymentSubject: getEnv("RECEIPT_PAYMENT_SUBJECT", "service"),
+		ReceiptPaymentMode:    getEnv("RECEIPT_PAYMENT_MODE", "full_prepayment"),
+
+		PaymentReconcileAfter: time.Duration(getEnvInt("PAYMENT_RECONCILE_AFTER_MINUTES", 10)) * time.Minute,
+		PaymentExpireAfter:    time.Duration(getEnvInt("PAYMENT_EXPIRE_AFTER_HOURS", 24)) * time.Hour,
+
+		AutoRenewEnabled: getEnv("AUTO_RENEW_ENABLED", "false") == "true",
+		// Keep it above 25h so a failed charge still gets the regular 24h expiry notice
+		AutoRenewBefore: time.Duration(getEnvInt("AUTO_RENEW_BEFORE_HOURS", 48)) * time.Hour,
+
+		ShutdownTimeout: time.Duration(getEnvInt("SHUTDOWN_TIMEOUT_SECONDS", 30)) * time.Second,
+
+		TelegramWebhookURL:    getEnv("TELEGRAM_WEBHOOK_URL", ""),
+		TelegramWebhookSecret: getEnv("TELEGRAM_WEBHOOK_SECRET", ""),
+
+		BroadcastRate: getEnvInt("BROADCAST_RATE_PER_SECOND", 25),
+
+		TrialDays:              getEnvInt("TRIAL_DAYS", 0),
+		TrialTrafficLimitBytes: int64(getEnvInt("TRIAL_TRAFFIC_LIMIT_GB", 10)) << 30,
+
+		GiftValidityDays: getEnvInt("GIFT_VALIDITY_DAYS", 30),
+
+		DeviceSlotPrice: int64(getEnvInt("DEVICE_SLOT_PRICE_RUB", 50)) * 100,
+		MaxExtraDevices: getEnvInt("MAX_EXTRA_DEVICES", 5),
 	}
 }
 
@@ -62,3 +139,45 @@ func getEnv(key, fallback string) string {
 	}
 	return fallback
 }
+
+func getEnvList(key string, fallback []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func getEnvInt(key string, fallback int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value for %s: %q, using default %d", key, value, fallback)
+		return fallback
+	}
+	return parsed
+}
+
+func getEnvIDs(key string) []int64 {
+	var ids []int64
+	for _, item := range getEnvList(key, nil) {
+		id, err := strconv.ParseInt(item, 10, 64)
+		if err != nil {
+			log.Printf("Invalid Telegram ID in %s: %q, skipping", key, item)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
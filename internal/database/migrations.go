@@ -0,0 +1,121 @@
+package database
+
+import (
+	"fmt"
+	"log"
+
+	"popovka-bot/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// moneyColumns were stored as float rubles before the switch to integer kopecks
+var moneyColumns = []struct {
+	Table  string
+	Column string
+}{
+	{"users", "balance"},
+	{"payments", "amount"},
+	{"referral_transactions", "amount"},
+	{"plans", "price"},
+}
+
+// convertMoneyColumns turns legacy float ruble columns into bigint kopecks.
+// It must run before AutoMigrate, which would otherwise cast the column type
+// without multiplying by 100.
+func convertMoneyColumns(db *gorm.DB) error {
+	for _, mc := range moneyColumns {
+		var dataType string
+		err := db.Raw(
+			"SELECT data_type FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?",
+			mc.Table, mc.Column,
+		).Scan(&dataType).Error
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s.%s: %w", mc.Table, mc.Column, err)
+		}
+		if dataType != "double precision" && dataType != "real" && dataType != "numeric" {
+			continue
+		}
+
+		log.Printf("Converting %s.%s from rubles to kopecks", mc.Table, mc.Column)
+		sql := fmt.Sprintf(
+			"ALTER TABLE %s ALTER COLUMN %s TYPE bigint USING ROUND(%s * 100)::bigint",
+			mc.Table, mc.Column, mc.Column,
+		)
+		if err := db.Exec(sql).Error; err != nil {
+			return fmt.Errorf("failed to convert %s.%s: %w", mc.Table, mc.Column, err)
+		}
+	}
+	return nil
+}
+
+// dedupePaymentYooKassaIDs removes payment rows duplicated by retried
+// YooKassa webhooks, keeping the earliest one. It must run before AutoMigrate,
+// which would otherwise fail to build the unique index on yoo_kassa_id.
+// Balances already credited twice are not corrected; the duplicates are
+// logged for manual review.
+func dedupePaymentYooKassaIDs(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.Payment{}) {
+		return nil
+	}
+
+	var duplicated []string
+	err := db.Raw(
+		"SELECT yoo_kassa_id FROM payments WHERE yoo_kassa_id <> '' GROUP BY yoo_kassa_id HAVING COUNT(*) > 1",
+	).Scan(&duplicated).Error
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate payments: %w", err)
+	}
+	if len(duplicated) == 0 {
+		return nil
+	}
+
+	log.Printf("Removing duplicate payment records for YooKassa payments %v; check these users' balances manually", duplicated)
+	err = db.Exec(
+		"DELETE FROM payments p USING payments d WHERE p.yoo_kassa_id = d.yoo_kassa_id AND p.yoo_kassa_id <> '' AND p.id > d.id",
+	).Error
+	if err != nil {
+		return fmt.Errorf("failed to remove duplicate payments: %w", err)
+	}
+	return nil
+}
+
+// openLedgerBalances records an opening entry for every user whose cached
+// balance predates the ledger, so the derived balance matches the cache.
+func openLedgerBalances(db *gorm.DB) error {
+	var users []models.User
+	err := db.Where("balance <> 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries le WHERE le.user_id = users.id)").Find(&users).Error
+	if err != nil {
+		return fmt.Errorf("failed to find users without ledger: %w", err)
+	}
+
+	for _, user := range users {
+		txID := uuid.New().String()
+		entries := []models.LedgerEntry{
+			{
+				TransactionID: txID,
+				Account:       models.UserAccount(user.ID),
+				UserID:        &user.ID,
+				Amount:        user.Balance,
+				Kind:          models.LedgerKindAdminAdjustment,
+				Comment:       "opening balance",
+			},
+			{
+				TransactionID: txID,
+				Account:       "equity:adjustments",
+				Amount:        -user.Balance,
+				Kind:          models.LedgerKindAdminAdjustment,
+				Comment:       "opening balance",
+			},
+		}
+		if err := db.Create(&entries).Error; err != nil {
+			return fmt.Errorf("failed to open ledger for user %d: %w", user.ID, err)
+		}
+	}
+
+	if len(users) > 0 {
+		log.Printf("Opened ledger balances for %d users", len(users))
+	}
+	return nil
+}
@@ -22,11 +22,22 @@ func ConnectPostgres(cfg *config.Config) (*gorm.DB, error) {
 
 	log.Println("Connected to PostgreSQL")
 
+	if err := convertMoneyColumns(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+	if err := dedupePaymentYooKassaIDs(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	// Auto Migrate
-	err = db.AutoMigrate(&models.User{}, &models.Subscription{}, &models.Payment{}, &models.ReferralTransaction{})
+	err = db.AutoMigrate(&models.User{}, &models.Subscription{}, &models.Payment{}, &models.ReferralTransaction{}, &models.Plan{}, &models.LedgerEntry{}, &models.Refund{}, &models.Broadcast{}, &models.PromoCode{}, &models.PromoRedemption{}, &models.Gift{})
 	if err != nil {
 		return nil, fmt.Errorf("failed to migrate database: %w", err)
 	}
 
+	if err := openLedgerBalances(db); err != nil {
+		return nil, fmt.Errorf("failed to migrate database: %w", err)
+	}
+
 	return db, nil
 }
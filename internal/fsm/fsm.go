@@ -0,0 +1,143 @@
+// Package fsm keeps per-user conversation state in Redis, so it survives
+// restarts, is shared between replicas and expires when the user walks away.
+package fsm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// State is the step of a conversation the user is in
+type State string
+
+// Conversation states
+const (
+	StateNone               State = ""
+	StateWaitingTopUpAmount State = "WAITING_TOPUP_AMOUNT"
+	StateWaitingContact     State = "WAITING_RECEIPT_CONTACT" // Carries a TopUpPayload
+	StateWaitingPromoCode   State = "WAITING_PROMO_CODE"
+
+	// Admin panel; the balance and extension states carry an AdminPayload
+	StateAdminWaitingUserQuery  State = "ADMIN_WAITING_USER_QUERY"
+	StateAdminWaitingBalance    State = "ADMIN_WAITING_BALANCE"
+	StateAdminWaitingExtendDays State = "ADMIN_WAITING_EXTEND_DAYS"
+
+	StateBroadcastWaitingContent State = "BROADCAST_WAITING_CONTENT"
+)
+
+// AdminPayload is the user an admin action applies to
+type AdminPayload struct {
+	UserID uint `json:"user_id"`
+}
+
+// TopUpPayload is the top-up to start once the user has left a receipt
+// contact
+type TopUpPayload struct {
+	Provider string `json:"provider"`
+	Amount   int64  `json:"amount"`
+}
+
+// DefaultTTL applies to states without an entry in ttls
+const DefaultTTL = 15 * time.Minute
+
+// ttls is how long each state waits for the user's input
+var ttls = map[State]time.Duration{
+	StateWaitingTopUpAmount: 15 * time.Minute,
+	StateWaitingContact:     15 * time.Minute,
+	StateWaitingPromoCode:   15 * time.Minute,
+
+	StateAdminWaitingUserQuery:  5 * time.Minute,
+	StateAdminWaitingBalance:    5 * time.Minute,
+	StateAdminWaitingExtendDays: 5 * time.Minute,
+
+	StateBroadcastWaitingContent: 30 * time.Minute,
+}
+
+// TTL returns how long a state is kept without user input
+func (s State) TTL() time.Duration {
+	if ttl, ok := ttls[s]; ok {
+		return ttl
+	}
+	return DefaultTTL
+}
+
+// Session is a user's current state with the data collected so far
+type Session struct {
+	State   State           `json:"state"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode unmarshals the session payload into v
+func (s *Session) Decode(v interface{}) error {
+	if len(s.Payload) == 0 {
+		return errors.New("session has no payload")
+	}
+	return json.Unmarshal(s.Payload, v)
+}
+
+type Store struct {
+	Redis  *redis.Client
+	Prefix string
+}
+
+func NewStore(rdb *redis.Client) *Store {
+	return &Store{Redis: rdb, Prefix: "fsm"}
+}
+
+func (s *Store) key(userID int64) string {
+	return fmt.Sprintf("%s:%d", s.Prefix, userID)
+}
+
+// Set moves the user to state, replacing any previous state and payload.
+// payload may be nil; the state expires after state.TTL().
+func (s *Store) Set(ctx context.Context, userID int64, state State, payload interface{}) error {
+	session := Session{State: state}
+	if payload != nil {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		session.Payload = raw
+	}
+
+	value, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	if err := s.Redis.Set(ctx, s.key(userID), value, state.TTL()).Err(); err != nil {
+		return fmt.Errorf("failed to save state: %w", err)
+	}
+	return nil
+}
+
+// Get returns the user's session. A user without a state, or whose state
+// has expired, gets a session in StateNone.
+func (s *Store) Get(ctx context.Context, userID int64) (Session, error) {
+	value, err := s.Redis.Get(ctx, s.key(userID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Session{}, nil
+	}
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to load state: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(value, &session); err != nil {
+		return Session{}, fmt.Errorf("failed to unmarshal session: %w", err)
+	}
+	return session, nil
+}
+
+// Clear returns the user to StateNone
+func (s *Store) Clear(ctx context.Context, userID int64) error {
+	if err := s.Redis.Del(ctx, s.key(userID)).Err(); err != nil {
+		return fmt.Errorf("failed to clear state: %w", err)
+	}
+	return nil
+}
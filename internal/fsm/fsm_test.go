@@ -0,0 +1,87 @@
+package fsm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newStore(t *testing.T) (*Store, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	return NewStore(rdb), mr
+}
+
+func TestSetGetClear(t *testing.T) {
+	store, _ := newStore(t)
+	ctx := context.Background()
+
+	session, err := store.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if session.State != StateNone {
+		t.Errorf("state of a new user = %q, want none", session.State)
+	}
+
+	type payload struct {
+		Amount int64 `json:"amount"`
+	}
+	if err := store.Set(ctx, 1, StateWaitingTopUpAmount, payload{Amount: 500}); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+
+	session, err = store.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if session.State != StateWaitingTopUpAmount {
+		t.Errorf("state = %q, want %q", session.State, StateWaitingTopUpAmount)
+	}
+	var got payload
+	if err := session.Decode(&got); err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	if got.Amount != 500 {
+		t.Errorf("payload amount = %d, want 500", got.Amount)
+	}
+
+	// Other users are not affected
+	if other, _ := store.Get(ctx, 2); other.State != StateNone {
+		t.Errorf("state of another user = %q, want none", other.State)
+	}
+
+	if err := store.Clear(ctx, 1); err != nil {
+		t.Fatalf("Clear: %v", err)
+	}
+	if session, _ = store.Get(ctx, 1); session.State != StateNone {
+		t.Errorf("state after Clear = %q, want none", session.State)
+	}
+}
+
+func TestStateExpires(t *testing.T) {
+	store, mr := newStore(t)
+	ctx := context.Background()
+
+	if err := store.Set(ctx, 1, StateWaitingContact, nil); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if ttl := mr.TTL(store.key(1)); ttl != StateWaitingContact.TTL() {
+		t.Errorf("key TTL = %v, want %v", ttl, StateWaitingContact.TTL())
+	}
+
+	mr.FastForward(StateWaitingContact.TTL())
+
+	session, err := store.Get(ctx, 1)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if session.State != StateNone {
+		t.Errorf("state after TTL = %q, want none", session.State)
+	}
+}
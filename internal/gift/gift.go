@@ -0,0 +1,210 @@
+// Package gift sells plans to be activated by another Telegram user. The
+// buyer pays from balance and shares a one-time code; the first user to
+// redeem it gets the subscription, and an unredeemed gift can be returned
+// to the buyer's balance once it expires.
+package gift
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/tariff"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotFound      = errors.New("gift not found")
+	ErrRedeemed      = errors.New("gift already redeemed")
+	ErrExpired       = errors.New("gift has expired")
+	ErrOwnGift       = errors.New("buyer cannot redeem their own gift")
+	ErrNotExpired    = errors.New("gift has not expired yet")
+	ErrNotRefundable = errors.New("gift is not refundable")
+)
+
+// StartPrefix marks gift codes in /start deep links
+const StartPrefix = "gift_"
+
+// Service buys, redeems and refunds gifts
+type Service struct {
+	DB            *gorm.DB
+	Subscriptions *subscription.Service
+	Validity      time.Duration // How long the recipient has to redeem
+}
+
+func NewService(db *gorm.DB, subscriptions *subscription.Service, validity time.Duration) *Service {
+	return &Service{
+		DB:            db,
+		Subscriptions: subscriptions,
+		Validity:      validity,
+	}
+}
+
+// newCode returns a random code that fits a /start parameter
+func newCode() (string, error) {
+	buf := make([]byte, 10)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate gift code: %w", err)
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(buf), nil
+}
+
+// Buy charges the buyer for plan and creates the gift. It returns
+// ledger.ErrInsufficientFunds if the balance is too low.
+func (s *Service) Buy(buyer *models.User, plan *models.Plan) (*models.Gift, error) {
+	code, err := newCode()
+	if err != nil {
+		return nil, err
+	}
+
+	g := &models.Gift{
+		Code:      code,
+		BuyerID:   buyer.ID,
+		PlanID:    plan.ID,
+		PlanName:  plan.Name,
+		Days:      plan.DurationDays,
+		Price:     plan.Price,
+		Status:    models.GiftStatusPending,
+		ExpiresAt: time.Now().Add(s.Validity),
+	}
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(g).Error; err != nil {
+			return fmt.Errorf("failed to save gift: %w", err)
+		}
+		_, err := ledger.Post(tx, ledger.Entry{
+			UserID:        buyer.ID,
+			Amount:        -plan.Price,
+			Kind:          models.LedgerKindPurchase,
+			ReferenceType: "gift",
+			ReferenceID:   strconv.FormatUint(uint64(g.ID), 10),
+			Comment:       "Подарок: " + plan.Name,
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Redeem activates the gift for the recipient, creating or extending their
+// subscription. The claim and the panel call share one transaction, so a
+// failed activation leaves the gift redeemable.
+func (s *Service) Redeem(ctx context.Context, code string, recipient *models.User) (*models.Gift, *models.Subscription, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+
+	var g models.Gift
+	err := s.DB.Where("code = ?", code).First(&g).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to load gift: %w", err)
+	}
+
+	switch {
+	case g.Status != models.GiftStatusPending:
+		return &g, nil, ErrRedeemed
+	case time.Now().After(g.ExpiresAt):
+		return &g, nil, ErrExpired
+	case g.BuyerID == recipient.ID:
+		return &g, nil, ErrOwnGift
+	}
+
+	// Don't claim and roll back over and over while the panel is down
+	if !s.Subscriptions.Remnawave.Available() {
+		return &g, nil, remnawave.ErrUnavailable
+	}
+
+	plan, err := s.Subscriptions.Tariffs.GetPlan(g.PlanID)
+	if errors.Is(err, tariff.ErrPlanNotFound) {
+		plan = nil // Removed since; the gift still carries its days
+	} else if err != nil {
+		return &g, nil, err
+	}
+
+	var sub *models.Subscription
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.Gift{}).
+			Where("id = ? AND status = ? AND expires_at > ?", g.ID, models.GiftStatusPending, now).
+			Updates(map[string]any{
+				"status":       models.GiftStatusRedeemed,
+				"recipient_id": recipient.ID,
+				"redeemed_at":  now,
+			})
+		if result.Error != nil {
+			return fmt.Errorf("failed to claim gift: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrRedeemed
+		}
+
+		var err error
+		sub, err = s.Subscriptions.Extend(ctx, tx, recipient, g.Days, plan)
+		return err
+	})
+	if err != nil {
+		return &g, nil, err
+	}
+
+	g.Status = models.GiftStatusRedeemed
+	g.RecipientID = &recipient.ID
+	return &g, sub, nil
+}
+
+// Refund returns an expired, unredeemed gift to the buyer's balance
+func (s *Service) Refund(giftID, buyerID uint) (*models.Gift, error) {
+	var g models.Gift
+	err := s.DB.Where("id = ? AND buyer_id = ?", giftID, buyerID).First(&g).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load gift: %w", err)
+	}
+	if g.Status != models.GiftStatusPending {
+		return &g, ErrNotRefundable
+	}
+	if time.Now().Before(g.ExpiresAt) {
+		return &g, ErrNotExpired
+	}
+
+	err = s.DB.Transaction(func(tx *gorm.DB) error {
+		// The status guard makes a double tap refund only once
+		result := tx.Model(&models.Gift{}).
+			Where("id = ? AND status = ?", g.ID, models.GiftStatusPending).
+			Update("status", models.GiftStatusRefunded)
+		if result.Error != nil {
+			return fmt.Errorf("failed to mark gift refunded: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrNotRefundable
+		}
+
+		_, err := ledger.Post(tx, ledger.Entry{
+			UserID:        buyerID,
+			Amount:        g.Price,
+			Kind:          models.LedgerKindGiftRefund,
+			ReferenceType: "gift",
+			ReferenceID:   strconv.FormatUint(uint64(g.ID), 10),
+			Comment:       "Возврат подарка: " + g.PlanName,
+		})
+		return err
+	})
+	if err != nil {
+		return &g, err
+	}
+	g.Status = models.GiftStatusRefunded
+	return &g, nil
+}
@@ -0,0 +1,124 @@
+package gift_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/gift"
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/remnawave/remnawavetest"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/testutil"
+
+	"gorm.io/gorm"
+)
+
+type env struct {
+	db     *gorm.DB
+	panel  *remnawavetest.Server
+	gifts  *gift.Service
+	plan30 *models.Plan
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+
+	db := testutil.DB(t)
+	panel := remnawavetest.NewServer()
+	t.Cleanup(panel.Close)
+
+	tariffs, plan30 := testutil.Plans(t, db, "squad-default")
+
+	client := panel.Client()
+	client.RetryBaseDelay = time.Millisecond
+	subs := subscription.NewService(client, tariffs)
+
+	return &env{
+		db:     db,
+		panel:  panel,
+		gifts:  gift.NewService(db, subs, 7*24*time.Hour),
+		plan30: plan30,
+	}
+}
+
+func TestGiftIsRedeemedOnce(t *testing.T) {
+	e := newEnv(t)
+	buyer := testutil.NewUser(t, e.db, 1, e.plan30.Price)
+	recipient := testutil.NewUser(t, e.db, 2, 0)
+	other := testutil.NewUser(t, e.db, 3, 0)
+
+	g, err := e.gifts.Buy(buyer, e.plan30)
+	if err != nil {
+		t.Fatalf("Buy: %v", err)
+	}
+	if got := testutil.Balance(t, e.db, buyer.ID); got != 0 {
+		t.Errorf("buyer balance = %d, want 0", got)
+	}
+	if _, err := e.gifts.Buy(buyer, e.plan30); !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Errorf("second Buy error = %v, want ErrInsufficientFunds", err)
+	}
+
+	if _, _, err := e.gifts.Redeem(context.Background(), g.Code, buyer); !errors.Is(err, gift.ErrOwnGift) {
+		t.Errorf("Redeem by buyer error = %v, want ErrOwnGift", err)
+	}
+
+	redeemed, sub, err := e.gifts.Redeem(context.Background(), " "+g.Code+" ", recipient)
+	if err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+	if sub.UserID != recipient.ID || sub.PlanID == nil || *sub.PlanID != e.plan30.ID {
+		t.Errorf("subscription = user %d plan %v, want user %d plan %d", sub.UserID, sub.PlanID, recipient.ID, e.plan30.ID)
+	}
+	if redeemed.RecipientID == nil || *redeemed.RecipientID != recipient.ID {
+		t.Errorf("gift recipient = %v, want %d", redeemed.RecipientID, recipient.ID)
+	}
+	if _, ok := e.panel.User(sub.RemnawaveID); !ok {
+		t.Errorf("panel user %s was not created", sub.RemnawaveID)
+	}
+
+	if _, _, err := e.gifts.Redeem(context.Background(), g.Code, other); !errors.Is(err, gift.ErrRedeemed) {
+		t.Errorf("second Redeem error = %v, want ErrRedeemed", err)
+	}
+	if _, err := e.gifts.Refund(g.ID, buyer.ID); !errors.Is(err, gift.ErrNotRefundable) {
+		t.Errorf("Refund of a redeemed gift error = %v, want ErrNotRefundable", err)
+	}
+}
+
+func TestExpiredGiftIsRefunded(t *testing.T) {
+	e := newEnv(t)
+	buyer := testutil.NewUser(t, e.db, 1, e.plan30.Price)
+	recipient := testutil.NewUser(t, e.db, 2, 0)
+
+	g, err := e.gifts.Buy(buyer, e.plan30)
+	if err != nil {
+		t.Fatalf("Buy: %v", err)
+	}
+	if _, err := e.gifts.Refund(g.ID, buyer.ID); !errors.Is(err, gift.ErrNotExpired) {
+		t.Errorf("Refund before expiry error = %v, want ErrNotExpired", err)
+	}
+
+	e.db.Model(g).Update("expires_at", time.Now().Add(-time.Minute))
+
+	if _, _, err := e.gifts.Redeem(context.Background(), g.Code, recipient); !errors.Is(err, gift.ErrExpired) {
+		t.Errorf("Redeem after expiry error = %v, want ErrExpired", err)
+	}
+	if _, err := e.gifts.Refund(g.ID, recipient.ID); !errors.Is(err, gift.ErrNotFound) {
+		t.Errorf("Refund by another user error = %v, want ErrNotFound", err)
+	}
+
+	if _, err := e.gifts.Refund(g.ID, buyer.ID); err != nil {
+		t.Fatalf("Refund: %v", err)
+	}
+	if _, err := e.gifts.Refund(g.ID, buyer.ID); !errors.Is(err, gift.ErrNotRefundable) {
+		t.Errorf("second Refund error = %v, want ErrNotRefundable", err)
+	}
+	if got := testutil.Balance(t, e.db, buyer.ID); got != e.plan30.Price {
+		t.Errorf("buyer balance = %d, want %d", got, e.plan30.Price)
+	}
+	if n := e.panel.Users(); n != 0 {
+		t.Errorf("panel has %d users, want 0", n)
+	}
+}
@@ -0,0 +1,106 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+
+	"popovka-bot/internal/models"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrInsufficientFunds is returned when a debit would make the balance negative
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// counterAccounts maps an entry kind to the system account on the other side
+var counterAccounts = map[string]string{
+	models.LedgerKindTopUp:           "external:payments",
+	models.LedgerKindPurchase:        "revenue:subscriptions",
+	models.LedgerKindRefund:          "external:payments",
+	models.LedgerKindReferralBonus:   "expense:referrals",
+	models.LedgerKindAdminAdjustment: "equity:adjustments",
+	models.LedgerKindPromo:           "expense:promo",
+	models.LedgerKindGiftRefund:      "revenue:subscriptions",
+}
+
+// Entry describes a balance change of a single user
+type Entry struct {
+	UserID        uint
+	Amount        int64 // Kopecks, negative for debits
+	Kind          string
+	ReferenceType string
+	ReferenceID   string
+	Comment       string
+	AllowNegative bool // Refunds may push a balance below zero
+}
+
+// Post records the entry and its counter entry and updates the cached user
+// balance. It must run inside a transaction: the user row is locked for the
+// duration of it so concurrent postings are serialized.
+func Post(tx *gorm.DB, e Entry) (*models.User, error) {
+	counterAccount, ok := counterAccounts[e.Kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown ledger entry kind: %s", e.Kind)
+	}
+	if e.Amount == 0 {
+		return nil, fmt.Errorf("ledger entry amount must not be zero")
+	}
+
+	var user models.User
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&user, e.UserID).Error; err != nil {
+		return nil, fmt.Errorf("failed to lock user %d: %w", e.UserID, err)
+	}
+
+	newBalance := user.Balance + e.Amount
+	if newBalance < 0 && e.Amount < 0 && !e.AllowNegative {
+		return nil, ErrInsufficientFunds
+	}
+
+	txID := uuid.New().String()
+	entries := []models.LedgerEntry{
+		{
+			TransactionID: txID,
+			Account:       models.UserAccount(user.ID),
+			UserID:        &user.ID,
+			Amount:        e.Amount,
+			Kind:          e.Kind,
+			ReferenceType: e.ReferenceType,
+			ReferenceID:   e.ReferenceID,
+			Comment:       e.Comment,
+		},
+		{
+			TransactionID: txID,
+			Account:       counterAccount,
+			Amount:        -e.Amount,
+			Kind:          e.Kind,
+			ReferenceType: e.ReferenceType,
+			ReferenceID:   e.ReferenceID,
+			Comment:       e.Comment,
+		},
+	}
+	if err := tx.Create(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to write ledger entries: %w", err)
+	}
+
+	if err := tx.Model(&user).Update("balance", newBalance).Error; err != nil {
+		return nil, fmt.Errorf("failed to update cached balance: %w", err)
+	}
+	user.Balance = newBalance
+
+	return &user, nil
+}
+
+// Balance derives the user balance from the ledger, ignoring the cached value
+func Balance(db *gorm.DB, userID uint) (int64, error) {
+	var balance int64
+	err := db.Model(&models.LedgerEntry{}).
+		Where("account = ?", models.UserAccount(userID)).
+		Select("COALESCE(SUM(amount), 0)").
+		Scan(&balance).Error
+	if err != nil {
+		return 0, fmt.Errorf("failed to sum ledger for user %d: %w", userID, err)
+	}
+	return balance, nil
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// Broadcast statuses
+const (
+	BroadcastStatusDraft    = "draft"
+	BroadcastStatusSending  = "sending"
+	BroadcastStatusDone     = "done"
+	BroadcastStatusCanceled = "canceled"
+)
+
+// Broadcast is a message sent by an admin to a segment of users
+type Broadcast struct {
+	ID          uint   `gorm:"primaryKey"`
+	AdminID     int64  `gorm:"not null"` // Telegram ID of the author, receives the report
+	Text        string `gorm:"type:text"`
+	PhotoFileID string `gorm:"size:255"`
+	Buttons     string `gorm:"type:text"` // JSON array of URL buttons
+	Segment     string `gorm:"size:32"`
+	Status      string `gorm:"size:16;default:'draft'"`
+	Total       int    `gorm:"default:0"`
+	Sent        int    `gorm:"default:0"`
+	Failed      int    `gorm:"default:0"`
+	Blocked     int    `gorm:"default:0"` // Recipients who blocked the bot
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	FinishedAt  *time.Time
+}
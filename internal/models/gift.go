@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// Gift statuses
+const (
+	GiftStatusPending  = "pending"  // Paid, waiting for the recipient
+	GiftStatusRedeemed = "redeemed" // Activated by the recipient
+	GiftStatusRefunded = "refunded" // Expired and returned to the buyer's balance
+)
+
+// Gift is a plan paid by one user for another. The buyer shares the code as
+// a /start gift_<code> link; whoever opens it first gets the subscription.
+type Gift struct {
+	ID          uint   `gorm:"primaryKey"`
+	Code        string `gorm:"size:32;not null;uniqueIndex"`
+	BuyerID     uint   `gorm:"not null;index"`
+	PlanID      uint   `gorm:"not null"`
+	PlanName    string `gorm:"size:255"` // Plans may be renamed or removed later
+	Days        int    `gorm:"not null"`
+	Price       int64  `gorm:"not null"` // Kopecks paid, returned on refund
+	Status      string `gorm:"size:16;not null;index"`
+	RecipientID *uint
+	ExpiresAt   time.Time // Redeem before, refundable after
+	RedeemedAt  *time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Ledger entry kinds
+const (
+	LedgerKindTopUp           = "topup"
+	LedgerKindPurchase        = "purchase"
+	LedgerKindRefund          = "refund"
+	LedgerKindReferralBonus   = "referral_bonus"
+	LedgerKindAdminAdjustment = "admin_adjustment"
+	LedgerKindPromo           = "promo"
+	LedgerKindGiftRefund      = "gift_refund"
+)
+
+// LedgerEntry is one leg of a double-entry posting. Every posting writes two
+// entries with the same TransactionID whose amounts sum to zero: one on the
+// user account and one on the matching system account. Rows are never updated
+// or deleted; User.Balance is a cache of the sum of the user account entries.
+type LedgerEntry struct {
+	ID            uint   `gorm:"primaryKey"`
+	TransactionID string `gorm:"size:36;not null;index"`
+	Account       string `gorm:"size:64;not null;index"` // "user:<id>" or a system account
+	UserID        *uint  `gorm:"index"`                  // Set on user account legs only
+	Amount        int64  `gorm:"not null"`               // Kopecks, positive increases the account
+	Kind          string `gorm:"size:32;not null;index"`
+	ReferenceType string `gorm:"size:32"` // payment, plan, ...
+	ReferenceID   string `gorm:"size:255;index"`
+	Comment       string `gorm:"size:512"`
+	CreatedAt     time.Time
+}
+
+// UserAccount returns the ledger account name of a user
+func UserAccount(userID uint) string {
+	return fmt.Sprintf("user:%d", userID)
+}
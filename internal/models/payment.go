@@ -4,14 +4,32 @@ import (
 	"time"
 )
 
+// Payment statuses
+const (
+	PaymentStatusPending   = "pending"
+	PaymentStatusSucceeded = "succeeded"
+	PaymentStatusCanceled  = "canceled"
+	PaymentStatusExpired   = "expired"
+)
+
+// Payment providers
+const (
+	PaymentProviderYooKassa = "yookassa"
+	PaymentProviderStars    = "stars"
+)
+
 type Payment struct {
-	ID         uint    `gorm:"primaryKey"`
-	UserID     uint    `gorm:"not null;index"`
-	User       User    `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
-	Amount     float64 `gorm:"not null"`
-	Status     string  `gorm:"default:'pending'"`
-	Type       string  `gorm:"default:'subscription'"` // subscription, balance_topup
-	YooKassaID string  `gorm:"size:255"`
-	CreatedAt  time.Time
-	UpdatedAt  time.Time
+	ID           uint       `gorm:"primaryKey"`
+	UserID       uint       `gorm:"not null;index"`
+	User         User       `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	Amount       int64      `gorm:"not null"` // Kopecks
+	Status       string     `gorm:"default:'pending'"`
+	Type         string     `gorm:"default:'subscription'"` // subscription, balance_topup
+	YooKassaID   string     `gorm:"size:255;uniqueIndex:idx_payments_yoo_kassa_id,where:yoo_kassa_id <> ''"`
+	Provider     string     `gorm:"size:32;default:'yookassa'"`
+	ChargeID     string     `gorm:"size:255;uniqueIndex:idx_payments_charge_id,where:charge_id <> ''"` // Telegram payment charge ID
+	DurationDays int        `gorm:"default:0"`                                                         // Days granted by a direct subscription payment
+	CheckedAt    *time.Time // Last time the reconciler asked the provider about it
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+type Plan struct {
+	ID                uint   `gorm:"primaryKey"`
+	Name              string `gorm:"size:255;not null"`
+	Price             int64  `gorm:"not null"` // Kopecks
+	DurationDays      int    `gorm:"not null"`
+	TrafficLimitBytes int64  `gorm:"default:0"` // 0 means unlimited
+	DeviceLimit       int    `gorm:"default:0"` // 0 means unlimited
+	Squads            string `gorm:"size:1024"` // Comma-separated Remnawave internal squad UUIDs
+	IsActive          bool   `gorm:"default:true;index"`
+	SortOrder         int    `gorm:"default:0"`
+	CreatedAt         time.Time
+	UpdatedAt         time.Time
+}
+
+// SquadIDs returns the plan squads as a slice, skipping empty entries
+func (p *Plan) SquadIDs() []string {
+	var squads []string
+	for _, squad := range strings.Split(p.Squads, ",") {
+		if squad = strings.TrimSpace(squad); squad != "" {
+			squads = append(squads, squad)
+		}
+	}
+	return squads
+}
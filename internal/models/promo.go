@@ -0,0 +1,58 @@
+package models
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Promo code types
+const (
+	PromoTypePercent = "percent" // Value is the discount on the next plan purchase, in percent
+	PromoTypeCredit  = "credit"  // Value is credited with the next top-up, in kopecks
+	PromoTypeDays    = "days"    // Value is days added to the next plan purchase
+)
+
+// PromoCode is created by admins. A user enters it once and it stays
+// attached to them (User.PromoCodeID) until the next purchase or top-up it
+// applies to.
+type PromoCode struct {
+	ID             uint   `gorm:"primaryKey"`
+	Code           string `gorm:"size:64;not null;uniqueIndex"` // Upper case
+	Type           string `gorm:"size:16;not null"`
+	Value          int64  `gorm:"not null"`
+	MaxUses        int    `gorm:"default:0"` // 0 means unlimited
+	MaxUsesPerUser int    `gorm:"not null"`  // 0 means unlimited
+	Uses           int    `gorm:"default:0"`
+	PlanIDs        string `gorm:"size:255"` // Comma-separated plans the code applies to, empty means any
+	ValidFrom      *time.Time
+	ValidUntil     *time.Time
+	IsActive       bool  `gorm:"default:true"`
+	CreatedBy      int64 // Telegram ID of the admin
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// AppliesToPlan reports whether the code may be used with the plan
+func (p *PromoCode) AppliesToPlan(planID uint) bool {
+	if strings.TrimSpace(p.PlanIDs) == "" {
+		return true
+	}
+	for _, item := range strings.Split(p.PlanIDs, ",") {
+		if id, err := strconv.ParseUint(strings.TrimSpace(item), 10, 64); err == nil && uint(id) == planID {
+			return true
+		}
+	}
+	return false
+}
+
+// PromoRedemption records a promo code applied to a purchase or top-up
+type PromoRedemption struct {
+	ID          uint  `gorm:"primaryKey"`
+	PromoCodeID uint  `gorm:"not null;index"`
+	UserID      uint  `gorm:"not null;index"`
+	PlanID      *uint // Set for purchases
+	Amount      int64 // Kopecks: discount given or balance credited
+	Days        int   // Bonus days granted
+	CreatedAt   time.Time
+}
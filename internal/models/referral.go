@@ -5,9 +5,9 @@ import (
 )
 
 type ReferralTransaction struct {
-	ID            uint    `gorm:"primaryKey"`
-	ReferrerID    uint    `gorm:"not null;index"`
-	InvitedUserID uint    `gorm:"not null;index"`
-	Amount        float64 `gorm:"not null"`
+	ID            uint  `gorm:"primaryKey"`
+	ReferrerID    uint  `gorm:"not null;index"`
+	InvitedUserID uint  `gorm:"not null;index"`
+	Amount        int64 `gorm:"not null"` // Kopecks
 	CreatedAt     time.Time
 }
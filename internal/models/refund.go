@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// Refund statuses mirror YooKassa
+const (
+	RefundStatusPending   = "pending"
+	RefundStatusSucceeded = "succeeded"
+	RefundStatusCanceled  = "canceled"
+)
+
+type Refund struct {
+	ID          uint    `gorm:"primaryKey"`
+	PaymentID   uint    `gorm:"not null;index"`
+	Payment     Payment `gorm:"constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	UserID      uint    `gorm:"not null;index"`
+	YooKassaID  string  `gorm:"size:255;uniqueIndex"`
+	Amount      int64   `gorm:"not null"` // Kopecks
+	Status      string  `gorm:"size:32;default:'pending'"`
+	Description string  `gorm:"size:512"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
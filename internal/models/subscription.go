@@ -4,6 +4,9 @@ import (
 	"time"
 )
 
+// PlanTypeTrial marks a free trial subscription
+const PlanTypeTrial = "trial"
+
 type Subscription struct {
 	ID              uint   `gorm:"primaryKey"`
 	UserID          uint   `gorm:"not null;index"`
@@ -11,7 +14,9 @@ type Subscription struct {
 	RemnawaveID     string `gorm:"size:255"`
 	SubscriptionURL string `gorm:"size:512"` // VPN subscription link
 	ExpirationDate  time.Time
+	PlanID          *uint  `gorm:"index"`
 	PlanType        string `gorm:"size:50"`
+	ExtraDevices    int    `gorm:"default:0"` // Paid device slots on top of the plan limit
 	CreatedAt       time.Time
 	UpdatedAt       time.Time
 }
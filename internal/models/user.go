@@ -5,13 +5,30 @@ import (
 )
 
 type User struct {
-	ID           uint    `gorm:"primaryKey"`
-	TelegramID   int64   `gorm:"uniqueIndex;not null"`
-	Username     string  `gorm:"size:255"`
-	Status       string  `gorm:"default:'active'"`
-	Balance      float64 `gorm:"default:0"`
-	ReferrerID   *uint   `gorm:"index"`
-	ReferralCode string  `gorm:"size:32;uniqueIndex"`
-	CreatedAt    time.Time
-	UpdatedAt    time.Time
+	ID           uint   `gorm:"primaryKey"`
+	TelegramID   int64  `gorm:"uniqueIndex;not null"`
+	Username     string `gorm:"size:255"`
+	Email        string `gorm:"size:255"` // Receipt recipient (54-FZ)
+	Phone        string `gorm:"size:32"`  // Receipt recipient without an email, digits only
+	Status       string `gorm:"default:'active'"`
+	Balance      int64  `gorm:"default:0"` // Kopecks, cached sum of the user's ledger entries
+	ReferrerID   *uint  `gorm:"index"`
+	ReferralCode string `gorm:"size:32;uniqueIndex"`
+
+	// Saved YooKassa payment method used for auto-renewal
+	PaymentMethodID    string `gorm:"size:64"`
+	PaymentMethodTitle string `gorm:"size:64"` // e.g. "MasterCard *4444"
+	AutoRenew          bool   `gorm:"default:false"`
+
+	IsAdmin bool `gorm:"default:false"` // Admin in addition to ADMIN_TELEGRAM_IDS
+	Banned  bool `gorm:"default:false"` // Updates from banned users are ignored
+
+	BlockedBot bool `gorm:"default:false"` // Telegram refused delivery, reset on /start
+
+	TrialUsedAt *time.Time // Set when the free trial is claimed, it is never granted again
+
+	PromoCodeID *uint // Entered promo code waiting for a purchase or top-up to apply to
+
+	CreatedAt time.Time
+	UpdatedAt time.Time
 }
@@ -5,33 +5,39 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"strconv"
-	"strings"
 	"time"
 
 	"popovka-bot/internal/config"
+	"popovka-bot/internal/ledger"
 	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
 	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/subscription"
 	"popovka-bot/internal/utils"
 
 	"github.com/mymmrac/telego"
 	tu "github.com/mymmrac/telego/telegoutil"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Handler struct {
-	RemnawaveClient *remnawave.Client
+	RemnawaveClient remnawave.API
+	PaymentClient   *Client
+	Subscriptions   *subscription.Service
 	DB              *gorm.DB
 	Bot             *telego.Bot
 	SquadID         string
 	Config          *config.Config
 }
 
-func NewHandler(remnawaveClient *remnawave.Client, db *gorm.DB, bot *telego.Bot, squadID string, cfg *config.Config) *Handler {
+func NewHandler(remnawaveClient remnawave.API, paymentClient *Client, subscriptions *subscription.Service, db *gorm.DB, bot *telego.Bot, squadID string, cfg *config.Config) *Handler {
 	return &Handler{
 		RemnawaveClient: remnawaveClient,
+		PaymentClient:   paymentClient,
+		Subscriptions:   subscriptions,
 		DB:              db,
 		Bot:             bot,
 		SquadID:         squadID,
@@ -40,21 +46,8 @@ func NewHandler(remnawaveClient *remnawave.Client, db *gorm.DB, bot *telego.Bot,
 }
 
 func (h *Handler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
-	// IP Security Check
-	clientIP := r.RemoteAddr
-	// If behind proxy (Nginx, etc), header might look like "client_ip, proxy_ip"
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		ips := strings.Split(xff, ",")
-		if len(ips) > 0 {
-			clientIP = strings.TrimSpace(ips[0])
-		}
-	} else {
-		// RemoteAddr contains port, stripe it
-		if strings.Contains(clientIP, ":") {
-			clientIP, _, _ = net.SplitHostPort(clientIP)
-		}
-	}
-
+	// IP Security Check (X-Forwarded-For is only trusted from our own proxies)
+	clientIP := utils.ClientIP(r, h.Config.TrustedProxies)
 	if !utils.IsAllowedIP(clientIP, h.Config.AllowedYooIp) {
 		log.Printf("Webhook rejected: IP %s not in whitelist", clientIP)
 		http.Error(w, "Forbidden", http.StatusForbidden)
@@ -73,23 +66,65 @@ func (h *Handler) HandleWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if notification.Event != "payment.succeeded" {
-		log.Printf("Ignored event: %s", notification.Event)
-		w.WriteHeader(http.StatusOK)
-		return
-	}
+	ctx := r.Context()
 
-	// Process successful payment
-	if err := h.processSuccess(notification.Object); err != nil {
-		log.Printf("Failed to process payment success: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
-		return
+	// Never trust the notification body: fetch the object from YooKassa
+	// and act only on the server-confirmed status, amount and metadata.
+	switch notification.Event {
+	case "payment.succeeded", "payment.canceled":
+		verified, err := h.PaymentClient.GetPayment(ctx, notification.Object.ID)
+		if err != nil {
+			log.Printf("Failed to verify payment %s: %v", notification.Object.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.ProcessPayment(ctx, verified); err != nil {
+			log.Printf("Failed to process payment %s: %v", verified.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+	case "refund.succeeded":
+		verified, err := h.PaymentClient.GetRefund(ctx, notification.Object.ID)
+		if err != nil {
+			log.Printf("Failed to verify refund %s: %v", notification.Object.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		if err := h.ProcessRefund(ctx, verified); err != nil {
+			log.Printf("Failed to process refund %s: %v", verified.ID, err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+
+	default:
+		log.Printf("Ignored event: %s", notification.Event)
 	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *Handler) processSuccess(obj WebhookObject) error {
+// ProcessPayment applies a payment state fetched from the YooKassa API.
+// It is shared by the webhook and the reconciliation worker and is safe to
+// call any number of times for the same payment.
+func (h *Handler) ProcessPayment(ctx context.Context, obj *PaymentResponse) error {
+	switch obj.Status {
+	case "succeeded":
+		if !obj.Paid {
+			return fmt.Errorf("payment %s succeeded but not paid", obj.ID)
+		}
+		return h.processSuccess(ctx, obj)
+	case "canceled":
+		return h.processCanceled(ctx, obj)
+	default:
+		log.Printf("Payment %s is still %s, nothing to do", obj.ID, obj.Status)
+		return nil
+	}
+}
+
+func (h *Handler) processSuccess(ctx context.Context, obj *PaymentResponse) error {
 	log.Printf("Processing payment success: %s", obj.ID)
 
 	telegramIDStr, ok := obj.Metadata["telegram_id"]
@@ -108,167 +143,382 @@ func (h *Handler) processSuccess(obj WebhookObject) error {
 		durationStr = "30d"
 	}
 
-	// 1. Find or Create User in DB
-	var user models.User
-	if err := h.DB.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
-		return fmt.Errorf("failed to find/create user: %w", err)
+	// Parse duration (e.g., "30d" -> 30)
+	durationDays := 30 // default
+	if len(durationStr) > 1 && durationStr[len(durationStr)-1] == 'd' {
+		if days, err := strconv.Atoi(durationStr[:len(durationStr)-1]); err == nil {
+			durationDays = days
+		}
+	}
+
+	if obj.Amount.Currency != "RUB" {
+		return fmt.Errorf("unexpected payment currency: %s", obj.Amount.Currency)
+	}
+
+	amountVal, err := utils.ParseRub(obj.Amount.Value)
+	if err != nil {
+		return fmt.Errorf("invalid payment amount %q: %w", obj.Amount.Value, err)
+	}
+
+	// Payments for a specific plan (auto-renewal) carry its ID
+	var plan *models.Plan
+	if planIDStr, ok := obj.Metadata["plan_id"]; ok {
+		planID, err := strconv.ParseUint(planIDStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid plan_id: %w", err)
+		}
+		if plan, err = h.Subscriptions.Tariffs.GetPlan(uint(planID)); err != nil {
+			return fmt.Errorf("failed to load plan %d: %w", planID, err)
+		}
+		durationDays = plan.DurationDays
 	}
 
 	paymentType := obj.Metadata["type"]
-	if paymentType == "balance_topup" {
-		// Handle Balance Top-up
-		amountVal, _ := strconv.ParseFloat(obj.Amount.Value, 64)
-
-		// Update User Balance
-		user.Balance += amountVal
-		if err := h.DB.Save(&user).Error; err != nil {
-			log.Printf("Failed to update user balance: %v", err)
+	if paymentType != "balance_topup" {
+		paymentType = "subscription"
+	} else {
+		durationDays = 0
+	}
+
+	// Messages are sent only after the transaction commits, so a retried
+	// notification never produces a second "payment succeeded" message.
+	var messages []*telego.SendMessageParams
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		// 1. Find or Create User in DB
+		var user models.User
+		if err := tx.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
+			return fmt.Errorf("failed to find/create user: %w", err)
+		}
+
+		// 2. Claim the payment. A concurrent delivery blocks on the unique
+		// index until this transaction finishes and then sees it as taken.
+		claimed, err := claimPayment(tx, &models.Payment{
+			UserID:       user.ID,
+			Amount:       amountVal,
+			Status:       models.PaymentStatusSucceeded,
+			Type:         paymentType,
+			YooKassaID:   obj.ID,
+			DurationDays: durationDays,
+		})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			log.Printf("Payment %s already processed, skipping", obj.ID)
+			return nil
 		}
 
-		// Referral Bonus Logic (15%)
-		if user.ReferrerID != nil {
-			bonusAmount := amountVal * 0.15
-			if bonusAmount > 0 {
-				var referrer models.User
-				if err := h.DB.First(&referrer, *user.ReferrerID).Error; err == nil {
-					referrer.Balance += bonusAmount
-					h.DB.Save(&referrer)
-
-					// Record Transaction
-					h.DB.Create(&models.ReferralTransaction{
-						ReferrerID:    referrer.ID,
-						InvitedUserID: user.ID,
-						Amount:        bonusAmount,
-						CreatedAt:     time.Now(),
-					})
-
-					_, _ = h.Bot.SendMessage(context.Background(), tu.Message(
-						tu.ID(referrer.TelegramID),
-						fmt.Sprintf("💰 Вам начислен реферальный бонус: %.2f₽ за пополнение друга!", bonusAmount),
-					))
-				}
+		// The user ticked "save card": remember the method for auto-renewal
+		if method := obj.PaymentMethod; method != nil && method.Saved && method.ID != "" {
+			if err := tx.Model(&user).Updates(map[string]interface{}{
+				"payment_method_id":    method.ID,
+				"payment_method_title": method.DisplayTitle(),
+				"auto_renew":           true,
+			}).Error; err != nil {
+				return fmt.Errorf("failed to save payment method: %w", err)
 			}
+			log.Printf("Saved payment method %s for user %d", method.ID, telegramID)
+		}
+
+		if paymentType == "balance_topup" {
+			messages, err = h.applyTopUp(tx, &user, obj.ID, amountVal)
+			return err
 		}
 
-		_, _ = h.Bot.SendMessage(context.Background(), tu.Message(
+		messages, err = h.applySubscription(ctx, tx, &user, durationDays, plan)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		_, _ = h.Bot.SendMessage(ctx, msg)
+	}
+
+	return nil
+}
+
+// claimPayment inserts the payment record, or takes over the pending record
+// created together with the payment. A record the reconciler expired, or
+// one canceled locally, is taken over too when the verified payment
+// succeeded after all. It reports whether the caller now owns the payment;
+// false means it has already been processed.
+func claimPayment(tx *gorm.DB, payment *models.Payment) (bool, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(payment)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record payment: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+	if payment.YooKassaID == "" {
+		// Only YooKassa payments have a pending record to take over
+		return false, nil
+	}
+
+	var existing models.Payment
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("yoo_kassa_id = ?", payment.YooKassaID).
+		First(&existing).Error; err != nil {
+		return false, fmt.Errorf("failed to lock payment %s: %w", payment.YooKassaID, err)
+	}
+	if !claimable(existing.Status, payment.Status) {
+		return false, nil
+	}
+
+	if err := tx.Model(&existing).Updates(map[string]interface{}{
+		"status": payment.Status,
+		"amount": payment.Amount,
+	}).Error; err != nil {
+		return false, fmt.Errorf("failed to update payment %s: %w", payment.YooKassaID, err)
+	}
+	return true, nil
+}
+
+// claimable reports whether a record in status from may move to status to
+func claimable(from, to string) bool {
+	switch from {
+	case models.PaymentStatusPending:
+		return true
+	case models.PaymentStatusExpired, models.PaymentStatusCanceled:
+		return to == models.PaymentStatusSucceeded
+	}
+	return false
+}
+
+// processCanceled marks a pending payment as canceled and tells the user why
+func (h *Handler) processCanceled(ctx context.Context, obj *PaymentResponse) error {
+	result := h.DB.Model(&models.Payment{}).
+		Where("yoo_kassa_id = ? AND status = ?", obj.ID, models.PaymentStatusPending).
+		Update("status", models.PaymentStatusCanceled)
+	if result.Error != nil {
+		return fmt.Errorf("failed to mark payment %s canceled: %w", obj.ID, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		// Unknown or already handled: notify only once
+		return nil
+	}
+
+	reason := ""
+	if obj.CancellationDetails != nil {
+		reason = obj.CancellationDetails.Reason
+	}
+	log.Printf("Payment %s canceled (reason: %s)", obj.ID, reason)
+
+	telegramID, err := strconv.ParseInt(obj.Metadata["telegram_id"], 10, 64)
+	if err != nil {
+		log.Printf("Payment %s has no telegram_id, skipping notification", obj.ID)
+		return nil
+	}
+
+	if obj.Metadata["auto_renew"] != "true" {
+		_, _ = h.Bot.SendMessage(ctx, tu.Message(
 			tu.ID(telegramID),
-			fmt.Sprintf("✅ Баланс успешно пополнен на %.2f₽\nТекущий баланс: %.2f₽", amountVal, user.Balance),
+			fmt.Sprintf("❌ Платёж на %s₽ отменён.\nПричина: %s", obj.Amount.Value, cancellationReasonText(reason)),
 		))
+		return nil
+	}
 
-		// Save Payment Record
-		payment := models.Payment{
-			UserID:     user.ID,
-			Amount:     amountVal,
-			Status:     "succeeded",
-			Type:       "balance_topup",
-			YooKassaID: obj.ID,
+	// The card can no longer be charged without the user: forget it
+	if reason == "permission_revoked" {
+		if err := h.UnlinkPaymentMethod(telegramID); err != nil {
+			log.Printf("Failed to unlink payment method of %d: %v", telegramID, err)
 		}
-		h.DB.Create(&payment)
+	}
 
-		return nil
+	_, _ = h.Bot.SendMessage(ctx, tu.Message(
+		tu.ID(telegramID),
+		fmt.Sprintf("❌ Не удалось автоматически продлить подписку.\nПричина: %s\n\nПродлите подписку вручную в меню 'Купить VPN'.", cancellationReasonText(reason)),
+	))
+	return nil
+}
+
+// UnlinkPaymentMethod forgets the user's saved payment method and turns
+// auto-renewal off
+func (h *Handler) UnlinkPaymentMethod(telegramID int64) error {
+	return h.DB.Model(&models.User{}).
+		Where("telegram_id = ?", telegramID).
+		Updates(map[string]interface{}{
+			"payment_method_id":    "",
+			"payment_method_title": "",
+			"auto_renew":           false,
+		}).Error
+}
+
+// cancellationReasonText explains a YooKassa cancellation reason to the user
+func cancellationReasonText(reason string) string {
+	switch reason {
+	case "3d_secure_failed":
+		return "не пройдена проверка 3-D Secure."
+	case "call_issuer":
+		return "банк отклонил платёж, обратитесь в банк."
+	case "card_expired":
+		return "истёк срок действия карты."
+	case "country_forbidden":
+		return "оплата картой этой страны недоступна."
+	case "expired_on_confirmation":
+		return "истекло время на оплату."
+	case "fraud_suspected":
+		return "платёж заблокирован из-за подозрения в мошенничестве."
+	case "insufficient_funds":
+		return "недостаточно средств на карте."
+	case "invalid_card_number":
+		return "неверный номер карты."
+	case "invalid_csc":
+		return "неверный CVV/CVC код."
+	case "issuer_unavailable":
+		return "банк недоступен, попробуйте позже."
+	case "payment_method_limit_exceeded":
+		return "превышен лимит по карте."
+	case "payment_method_restricted":
+		return "операции по карте запрещены."
+	case "canceled_by_merchant":
+		return "платёж отменён магазином."
+	case "permission_revoked":
+		return "списания без подтверждения запрещены, карта отвязана."
+	default:
+		return "платёж отклонён, попробуйте другой способ оплаты."
 	}
+}
 
-	// Legacy/Direct Subscription Logic
-	var rwID string
-	var configLink string // Store subscription URL
+// adminMessages builds the same notification for every configured admin
+func (h *Handler) adminMessages(text string) []*telego.SendMessageParams {
+	messages := make([]*telego.SendMessageParams, 0, len(h.Config.AdminIDs))
+	for _, adminID := range h.Config.AdminIDs {
+		messages = append(messages, tu.Message(tu.ID(adminID), text))
+	}
+	return messages
+}
 
-	// 2. Check if subscription exists
-	var sub models.Subscription
-	result := h.DB.Where("user_id = ?", user.ID).First(&sub)
+// referralBonusPercent is the share of a friend's top-up credited to the referrer
+const referralBonusPercent = 15
+
+func (h *Handler) applyTopUp(tx *gorm.DB, user *models.User, paymentID string, amount int64) ([]*telego.SendMessageParams, error) {
+	var messages []*telego.SendMessageParams
 
-	if result.Error == gorm.ErrRecordNotFound {
-		// New Subscription -> Create User in Remnawave
-		log.Printf("Creating new Remnawave user for TelegramID: %d", telegramID)
+	// Credit User Balance
+	updated, err := ledger.Post(tx, ledger.Entry{
+		UserID:        user.ID,
+		Amount:        amount,
+		Kind:          models.LedgerKindTopUp,
+		ReferenceType: "payment",
+		ReferenceID:   paymentID,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to credit user balance: %w", err)
+	}
 
-		// Parse duration (e.g., "30d" -> 30)
-		durationDays := 30 // default
-		if len(durationStr) > 1 && durationStr[len(durationStr)-1] == 'd' {
-			if days, err := strconv.Atoi(durationStr[:len(durationStr)-1]); err == nil {
-				durationDays = days
+	// Referral Bonus Logic
+	if user.ReferrerID != nil {
+		bonusAmount := amount * referralBonusPercent / 100
+		if bonusAmount > 0 {
+			referrer, err := ledger.Post(tx, ledger.Entry{
+				UserID:        *user.ReferrerID,
+				Amount:        bonusAmount,
+				Kind:          models.LedgerKindReferralBonus,
+				ReferenceType: "payment",
+				ReferenceID:   paymentID,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to credit referral bonus: %w", err)
 			}
-		}
 
-		rwUser, err := h.RemnawaveClient.CreateUser(telegramID, fmt.Sprintf("user_%d", telegramID), durationDays, h.SquadID)
-		if err != nil {
-			return fmt.Errorf("remnawave create user error: %w", err)
-		}
+			// Record Transaction
+			if err := tx.Create(&models.ReferralTransaction{
+				ReferrerID:    referrer.ID,
+				InvitedUserID: user.ID,
+				Amount:        bonusAmount,
+				CreatedAt:     time.Now(),
+			}).Error; err != nil {
+				return nil, fmt.Errorf("failed to record referral transaction: %w", err)
+			}
 
-		rwID = rwUser.UUID
-		configLink = rwUser.SubscriptionURL // Save subscription URL from response
-		log.Printf("DEBUG: Created user with UUID: '%s', SubscriptionURL: '%s'", rwID, configLink)
-
-		// Create Subscription record
-		expireDate := time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
-		newSub := models.Subscription{
-			UserID:          user.ID,
-			RemnawaveID:     rwUser.UUID,
-			SubscriptionURL: rwUser.SubscriptionURL, // Save subscription URL
-			ExpirationDate:  expireDate,
-			PlanType:        "standard", // Default plan
-		}
-		if err := h.DB.Create(&newSub).Error; err != nil {
-			return fmt.Errorf("failed to save subscription: %w", err)
+			messages = append(messages, tu.Message(
+				tu.ID(referrer.TelegramID),
+				fmt.Sprintf("💰 Вам начислен реферальный бонус: %s₽ за пополнение друга!", utils.FormatRub(bonusAmount)),
+			))
 		}
+	}
 
-	} else if result.Error == nil {
-		rwID = sub.RemnawaveID
-		// Existing Subscription -> Extend
-		log.Printf("Extending subscription for RemnawaveID: %s", sub.RemnawaveID)
+	// Credit promo code entered before the top-up
+	var bonusText string
+	code, err := h.applyPromoCredit(tx, user, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	if code != nil {
+		bonusText = fmt.Sprintf("\n🎟 Бонус по промокоду %s: +%s₽", code.Code, utils.FormatRub(code.Value))
+		updated.Balance += code.Value
+	}
 
-		// Parse duration
-		durationDays := 30
-		if len(durationStr) > 1 && durationStr[len(durationStr)-1] == 'd' {
-			if days, err := strconv.Atoi(durationStr[:len(durationStr)-1]); err == nil {
-				durationDays = days
-			}
-		}
+	messages = append(messages, tu.Message(
+		tu.ID(user.TelegramID),
+		fmt.Sprintf("✅ Баланс успешно пополнен на %s₽%s\nТекущий баланс: %s₽", utils.FormatRub(amount), bonusText, utils.FormatRub(updated.Balance)),
+	))
 
-		if err := h.RemnawaveClient.ExtendSubscription(sub.RemnawaveID, durationDays); err != nil {
-			return fmt.Errorf("remnawave extend error: %w", err)
-		}
+	return messages, nil
+}
 
-		// Update subscription expiration date in DB
-		newExpireDate := time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
-		if err := h.DB.Model(&sub).Update("expiration_date", newExpireDate).Error; err != nil {
-			log.Printf("Failed to update subscription expiration date: %v", err)
-		}
-	} else {
-		return fmt.Errorf("db error checking subscription: %w", result.Error)
+// applyPromoCredit credits the user's pending credit promo code, if any, and
+// returns it
+func (h *Handler) applyPromoCredit(tx *gorm.DB, user *models.User, paymentID string) (*models.PromoCode, error) {
+	code, err := promo.Pending(tx, user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load promo code: %w", err)
+	}
+	if code == nil || code.Type != models.PromoTypeCredit || code.Value <= 0 {
+		return nil, nil
 	}
 
-	// 3. Record Payment
-	amountVal, _ := strconv.ParseFloat(obj.Amount.Value, 64)
-	payment := models.Payment{
-		UserID:     user.ID,
-		Amount:     amountVal,
-		Status:     "succeeded",
-		Type:       "subscription",
-		YooKassaID: obj.ID,
+	err = promo.Redeem(tx, code, user.ID, nil, code.Value, 0)
+	if promo.IsInvalid(err) {
+		// Used up concurrently: the top-up itself must still go through
+		log.Printf("Promo code %s is no longer valid for user %d: %v", code.Code, user.ID, err)
+		return nil, nil
 	}
-	if err := h.DB.Create(&payment).Error; err != nil {
-		log.Printf("Failed to record payment: %v", err)
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem promo code %s: %w", code.Code, err)
 	}
 
-	// 4. Notify User
-	log.Printf("DEBUG: rwID value: '%s', configLink: '%s'", rwID, configLink)
+	if _, err := ledger.Post(tx, ledger.Entry{
+		UserID:        user.ID,
+		Amount:        code.Value,
+		Kind:          models.LedgerKindPromo,
+		ReferenceType: "promo",
+		ReferenceID:   code.Code,
+		Comment:       "Payment " + paymentID,
+	}); err != nil {
+		return nil, fmt.Errorf("failed to credit promo bonus: %w", err)
+	}
+	return code, nil
+}
 
-	// If we don't have configLink yet (for existing subscriptions), get it from DB
-	if configLink == "" {
-		var sub models.Subscription
-		if err := h.DB.Where("remnawave_id = ?", rwID).First(&sub).Error; err != nil {
-			log.Printf("Failed to get subscription for user %d: %v", telegramID, err)
-			_, _ = h.Bot.SendMessage(context.Background(), tu.Message(tu.ID(telegramID), "✅ Оплата прошла успешно! Но возникла проблема при получении ссылки на конфиг. Напишите в поддержку."))
-			return nil // Still success for YooKassa
-		}
-		configLink = sub.SubscriptionURL
+// applySubscription handles direct subscription payments: legacy payment
+// links and auto-renewal charges of a saved card
+func (h *Handler) applySubscription(ctx context.Context, tx *gorm.DB, user *models.User, durationDays int, plan *models.Plan) ([]*telego.SendMessageParams, error) {
+	telegramID := user.TelegramID
+
+	sub, err := h.Subscriptions.Extend(ctx, tx, user, durationDays, plan)
+	if err != nil {
+		return nil, err
 	}
 
-	_, _ = h.Bot.SendMessage(context.Background(), tu.Message(
-		tu.ID(telegramID),
-		fmt.Sprintf("✅ Оплата прошла успешно!\n\nТвоя ссылка на VPN:\n%s\n\nПриятного пользования!", configLink),
-	))
+	// Notify User
+	if sub.SubscriptionURL == "" {
+		log.Printf("Subscription link missing for user %d", telegramID)
+		return []*telego.SendMessageParams{
+			tu.Message(tu.ID(telegramID), "✅ Оплата прошла успешно! Но возникла проблема при получении ссылки на конфиг. Напишите в поддержку."),
+		}, nil
+	}
 
-	return nil
+	return []*telego.SendMessageParams{
+		tu.Message(
+			tu.ID(telegramID),
+			fmt.Sprintf("✅ Оплата прошла успешно!\n\n📅 Действует до: %s\n\nТвоя ссылка на VPN:\n%s\n\nПриятного пользования!", sub.ExpirationDate.Format("02.01.2006"), sub.SubscriptionURL),
+		),
+	}, nil
 }
 
 // rwID helper
@@ -0,0 +1,309 @@
+package payment_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/payment"
+	"popovka-bot/internal/payment/yookassatest"
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/remnawave/remnawavetest"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/tariff"
+	"popovka-bot/internal/testutil"
+
+	"gorm.io/gorm"
+)
+
+type env struct {
+	db       *gorm.DB
+	tg       *testutil.Telegram
+	yookassa *yookassatest.Server
+	handler  *payment.Handler
+	provider *payment.YooKassaProvider
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+
+	cfg := &config.Config{
+		AllowedYooIp:   []string{"185.71.76.0/27"},
+		TrustedProxies: []string{"127.0.0.1/32", "::1/128"},
+	}
+
+	db := testutil.DB(t)
+	tg := testutil.NewTelegram(t)
+
+	panel := remnawavetest.NewServer()
+	t.Cleanup(panel.Close)
+	yookassa := yookassatest.NewServer()
+	t.Cleanup(yookassa.Close)
+
+	tariffs := tariff.NewService(db, "squad-default")
+	subs := subscription.NewService(panel.Client(), tariffs)
+	handler := payment.NewHandler(panel.Client(), yookassa.Client(), subs, db, tg.Bot, "squad-default", cfg)
+
+	webhook := httptest.NewServer(http.HandlerFunc(handler.HandleWebhook))
+	t.Cleanup(webhook.Close)
+	yookassa.WebhookURL = webhook.URL
+
+	return &env{
+		db:       db,
+		tg:       tg,
+		yookassa: yookassa,
+		handler:  handler,
+		provider: payment.NewYooKassaProvider(yookassa.Client(), db, cfg, false),
+	}
+}
+
+func (e *env) newUser(t *testing.T, telegramID int64, referrerID *uint) *models.User {
+	t.Helper()
+
+	user := testutil.NewUser(t, e.db, telegramID, 0)
+	if referrerID != nil {
+		if err := e.db.Model(user).Update("referrer_id", *referrerID).Error; err != nil {
+			t.Fatalf("set referrer: %v", err)
+		}
+	}
+	return user
+}
+
+// startTopUp creates a top-up like the bot does and returns the YooKassa payment ID
+func (e *env) startTopUp(t *testing.T, user *models.User, amount int64) string {
+	t.Helper()
+
+	if _, err := e.provider.CreateTopUp(context.Background(), user, amount); err != nil {
+		t.Fatalf("CreateTopUp: %v", err)
+	}
+
+	var p models.Payment
+	if err := e.db.Where("user_id = ?", user.ID).Order("id DESC").First(&p).Error; err != nil {
+		t.Fatalf("pending payment was not saved: %v", err)
+	}
+	if p.Status != models.PaymentStatusPending {
+		t.Fatalf("new payment status = %s, want pending", p.Status)
+	}
+	return p.YooKassaID
+}
+
+func (e *env) succeed(t *testing.T, paymentID string) {
+	t.Helper()
+
+	status, err := e.yookassa.Succeed(paymentID)
+	if err != nil {
+		t.Fatalf("Succeed: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("webhook status = %d, want 200", status)
+	}
+}
+
+func TestTopUp(t *testing.T) {
+	e := newEnv(t)
+	user := e.newUser(t, 3001, nil)
+
+	paymentID := e.startTopUp(t, user, 50000)
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Fatalf("balance before payment = %d, want 0", got)
+	}
+
+	e.succeed(t, paymentID)
+
+	if got := testutil.Balance(t, e.db, user.ID); got != 50000 {
+		t.Errorf("balance = %d, want 50000", got)
+	}
+
+	var p models.Payment
+	if err := e.db.Where("yoo_kassa_id = ?", paymentID).First(&p).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if p.Status != models.PaymentStatusSucceeded || p.Amount != 50000 {
+		t.Errorf("payment = %s/%d, want succeeded/50000", p.Status, p.Amount)
+	}
+
+	var entries int64
+	e.db.Model(&models.LedgerEntry{}).Where("reference_id = ?", paymentID).Count(&entries)
+	if entries != 2 {
+		t.Errorf("%d ledger entries for the payment, want 2", entries)
+	}
+
+	if msgs := e.tg.Messages(user.TelegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages to the user, want 1", len(msgs))
+	}
+}
+
+func TestTopUpReferralBonus(t *testing.T) {
+	e := newEnv(t)
+	referrer := e.newUser(t, 3002, nil)
+	friend := e.newUser(t, 3003, &referrer.ID)
+
+	e.succeed(t, e.startTopUp(t, friend, 20000))
+
+	if got := testutil.Balance(t, e.db, friend.ID); got != 20000 {
+		t.Errorf("friend balance = %d, want 20000", got)
+	}
+	if got := testutil.Balance(t, e.db, referrer.ID); got != 3000 {
+		t.Errorf("referrer balance = %d, want 3000 (15%%)", got)
+	}
+
+	var transactions []models.ReferralTransaction
+	e.db.Find(&transactions)
+	if len(transactions) != 1 || transactions[0].Amount != 3000 || transactions[0].InvitedUserID != friend.ID {
+		t.Errorf("referral transactions = %+v, want one of 3000 for user %d", transactions, friend.ID)
+	}
+
+	if msgs := e.tg.Messages(referrer.TelegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages to the referrer, want 1", len(msgs))
+	}
+}
+
+func TestTopUpPromoCredit(t *testing.T) {
+	e := newEnv(t)
+	user := e.newUser(t, 3010, nil)
+
+	code := models.PromoCode{Code: "BONUS50", Type: models.PromoTypeCredit, Value: 5000, MaxUsesPerUser: 1, IsActive: true}
+	if err := e.db.Create(&code).Error; err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	if _, err := promo.Activate(e.db, user, "bonus50"); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+
+	e.succeed(t, e.startTopUp(t, user, 20000))
+	e.succeed(t, e.startTopUp(t, user, 20000))
+
+	// The bonus comes with the first top-up only
+	if got := testutil.Balance(t, e.db, user.ID); got != 45000 {
+		t.Errorf("balance = %d, want 45000", got)
+	}
+
+	var redemptions []models.PromoRedemption
+	e.db.Find(&redemptions)
+	if len(redemptions) != 1 || redemptions[0].Amount != 5000 || redemptions[0].UserID != user.ID {
+		t.Errorf("redemptions = %+v, want one of 5000 for user %d", redemptions, user.ID)
+	}
+}
+
+func TestDuplicateWebhook(t *testing.T) {
+	e := newEnv(t)
+	referrer := e.newUser(t, 3004, nil)
+	user := e.newUser(t, 3005, &referrer.ID)
+
+	paymentID := e.startTopUp(t, user, 10000)
+	e.succeed(t, paymentID)
+
+	// Redelivery of the same notification is a 200 no-op
+	status, err := e.yookassa.Notify("payment.succeeded", paymentID)
+	if err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("duplicate webhook status = %d, want 200", status)
+	}
+
+	// So are concurrent deliveries, e.g. to several replicas
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _ = e.yookassa.Notify("payment.succeeded", paymentID)
+		}()
+	}
+	wg.Wait()
+
+	if got := testutil.Balance(t, e.db, user.ID); got != 10000 {
+		t.Errorf("balance = %d, want 10000 (credited once)", got)
+	}
+	if got := testutil.Balance(t, e.db, referrer.ID); got != 1500 {
+		t.Errorf("referrer balance = %d, want 1500 (credited once)", got)
+	}
+	if msgs := e.tg.Messages(user.TelegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages to the user, want 1", len(msgs))
+	}
+}
+
+func TestWebhookFromUnknownIPIsRejected(t *testing.T) {
+	e := newEnv(t)
+	user := e.newUser(t, 3006, nil)
+	paymentID := e.startTopUp(t, user, 10000)
+
+	req := httptest.NewRequest(http.MethodPost, "/yookassa-webhook", nil)
+	req.RemoteAddr = "203.0.113.5:4000"
+	req.Header.Set("X-Forwarded-For", yookassatest.SourceIP)
+	rec := httptest.NewRecorder()
+	e.handler.HandleWebhook(rec, req)
+
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403", rec.Code)
+	}
+	if p, _ := e.yookassa.Payment(paymentID); p.Status != "pending" {
+		t.Fatalf("fake payment status = %s, want pending", p.Status)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
+
+func TestCanceledTopUp(t *testing.T) {
+	e := newEnv(t)
+	user := e.newUser(t, 3007, nil)
+	paymentID := e.startTopUp(t, user, 10000)
+
+	status, err := e.yookassa.Cancel(paymentID, "insufficient_funds")
+	if err != nil {
+		t.Fatalf("Cancel: %v", err)
+	}
+	if status != http.StatusOK {
+		t.Fatalf("webhook status = %d, want 200", status)
+	}
+
+	var p models.Payment
+	if err := e.db.Where("yoo_kassa_id = ?", paymentID).First(&p).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if p.Status != models.PaymentStatusCanceled {
+		t.Errorf("payment status = %s, want canceled", p.Status)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+	if msgs := e.tg.Messages(user.TelegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages to the user, want 1", len(msgs))
+	}
+}
+
+func TestExpiredTopUpSucceedsLater(t *testing.T) {
+	e := newEnv(t)
+	user := e.newUser(t, 3008, nil)
+	paymentID := e.startTopUp(t, user, 10000)
+
+	// The reconciler gave up on the payment before the user paid
+	e.db.Model(&models.Payment{}).Where("yoo_kassa_id = ?", paymentID).Update("status", models.PaymentStatusExpired)
+
+	e.succeed(t, paymentID)
+
+	var p models.Payment
+	if err := e.db.Where("yoo_kassa_id = ?", paymentID).First(&p).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if p.Status != models.PaymentStatusSucceeded {
+		t.Errorf("payment status = %s, want succeeded", p.Status)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 10000 {
+		t.Errorf("balance = %d, want 10000", got)
+	}
+
+	// A redelivered notification doesn't credit it again
+	if _, err := e.yookassa.Notify("payment.succeeded", paymentID); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 10000 {
+		t.Errorf("balance after redelivery = %d, want 10000", got)
+	}
+}
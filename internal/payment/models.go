@@ -14,18 +14,92 @@ type Confirmation struct {
 type CreatePaymentRequest struct {
 	Amount       Amount            `json:"amount"`
 	Capture      bool              `json:"capture"`
-	Confirmation Confirmation      `json:"confirmation"`
+	Confirmation *Confirmation     `json:"confirmation,omitempty"`
 	Description  string            `json:"description,omitempty"`
 	Metadata     map[string]string `json:"metadata,omitempty"`
+	Receipt      *Receipt          `json:"receipt,omitempty"`
+
+	// Recurring payments: save the method on the first payment, then charge
+	// it later by ID without a confirmation step
+	SavePaymentMethod bool   `json:"save_payment_method,omitempty"`
+	PaymentMethodID   string `json:"payment_method_id,omitempty"`
+}
+
+// Receipt is the 54-FZ fiscal receipt data sent along with a payment or refund
+type Receipt struct {
+	Customer      ReceiptCustomer `json:"customer"`
+	Items         []ReceiptItem   `json:"items"`
+	TaxSystemCode int             `json:"tax_system_code,omitempty"`
+}
+
+type ReceiptCustomer struct {
+	Email string `json:"email,omitempty"`
+	Phone string `json:"phone,omitempty"` // E.164 without "+", e.g. 79001234567
+}
+
+type ReceiptItem struct {
+	Description    string `json:"description"` // Up to 128 characters
+	Quantity       string `json:"quantity"`
+	Amount         Amount `json:"amount"` // Price of a single unit
+	VatCode        int    `json:"vat_code"`
+	PaymentSubject string `json:"payment_subject,omitempty"`
+	PaymentMode    string `json:"payment_mode,omitempty"`
 }
 
 type PaymentResponse struct {
-	ID           string            `json:"id"`
-	Status       string            `json:"status"`
-	Paid         bool              `json:"paid"`
-	Amount       Amount            `json:"amount"`
-	Confirmation Confirmation      `json:"confirmation"`
-	Metadata     map[string]string `json:"metadata,omitempty"`
+	ID                  string               `json:"id"`
+	Status              string               `json:"status"`
+	Paid                bool                 `json:"paid"`
+	Amount              Amount               `json:"amount"`
+	Confirmation        Confirmation         `json:"confirmation"`
+	Description         string               `json:"description,omitempty"`
+	Metadata            map[string]string    `json:"metadata,omitempty"`
+	CancellationDetails *CancellationDetails `json:"cancellation_details,omitempty"`
+	PaymentMethod       *PaymentMethod       `json:"payment_method,omitempty"`
+}
+
+type PaymentMethod struct {
+	Type  string `json:"type"`
+	ID    string `json:"id"`
+	Saved bool   `json:"saved"`
+	Title string `json:"title,omitempty"`
+	Card  *Card  `json:"card,omitempty"`
+}
+
+type Card struct {
+	Last4    string `json:"last4"`
+	CardType string `json:"card_type"`
+}
+
+// DisplayTitle describes the method for the user, e.g. "MasterCard *4444"
+func (m *PaymentMethod) DisplayTitle() string {
+	if m.Card != nil && m.Card.Last4 != "" {
+		return m.Card.CardType + " *" + m.Card.Last4
+	}
+	if m.Title != "" {
+		return m.Title
+	}
+	return m.Type
+}
+
+type CancellationDetails struct {
+	Party  string `json:"party"`
+	Reason string `json:"reason"`
+}
+
+type CreateRefundRequest struct {
+	PaymentID   string   `json:"payment_id"`
+	Amount      Amount   `json:"amount"`
+	Description string   `json:"description,omitempty"`
+	Receipt     *Receipt `json:"receipt,omitempty"`
+}
+
+type RefundResponse struct {
+	ID          string `json:"id"`
+	PaymentID   string `json:"payment_id"`
+	Status      string `json:"status"`
+	Amount      Amount `json:"amount"`
+	Description string `json:"description,omitempty"`
 }
 
 // Webhook structures
@@ -37,9 +111,10 @@ type WebhookNotification struct {
 }
 
 type WebhookObject struct {
-	ID       string            `json:"id"`
-	Status   string            `json:"status"`
-	Paid     bool              `json:"paid"`
-	Amount   Amount            `json:"amount"`
-	Metadata map[string]string `json:"metadata"`
+	ID        string            `json:"id"`
+	PaymentID string            `json:"payment_id,omitempty"` // Refund events only
+	Status    string            `json:"status"`
+	Paid      bool              `json:"paid"`
+	Amount    Amount            `json:"amount"`
+	Metadata  map[string]string `json:"metadata"`
 }
@@ -0,0 +1,94 @@
+package payment
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/utils"
+
+	"gorm.io/gorm"
+)
+
+// Provider starts balance top-ups through a particular payment system.
+// Whatever the provider, a completed top-up is credited through the same
+// ledger and referral logic (Handler.applyTopUp).
+type Provider interface {
+	// Name identifies the provider in callback data
+	Name() string
+	// Title is shown on the payment method button
+	Title() string
+	// CreateTopUp starts a top-up of amount kopecks. It returns a URL the user
+	// has to open, or an empty string if the payment form was already sent
+	// to the chat.
+	CreateTopUp(ctx context.Context, user *models.User, amount int64) (string, error)
+	// NeedsReceiptContact reports whether the user has to leave an email or
+	// a phone for the fiscal receipt before paying
+	NeedsReceiptContact() bool
+}
+
+// YooKassaProvider creates redirect payments in YooKassa. With SaveCard set
+// the payment method is saved for subscription auto-renewal.
+type YooKassaProvider struct {
+	Client   *Client
+	DB       *gorm.DB
+	Config   *config.Config
+	SaveCard bool
+}
+
+func NewYooKassaProvider(client *Client, db *gorm.DB, cfg *config.Config, saveCard bool) *YooKassaProvider {
+	return &YooKassaProvider{
+		Client:   client,
+		DB:       db,
+		Config:   cfg,
+		SaveCard: saveCard,
+	}
+}
+
+func (p *YooKassaProvider) Name() string {
+	if p.SaveCard {
+		return "yookassa_autopay"
+	}
+	return models.PaymentProviderYooKassa
+}
+
+func (p *YooKassaProvider) Title() string {
+	if p.SaveCard {
+		return "🔁 Картой + автопродление"
+	}
+	return "💳 Банковская карта / СБП"
+}
+
+func (p *YooKassaProvider) NeedsReceiptContact() bool {
+	return p.Config.ReceiptEnabled
+}
+
+func (p *YooKassaProvider) CreateTopUp(ctx context.Context, user *models.User, amount int64) (string, error) {
+	metadata := map[string]string{
+		"telegram_id": strconv.FormatInt(user.TelegramID, 10),
+		"type":        "balance_topup",
+	}
+
+	receipt := NewReceipt(p.Config, user, "Пополнение баланса VPN", amount)
+	paymentResp, err := p.Client.CreatePayment(ctx, utils.FormatRub(amount), "RUB", "Пополнение баланса", "https://t.me/your_bot_name", metadata, receipt, p.SaveCard)
+	if err != nil {
+		return "", fmt.Errorf("failed to create yookassa payment: %w", err)
+	}
+
+	// Track the payment so it can be reconciled if the webhook never arrives
+	if err := p.DB.Create(&models.Payment{
+		UserID:     user.ID,
+		Amount:     amount,
+		Status:     models.PaymentStatusPending,
+		Type:       "balance_topup",
+		Provider:   models.PaymentProviderYooKassa,
+		YooKassaID: paymentResp.ID,
+	}).Error; err != nil {
+		log.Printf("Failed to save pending payment %s: %v", paymentResp.ID, err)
+	}
+
+	return paymentResp.Confirmation.ConfirmationURL, nil
+}
@@ -0,0 +1,75 @@
+package payment
+
+import (
+	"net/mail"
+	"strings"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/utils"
+)
+
+// NewReceipt builds a single-item receipt for the given amount in kopecks,
+// sent to the user's email or phone. It returns nil when receipts are
+// disabled, so the result can be passed to the client as is.
+func NewReceipt(cfg *config.Config, user *models.User, description string, amount int64) *Receipt {
+	if !cfg.ReceiptEnabled {
+		return nil
+	}
+
+	return &Receipt{
+		Customer: ReceiptCustomer{
+			Email: user.Email,
+			Phone: user.Phone,
+		},
+		Items: []ReceiptItem{
+			{
+				Description: description,
+				Quantity:    "1.00",
+				Amount: Amount{
+					Value:    utils.FormatRub(amount),
+					Currency: "RUB",
+				},
+				VatCode:        cfg.ReceiptVatCode,
+				PaymentSubject: cfg.ReceiptPaymentSubject,
+				PaymentMode:    cfg.ReceiptPaymentMode,
+			},
+		},
+		TaxSystemCode: cfg.ReceiptTaxSystemCode,
+	}
+}
+
+// ParseReceiptContact accepts an email address or a phone number to send
+// receipts to. Exactly one of email and phone is set when ok; the phone is
+// returned as digits with the country code, as YooKassa expects it.
+func ParseReceiptContact(input string) (email, phone string, ok bool) {
+	input = strings.TrimSpace(input)
+	if strings.Contains(input, "@") {
+		address, err := mail.ParseAddress(input)
+		if err != nil || address.Name != "" {
+			return "", "", false
+		}
+		return address.Address, "", true
+	}
+
+	var digits strings.Builder
+	for _, r := range strings.TrimPrefix(input, "+") {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')':
+		default:
+			return "", "", false
+		}
+	}
+	phone = digits.String()
+
+	// Russian numbers are often written with a leading 8 instead of +7
+	if len(phone) == 11 && phone[0] == '8' && !strings.HasPrefix(input, "+") {
+		phone = "7" + phone[1:]
+	}
+	if len(phone) < 11 || len(phone) > 15 {
+		return "", "", false
+	}
+	return "", phone, true
+}
@@ -0,0 +1,30 @@
+package payment_test
+
+import (
+	"testing"
+
+	"popovka-bot/internal/payment"
+)
+
+func TestParseReceiptContact(t *testing.T) {
+	tests := []struct {
+		input        string
+		email, phone string
+		ok           bool
+	}{
+		{input: " user@example.com ", email: "user@example.com", ok: true},
+		{input: "+7 (900) 123-45-67", phone: "79001234567", ok: true},
+		{input: "89001234567", phone: "79001234567", ok: true},
+		{input: "+375291234567", phone: "375291234567", ok: true},
+		{input: "User <user@example.com>"},
+		{input: "user@"},
+		{input: "1234567"},
+		{input: "+7 900 ABC-45-67"},
+	}
+	for _, tt := range tests {
+		email, phone, ok := payment.ParseReceiptContact(tt.input)
+		if email != tt.email || phone != tt.phone || ok != tt.ok {
+			t.Errorf("ParseReceiptContact(%q) = %q, %q, %v, want %q, %q, %v", tt.input, email, phone, ok, tt.email, tt.phone, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	// ErrPaymentNotFound is returned when no succeeded payment has the given ID
+	ErrPaymentNotFound = errors.New("payment not found")
+	// ErrInvalidRefundAmount is returned when the amount exceeds what is left to refund
+	ErrInvalidRefundAmount = errors.New("invalid refund amount")
+)
+
+// RequestRefund issues a full (amount == 0) or partial refund of a succeeded
+// YooKassa payment. The refund is recorded as pending first; if YooKassa
+// completes it synchronously it is applied right away, otherwise the
+// refund.succeeded webhook applies it later.
+func (h *Handler) RequestRefund(ctx context.Context, yooKassaPaymentID string, amount int64, description string) (*RefundResponse, error) {
+	var resp *RefundResponse
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		// The lock serializes refunds of one payment, so two requests cannot
+		// both pass the remaining-sum check
+		var payment models.Payment
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("yoo_kassa_id = ? AND status = ?", yooKassaPaymentID, models.PaymentStatusSucceeded).
+			First(&payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrPaymentNotFound
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load payment %s: %w", yooKassaPaymentID, err)
+		}
+		var user models.User
+		if err := tx.First(&user, payment.UserID).Error; err != nil {
+			return fmt.Errorf("failed to load user %d: %w", payment.UserID, err)
+		}
+
+		var refunded int64
+		if err := tx.Model(&models.Refund{}).
+			Where("payment_id = ? AND status IN ?", payment.ID, []string{models.RefundStatusPending, models.RefundStatusSucceeded}).
+			Select("COALESCE(SUM(amount), 0)").
+			Scan(&refunded).Error; err != nil {
+			return fmt.Errorf("failed to sum refunds: %w", err)
+		}
+
+		remaining := payment.Amount - refunded
+		if amount == 0 {
+			amount = remaining
+		}
+		if amount <= 0 || amount > remaining {
+			return fmt.Errorf("%w: requested %s₽, refundable %s₽", ErrInvalidRefundAmount, utils.FormatRub(amount), utils.FormatRub(remaining))
+		}
+
+		receipt := NewReceipt(h.Config, &user, "Возврат оплаты услуг VPN", amount)
+		resp, err = h.PaymentClient.CreateRefund(ctx, payment.YooKassaID, utils.FormatRub(amount), "RUB", description, receipt)
+		if err != nil {
+			return fmt.Errorf("yookassa refund error: %w", err)
+		}
+
+		// The refund exists at YooKassa now, so nothing may roll back
+		if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.Refund{
+			PaymentID:   payment.ID,
+			UserID:      payment.UserID,
+			YooKassaID:  resp.ID,
+			Amount:      amount,
+			Status:      models.RefundStatusPending,
+			Description: description,
+		}).Error; err != nil {
+			// The webhook will still record and apply it
+			log.Printf("Failed to record refund %s: %v", resp.ID, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.Status {
+	case models.RefundStatusSucceeded:
+		if err := h.ProcessRefund(ctx, resp); err != nil {
+			return resp, fmt.Errorf("refund created but not applied: %w", err)
+		}
+	case models.RefundStatusCanceled:
+		if err := h.DB.Model(&models.Refund{}).Where("yoo_kassa_id = ?", resp.ID).Update("status", models.RefundStatusCanceled).Error; err != nil {
+			log.Printf("Failed to mark refund %s canceled: %v", resp.ID, err)
+		}
+	}
+
+	return resp, nil
+}
+
+// ProcessRefund applies a refund state fetched from the YooKassa API: a
+// refunded top-up is debited from the balance, a refunded subscription
+// payment shortens the subscription proportionally. Safe to call repeatedly.
+func (h *Handler) ProcessRefund(ctx context.Context, obj *RefundResponse) error {
+	if obj.Status != models.RefundStatusSucceeded {
+		log.Printf("Refund %s is %s, nothing to do", obj.ID, obj.Status)
+		return nil
+	}
+
+	amount, err := utils.ParseRub(obj.Amount.Value)
+	if err != nil {
+		return fmt.Errorf("invalid refund amount %q: %w", obj.Amount.Value, err)
+	}
+
+	var messages []*telego.SendMessageParams
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		var payment models.Payment
+		err := tx.Preload("User").Where("yoo_kassa_id = ?", obj.PaymentID).First(&payment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			log.Printf("Refund %s references unknown payment %s, skipping", obj.ID, obj.PaymentID)
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to load payment %s: %w", obj.PaymentID, err)
+		}
+
+		claimed, err := claimRefund(tx, &models.Refund{
+			PaymentID:   payment.ID,
+			UserID:      payment.UserID,
+			YooKassaID:  obj.ID,
+			Amount:      amount,
+			Status:      models.RefundStatusSucceeded,
+			Description: obj.Description,
+		})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			log.Printf("Refund %s already processed, skipping", obj.ID)
+			return nil
+		}
+
+		if payment.Type == "balance_topup" {
+			messages, err = h.applyTopUpRefund(tx, &payment, obj.ID, amount)
+		} else {
+			messages, err = h.applySubscriptionRefund(ctx, tx, &payment, amount)
+		}
+		if err != nil {
+			return err
+		}
+
+		messages = append(messages, h.adminMessages(fmt.Sprintf(
+			"↩️ Возврат %s₽ по платежу %s\nПользователь: %d\nID возврата: %s",
+			utils.FormatRub(amount), payment.YooKassaID, payment.User.TelegramID, obj.ID,
+		))...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		_, _ = h.Bot.SendMessage(ctx, msg)
+	}
+
+	return nil
+}
+
+// claimRefund inserts the refund record, or takes over a pending record
+// created when the refund was requested. It reports whether the caller now
+// owns the refund; false means it has already been applied.
+func claimRefund(tx *gorm.DB, refund *models.Refund) (bool, error) {
+	result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(refund)
+	if result.Error != nil {
+		return false, fmt.Errorf("failed to record refund: %w", result.Error)
+	}
+	if result.RowsAffected > 0 {
+		return true, nil
+	}
+
+	var existing models.Refund
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("yoo_kassa_id = ?", refund.YooKassaID).
+		First(&existing).Error; err != nil {
+		return false, fmt.Errorf("failed to lock refund %s: %w", refund.YooKassaID, err)
+	}
+	if existing.Status == models.RefundStatusSucceeded {
+		return false, nil
+	}
+
+	if err := tx.Model(&existing).Updates(map[string]interface{}{
+		"status": refund.Status,
+		"amount": refund.Amount,
+	}).Error; err != nil {
+		return false, fmt.Errorf("failed to update refund %s: %w", refund.YooKassaID, err)
+	}
+	return true, nil
+}
+
+func (h *Handler) applyTopUpRefund(tx *gorm.DB, payment *models.Payment, refundID string, amount int64) ([]*telego.SendMessageParams, error) {
+	// The money may already be spent, so the balance is allowed to go negative
+	updated, err := ledger.Post(tx, ledger.Entry{
+		UserID:        payment.UserID,
+		Amount:        -amount,
+		Kind:          models.LedgerKindRefund,
+		ReferenceType: "refund",
+		ReferenceID:   refundID,
+		AllowNegative: true,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to debit refund: %w", err)
+	}
+
+	return []*telego.SendMessageParams{
+		tu.Message(
+			tu.ID(payment.User.TelegramID),
+			fmt.Sprintf("↩️ Оформлен возврат %s₽ за пополнение баланса.\nТекущий баланс: %s₽", utils.FormatRub(amount), utils.FormatRub(updated.Balance)),
+		),
+	}, nil
+}
+
+func (h *Handler) applySubscriptionRefund(ctx context.Context, tx *gorm.DB, payment *models.Payment, amount int64) ([]*telego.SendMessageParams, error) {
+	durationDays := int64(payment.DurationDays)
+	if durationDays == 0 {
+		durationDays = 30 // Legacy payments were always 30 days
+	}
+
+	// Shorten by the refunded share of the paid period, rounded up
+	days := durationDays
+	if payment.Amount > 0 && amount < payment.Amount {
+		days = (durationDays*amount + payment.Amount - 1) / payment.Amount
+	}
+
+	var sub models.Subscription
+	if err := tx.Where("user_id = ?", payment.UserID).First(&sub).Error; err != nil {
+		return nil, fmt.Errorf("failed to load subscription for refund: %w", err)
+	}
+
+	if err := h.Subscriptions.Shorten(ctx, tx, &sub, int(days)); err != nil {
+		return nil, err
+	}
+
+	return []*telego.SendMessageParams{
+		tu.Message(
+			tu.ID(payment.User.TelegramID),
+			fmt.Sprintf("↩️ Оформлен возврат %s₽ за подписку.\nСрок подписки сокращён на %d дн., теперь она действует до %s.",
+				utils.FormatRub(amount), days, sub.ExpirationDate.Format("02.01.2006")),
+		),
+	}, nil
+}
@@ -0,0 +1,164 @@
+package payment
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"gorm.io/gorm"
+)
+
+// starsCurrency is the Telegram Stars currency code
+const starsCurrency = "XTR"
+
+// ErrInvalidInvoice is returned when a Stars invoice payload or amount does not match
+var ErrInvalidInvoice = errors.New("invalid invoice")
+
+// StarsProvider sends Telegram Stars invoices right into the chat
+type StarsProvider struct {
+	Bot            *telego.Bot
+	KopecksPerStar int64
+}
+
+func NewStarsProvider(bot *telego.Bot, kopecksPerStar int64) *StarsProvider {
+	return &StarsProvider{
+		Bot:            bot,
+		KopecksPerStar: kopecksPerStar,
+	}
+}
+
+func (p *StarsProvider) Name() string {
+	return models.PaymentProviderStars
+}
+
+func (p *StarsProvider) Title() string {
+	return "⭐ Telegram Stars"
+}
+
+// NeedsReceiptContact is false: Telegram issues the receipt for Stars
+func (p *StarsProvider) NeedsReceiptContact() bool {
+	return false
+}
+
+func (p *StarsProvider) CreateTopUp(ctx context.Context, user *models.User, amount int64) (string, error) {
+	stars := starsForAmount(amount, p.KopecksPerStar)
+
+	invoice := tu.Invoice(
+		tu.ID(user.TelegramID),
+		"Пополнение баланса",
+		fmt.Sprintf("Пополнение баланса VPN на %s₽", utils.FormatRub(amount)),
+		starsPayload(user.TelegramID, amount),
+		"", // Stars invoices need no provider token
+		starsCurrency,
+		tu.LabeledPrice(fmt.Sprintf("%s₽", utils.FormatRub(amount)), int(stars)),
+	)
+
+	if _, err := p.Bot.SendInvoice(ctx, invoice); err != nil {
+		return "", fmt.Errorf("failed to send stars invoice: %w", err)
+	}
+	return "", nil
+}
+
+// starsForAmount converts kopecks to stars, rounding up
+func starsForAmount(amount, kopecksPerStar int64) int64 {
+	if kopecksPerStar <= 0 {
+		kopecksPerStar = 1
+	}
+	return (amount + kopecksPerStar - 1) / kopecksPerStar
+}
+
+func starsPayload(telegramID int64, amount int64) string {
+	return fmt.Sprintf("topup:%d:%d", telegramID, amount)
+}
+
+// parseStarsInvoice checks that the payload was issued for this user and
+// that the paid amount matches it. It returns the amount to credit in kopecks.
+func (h *Handler) parseStarsInvoice(telegramID int64, currency string, totalAmount int, payload string) (int64, error) {
+	if currency != starsCurrency {
+		return 0, fmt.Errorf("%w: currency %s", ErrInvalidInvoice, currency)
+	}
+
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 || parts[0] != "topup" {
+		return 0, fmt.Errorf("%w: payload %q", ErrInvalidInvoice, payload)
+	}
+
+	payloadTelegramID, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || payloadTelegramID != telegramID {
+		return 0, fmt.Errorf("%w: payload issued for another user", ErrInvalidInvoice)
+	}
+
+	amount, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || amount <= 0 {
+		return 0, fmt.Errorf("%w: payload amount %q", ErrInvalidInvoice, parts[2])
+	}
+
+	if int64(totalAmount) != starsForAmount(amount, h.Config.StarsKopecksPerStar) {
+		return 0, fmt.Errorf("%w: paid %d stars for %s₽", ErrInvalidInvoice, totalAmount, utils.FormatRub(amount))
+	}
+
+	return amount, nil
+}
+
+// ValidateStarsCheckout answers whether a pre_checkout_query may proceed
+func (h *Handler) ValidateStarsCheckout(query *telego.PreCheckoutQuery) error {
+	_, err := h.parseStarsInvoice(query.From.ID, query.Currency, query.TotalAmount, query.InvoicePayload)
+	return err
+}
+
+// ProcessStarsPayment credits a successful_payment. Telegram may deliver the
+// same update more than once, so it is keyed by the charge ID like YooKassa
+// payments are keyed by their payment ID.
+func (h *Handler) ProcessStarsPayment(ctx context.Context, telegramID int64, sp *telego.SuccessfulPayment) error {
+	amount, err := h.parseStarsInvoice(telegramID, sp.Currency, sp.TotalAmount, sp.InvoicePayload)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Processing stars payment %s: %d XTR for %s₽", sp.TelegramPaymentChargeID, sp.TotalAmount, utils.FormatRub(amount))
+
+	var messages []*telego.SendMessageParams
+
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.FirstOrCreate(&user, models.User{TelegramID: telegramID}).Error; err != nil {
+			return fmt.Errorf("failed to find/create user: %w", err)
+		}
+
+		claimed, err := claimPayment(tx, &models.Payment{
+			UserID:   user.ID,
+			Amount:   amount,
+			Status:   models.PaymentStatusSucceeded,
+			Type:     "balance_topup",
+			Provider: models.PaymentProviderStars,
+			ChargeID: sp.TelegramPaymentChargeID,
+		})
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			log.Printf("Stars payment %s already processed, skipping", sp.TelegramPaymentChargeID)
+			return nil
+		}
+
+		messages, err = h.applyTopUp(tx, &user, sp.TelegramPaymentChargeID, amount)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		_, _ = h.Bot.SendMessage(ctx, msg)
+	}
+
+	return nil
+}
@@ -2,10 +2,13 @@ package payment
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,44 +21,142 @@ type Client struct {
 	HTTPClient *http.Client
 }
 
-func NewClient(shopID, secretKey string) *Client {
+func NewClient(shopID, secretKey, apiURL string) *Client {
 	return &Client{
 		ShopID:    shopID,
 		SecretKey: secretKey,
-		APIURL:    "https://api.yookassa.ru/v3",
+		APIURL:    strings.TrimRight(apiURL, "/"),
 		HTTPClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
 	}
 }
 
-func (c *Client) CreatePayment(amount string, currency string, description string, returnURL string, metadata map[string]string) (*PaymentResponse, error) {
+func (c *Client) CreatePayment(ctx context.Context, amount string, currency string, description string, returnURL string, metadata map[string]string, receipt *Receipt, savePaymentMethod bool) (*PaymentResponse, error) {
 	reqBody := CreatePaymentRequest{
 		Amount: Amount{
 			Value:    amount,
 			Currency: currency,
 		},
 		Capture: true,
-		Confirmation: Confirmation{
+		Confirmation: &Confirmation{
 			Type:      "redirect",
 			ReturnURL: returnURL,
 		},
+		Description:       description,
+		Metadata:          metadata,
+		Receipt:           receipt,
+		SavePaymentMethod: savePaymentMethod,
+	}
+
+	return c.createPayment(ctx, reqBody)
+}
+
+// ChargeSavedMethod charges a previously saved payment method without user interaction
+func (c *Client) ChargeSavedMethod(ctx context.Context, paymentMethodID string, amount string, currency string, description string, metadata map[string]string, receipt *Receipt) (*PaymentResponse, error) {
+	reqBody := CreatePaymentRequest{
+		Amount: Amount{
+			Value:    amount,
+			Currency: currency,
+		},
+		Capture:         true,
+		Description:     description,
+		Metadata:        metadata,
+		Receipt:         receipt,
+		PaymentMethodID: paymentMethodID,
+	}
+
+	return c.createPayment(ctx, reqBody)
+}
+
+func (c *Client) createPayment(ctx context.Context, reqBody CreatePaymentRequest) (*PaymentResponse, error) {
+	resp, err := c.doRequest(ctx, "POST", "/payments", reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var paymentResponse PaymentResponse
+	if err := json.Unmarshal(resp, &paymentResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &paymentResponse, nil
+}
+
+// GetPayment fetches the current state of a payment from YooKassa
+func (c *Client) GetPayment(ctx context.Context, paymentID string) (*PaymentResponse, error) {
+	resp, err := c.doRequest(ctx, "GET", fmt.Sprintf("/payments/%s", url.PathEscape(paymentID)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var paymentResponse PaymentResponse
+	if err := json.Unmarshal(resp, &paymentResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &paymentResponse, nil
+}
+
+// CreateRefund refunds the whole or a part of a succeeded payment
+func (c *Client) CreateRefund(ctx context.Context, paymentID string, amount string, currency string, description string, receipt *Receipt) (*RefundResponse, error) {
+	reqBody := CreateRefundRequest{
+		PaymentID: paymentID,
+		Amount: Amount{
+			Value:    amount,
+			Currency: currency,
+		},
 		Description: description,
-		Metadata:    metadata,
+		Receipt:     receipt,
 	}
 
-	jsonBody, err := json.Marshal(reqBody)
+	resp, err := c.doRequest(ctx, "POST", "/refunds", reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/payments", c.APIURL), bytes.NewBuffer(jsonBody))
+	var refundResponse RefundResponse
+	if err := json.Unmarshal(resp, &refundResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &refundResponse, nil
+}
+
+// GetRefund fetches the current state of a refund from YooKassa
+func (c *Client) GetRefund(ctx context.Context, refundID string) (*RefundResponse, error) {
+	resp, err := c.doRequest(ctx, "GET", fmt.Sprintf("/refunds/%s", url.PathEscape(refundID)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var refundResponse RefundResponse
+	if err := json.Unmarshal(resp, &refundResponse); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &refundResponse, nil
+}
+
+func (c *Client) doRequest(ctx context.Context, method, endpoint string, body interface{}) ([]byte, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		jsonBody, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal request: %w", err)
+		}
+		bodyReader = bytes.NewBuffer(jsonBody)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s%s", c.APIURL, endpoint), bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	// Idempotence Key
-	req.Header.Set("Idempotence-Key", uuid.New().String())
+	// Idempotence Key is required for every state-changing request
+	if method == "POST" {
+		req.Header.Set("Idempotence-Key", uuid.New().String())
+	}
 	req.Header.Set("Content-Type", "application/json")
 	req.SetBasicAuth(c.ShopID, c.SecretKey)
 
@@ -74,10 +175,5 @@ func (c *Client) CreatePayment(amount string, currency string, description strin
 		return nil, fmt.Errorf("api error: %s (status: %d)", string(respBody), resp.StatusCode)
 	}
 
-	var paymentResponse PaymentResponse
-	if err := json.Unmarshal(respBody, &paymentResponse); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
-	}
-
-	return &paymentResponse, nil
+	return respBody, nil
 }
@@ -0,0 +1,290 @@
+// Package yookassatest provides an in-process fake of the YooKassa API that
+// can also deliver webhook notifications, for end-to-end payment tests.
+package yookassatest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	"popovka-bot/internal/payment"
+
+	"github.com/google/uuid"
+)
+
+// Credentials the fake accepts
+const (
+	ShopID    = "test-shop"
+	SecretKey = "test-secret"
+)
+
+// SourceIP is an address from YooKassa's published webhook range. Webhooks
+// are sent as if forwarded by a local reverse proxy from this address.
+const SourceIP = "185.71.76.10"
+
+// Server keeps payments and refunds in memory. Payments are created as
+// pending and change state only when the test calls Succeed or Cancel.
+type Server struct {
+	*httptest.Server
+
+	// WebhookURL receives notifications; set it before firing any
+	WebhookURL string
+
+	mu          sync.Mutex
+	payments    map[string]*payment.PaymentResponse
+	savePayment map[string]bool
+	refunds     map[string]*payment.RefundResponse
+	idempotence map[string][]byte
+}
+
+// NewServer starts a fake YooKassa API. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		payments:    make(map[string]*payment.PaymentResponse),
+		savePayment: make(map[string]bool),
+		refunds:     make(map[string]*payment.RefundResponse),
+		idempotence: make(map[string][]byte),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /payments", s.createPayment)
+	mux.HandleFunc("GET /payments/{id}", s.getPayment)
+	mux.HandleFunc("POST /refunds", s.createRefund)
+	mux.HandleFunc("GET /refunds/{id}", s.getRefund)
+
+	s.Server = httptest.NewServer(s.authorize(mux))
+	return s
+}
+
+// Client returns a payment client talking to the fake
+func (s *Server) Client() *payment.Client {
+	return payment.NewClient(ShopID, SecretKey, s.URL)
+}
+
+// Payment returns a copy of the payment with the given ID
+func (s *Server) Payment(id string) (payment.PaymentResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[id]
+	if !ok {
+		return payment.PaymentResponse{}, false
+	}
+	return *p, true
+}
+
+// Succeed marks a pending payment as paid, as if the user completed the
+// payment form, and sends payment.succeeded to WebhookURL. It returns the
+// HTTP status of the webhook response.
+func (s *Server) Succeed(id string) (int, error) {
+	s.mu.Lock()
+	p, ok := s.payments[id]
+	if !ok {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("payment %s not found", id)
+	}
+	p.Status = "succeeded"
+	p.Paid = true
+	if p.PaymentMethod == nil {
+		p.PaymentMethod = newCardMethod(s.savePayment[id])
+	}
+	s.mu.Unlock()
+
+	return s.Notify("payment.succeeded", id)
+}
+
+// Cancel marks a pending payment as canceled with the given reason and
+// sends payment.canceled to WebhookURL
+func (s *Server) Cancel(id, reason string) (int, error) {
+	s.mu.Lock()
+	p, ok := s.payments[id]
+	if !ok {
+		s.mu.Unlock()
+		return 0, fmt.Errorf("payment %s not found", id)
+	}
+	p.Status = "canceled"
+	p.CancellationDetails = &payment.CancellationDetails{Party: "payment_network", Reason: reason}
+	s.mu.Unlock()
+
+	return s.Notify("payment.canceled", id)
+}
+
+// Notify delivers a notification about the current state of a payment or
+// refund. Calling it again simulates YooKassa's redelivery.
+func (s *Server) Notify(event, id string) (int, error) {
+	s.mu.Lock()
+	var object interface{}
+	if p, ok := s.payments[id]; ok {
+		object = *p
+	} else if r, ok := s.refunds[id]; ok {
+		object = *r
+	}
+	s.mu.Unlock()
+	if object == nil {
+		return 0, fmt.Errorf("object %s not found", id)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"type":   "notification",
+		"event":  event,
+		"object": object,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", SourceIP)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		shopID, secretKey, ok := r.BasicAuth()
+		if !ok || shopID != ShopID || secretKey != SecretKey {
+			writeError(w, http.StatusUnauthorized, "invalid_credentials", "Authentication failed")
+			return
+		}
+		if r.Method == http.MethodPost && r.Header.Get("Idempotence-Key") == "" {
+			writeError(w, http.StatusBadRequest, "invalid_request", "Idempotence key is missing")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) createPayment(w http.ResponseWriter, r *http.Request) {
+	var req payment.CreatePaymentRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Same key, same answer
+	key := r.Header.Get("Idempotence-Key")
+	if cached, ok := s.idempotence[key]; ok {
+		writeRaw(w, cached)
+		return
+	}
+
+	p := &payment.PaymentResponse{
+		ID:          uuid.New().String(),
+		Status:      "pending",
+		Amount:      req.Amount,
+		Description: req.Description,
+		Metadata:    req.Metadata,
+	}
+
+	if req.PaymentMethodID != "" {
+		// Charges of a saved method need no confirmation
+		p.Status = "succeeded"
+		p.Paid = true
+		p.PaymentMethod = &payment.PaymentMethod{Type: "bank_card", ID: req.PaymentMethodID, Saved: true}
+	} else {
+		p.Confirmation = payment.Confirmation{
+			Type:            "redirect",
+			ConfirmationURL: fmt.Sprintf("%s/checkout/%s", s.URL, p.ID),
+		}
+		s.savePayment[p.ID] = req.SavePaymentMethod
+	}
+	s.payments[p.ID] = p
+
+	body, _ := json.Marshal(p)
+	s.idempotence[key] = body
+	writeRaw(w, body)
+}
+
+func (s *Server) getPayment(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Payment not found")
+		return
+	}
+	body, _ := json.Marshal(p)
+	writeRaw(w, body)
+}
+
+func (s *Server) createRefund(w http.ResponseWriter, r *http.Request) {
+	var req payment.CreateRefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.payments[req.PaymentID]
+	if !ok || p.Status != "succeeded" {
+		writeError(w, http.StatusBadRequest, "invalid_request", "Payment is not refundable")
+		return
+	}
+
+	refund := &payment.RefundResponse{
+		ID:          uuid.New().String(),
+		PaymentID:   req.PaymentID,
+		Status:      "succeeded",
+		Amount:      req.Amount,
+		Description: req.Description,
+	}
+	s.refunds[refund.ID] = refund
+
+	body, _ := json.Marshal(refund)
+	writeRaw(w, body)
+}
+
+func (s *Server) getRefund(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	refund, ok := s.refunds[r.PathValue("id")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "not_found", "Refund not found")
+		return
+	}
+	body, _ := json.Marshal(refund)
+	writeRaw(w, body)
+}
+
+func newCardMethod(saved bool) *payment.PaymentMethod {
+	return &payment.PaymentMethod{
+		Type:  "bank_card",
+		ID:    uuid.New().String(),
+		Saved: saved,
+		Card:  &payment.Card{Last4: "4444", CardType: "MasterCard"},
+	}
+}
+
+func writeRaw(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"type":        "error",
+		"code":        code,
+		"description": description,
+	})
+}
@@ -0,0 +1,209 @@
+// Package promo validates promo codes and applies them to purchases and
+// top-ups. A code entered by the user is attached to them and redeemed by
+// the first purchase or top-up it applies to.
+package promo
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/utils"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrNotFound    = errors.New("promo code not found")
+	ErrNotStarted  = errors.New("promo code is not valid yet")
+	ErrExpired     = errors.New("promo code has expired")
+	ErrExhausted   = errors.New("promo code has no uses left")
+	ErrAlreadyUsed = errors.New("promo code already used by this user")
+	ErrChanged     = errors.New("promo code no longer applies as quoted")
+)
+
+// Normalize returns the stored form of a code
+func Normalize(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// Validate checks the code can be redeemed by the user right now
+func Validate(db *gorm.DB, code *models.PromoCode, userID uint) error {
+	now := time.Now()
+	switch {
+	case !code.IsActive:
+		return ErrNotFound
+	case code.ValidFrom != nil && now.Before(*code.ValidFrom):
+		return ErrNotStarted
+	case code.ValidUntil != nil && now.After(*code.ValidUntil):
+		return ErrExpired
+	case code.MaxUses > 0 && code.Uses >= code.MaxUses:
+		return ErrExhausted
+	}
+
+	if code.MaxUsesPerUser > 0 {
+		var used int64
+		if err := db.Model(&models.PromoRedemption{}).Where("promo_code_id = ? AND user_id = ?", code.ID, userID).Count(&used).Error; err != nil {
+			return fmt.Errorf("failed to count redemptions: %w", err)
+		}
+		if used >= int64(code.MaxUsesPerUser) {
+			return ErrAlreadyUsed
+		}
+	}
+	return nil
+}
+
+// Activate attaches a valid code to the user, replacing any code entered
+// before
+func Activate(db *gorm.DB, user *models.User, input string) (*models.PromoCode, error) {
+	var code models.PromoCode
+	err := db.Where("code = ?", Normalize(input)).First(&code).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load promo code: %w", err)
+	}
+
+	if err := Validate(db, &code, user.ID); err != nil {
+		return nil, err
+	}
+
+	if err := db.Model(user).Update("promo_code_id", code.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to attach promo code: %w", err)
+	}
+	user.PromoCodeID = &code.ID
+	return &code, nil
+}
+
+// Pending returns the code the user has entered if it can still be
+// redeemed, or nil. A code that became invalid is detached.
+func Pending(db *gorm.DB, userID uint) (*models.PromoCode, error) {
+	var user models.User
+	if err := db.Select("id", "promo_code_id").First(&user, userID).Error; err != nil {
+		return nil, fmt.Errorf("failed to load user %d: %w", userID, err)
+	}
+	if user.PromoCodeID == nil {
+		return nil, nil
+	}
+
+	var code models.PromoCode
+	err := db.First(&code, *user.PromoCodeID).Error
+	if err == nil {
+		err = Validate(db, &code, userID)
+	}
+	if err == nil {
+		return &code, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) && !IsInvalid(err) {
+		return nil, err
+	}
+
+	if err := db.Model(&user).Update("promo_code_id", nil).Error; err != nil {
+		return nil, fmt.Errorf("failed to detach promo code: %w", err)
+	}
+	return nil, nil
+}
+
+// IsInvalid reports whether err means the code can't be used (as opposed to
+// a database failure)
+func IsInvalid(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, ErrNotStarted) || errors.Is(err, ErrExpired) ||
+		errors.Is(err, ErrExhausted) || errors.Is(err, ErrAlreadyUsed) || errors.Is(err, ErrChanged)
+}
+
+// Quote is the price of a plan for a user with their pending promo code
+type Quote struct {
+	Price     int64 // Kopecks to charge
+	Discount  int64 // Kopecks off the plan price
+	BonusDays int
+	Code      *models.PromoCode // Nil if no code applies
+}
+
+// QuotePlan prices the plan with the user's pending code if it applies
+func QuotePlan(db *gorm.DB, userID uint, plan *models.Plan) (Quote, error) {
+	code, err := Pending(db, userID)
+	if err != nil {
+		return Quote{Price: plan.Price}, err
+	}
+	return Apply(code, plan), nil
+}
+
+// Same reports whether both quotes charge the same price with the same code.
+// Codes don't change once created, so the code also fixes the bonus days.
+func (q Quote) Same(other Quote) bool {
+	if q.Price != other.Price {
+		return false
+	}
+	if q.Code == nil || other.Code == nil {
+		return q.Code == other.Code
+	}
+	return q.Code.ID == other.Code.ID
+}
+
+// Apply prices the plan with code, which may be nil
+func Apply(code *models.PromoCode, plan *models.Plan) Quote {
+	quote := Quote{Price: plan.Price}
+	if code == nil || !code.AppliesToPlan(plan.ID) {
+		return quote
+	}
+
+	switch code.Type {
+	case models.PromoTypePercent:
+		quote.Discount = plan.Price * min(code.Value, 100) / 100
+		quote.Price = plan.Price - quote.Discount
+	case models.PromoTypeDays:
+		quote.BonusDays = int(code.Value)
+	default:
+		return quote // Credit codes apply to top-ups
+	}
+	quote.Code = code
+	return quote
+}
+
+// Redeem records a use of the code by the user and detaches it. It must run
+// in the transaction of the purchase or top-up; it fails with ErrExhausted
+// if a concurrent redemption took the last use.
+func Redeem(tx *gorm.DB, code *models.PromoCode, userID uint, planID *uint, amount int64, days int) error {
+	// Lock the code so per-user and global limits hold under concurrency
+	var locked models.PromoCode
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, code.ID).Error; err != nil {
+		return fmt.Errorf("failed to lock promo code %d: %w", code.ID, err)
+	}
+	if err := Validate(tx, &locked, userID); err != nil {
+		return err
+	}
+
+	if err := tx.Model(&locked).Update("uses", gorm.Expr("uses + 1")).Error; err != nil {
+		return fmt.Errorf("failed to count promo code use: %w", err)
+	}
+	if err := tx.Create(&models.PromoRedemption{
+		PromoCodeID: code.ID,
+		UserID:      userID,
+		PlanID:      planID,
+		Amount:      amount,
+		Days:        days,
+	}).Error; err != nil {
+		return fmt.Errorf("failed to record redemption: %w", err)
+	}
+	if err := tx.Model(&models.User{}).Where("id = ?", userID).Update("promo_code_id", nil).Error; err != nil {
+		return fmt.Errorf("failed to detach promo code: %w", err)
+	}
+	return nil
+}
+
+// Describe returns what the code gives, for users
+func Describe(code *models.PromoCode) string {
+	switch code.Type {
+	case models.PromoTypePercent:
+		return fmt.Sprintf("скидка %d%% на покупку тарифа", code.Value)
+	case models.PromoTypeDays:
+		return fmt.Sprintf("+%d дн. к покупке тарифа", code.Value)
+	case models.PromoTypeCredit:
+		return fmt.Sprintf("+%s₽ к следующему пополнению баланса", utils.FormatRub(code.Value))
+	}
+	return code.Type
+}
@@ -0,0 +1,132 @@
+package promo_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/testutil"
+
+	"gorm.io/gorm"
+)
+
+func newUser(t *testing.T, db *gorm.DB, telegramID int64) *models.User {
+	t.Helper()
+
+	user := models.User{TelegramID: telegramID, ReferralCode: fmt.Sprintf("ref_%d", telegramID)}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return &user
+}
+
+func newCode(t *testing.T, db *gorm.DB, code models.PromoCode) *models.PromoCode {
+	t.Helper()
+
+	code.IsActive = true
+	if err := db.Create(&code).Error; err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	return &code
+}
+
+func TestActivateChecksValidity(t *testing.T) {
+	db := testutil.DB(t)
+	user := newUser(t, db, 1)
+
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	newCode(t, db, models.PromoCode{Code: "OLD", Type: models.PromoTypeDays, Value: 3, ValidUntil: &past})
+	newCode(t, db, models.PromoCode{Code: "SOON", Type: models.PromoTypeDays, Value: 3, ValidFrom: &future})
+	newCode(t, db, models.PromoCode{Code: "GONE", Type: models.PromoTypeDays, Value: 3, MaxUses: 2, Uses: 2})
+	off := newCode(t, db, models.PromoCode{Code: "OFF", Type: models.PromoTypeDays, Value: 3})
+	db.Model(off).Update("is_active", false)
+
+	tests := []struct {
+		input string
+		want  error
+	}{
+		{"missing", promo.ErrNotFound},
+		{"old", promo.ErrExpired},
+		{"soon", promo.ErrNotStarted},
+		{"gone", promo.ErrExhausted},
+		{"off", promo.ErrNotFound},
+	}
+	for _, tt := range tests {
+		if _, err := promo.Activate(db, user, tt.input); !errors.Is(err, tt.want) {
+			t.Errorf("Activate(%q) error = %v, want %v", tt.input, err, tt.want)
+		}
+	}
+	if user.PromoCodeID != nil {
+		t.Errorf("invalid code was attached to the user")
+	}
+}
+
+func TestRedeemLimits(t *testing.T) {
+	db := testutil.DB(t)
+	first := newUser(t, db, 1)
+	second := newUser(t, db, 2)
+	third := newUser(t, db, 3)
+
+	code := newCode(t, db, models.PromoCode{Code: "TWICE", Type: models.PromoTypeCredit, Value: 1000, MaxUses: 2, MaxUsesPerUser: 1})
+
+	for _, user := range []*models.User{first, second} {
+		if _, err := promo.Activate(db, user, " twice "); err != nil {
+			t.Fatalf("Activate for user %d: %v", user.ID, err)
+		}
+	}
+	// Entered by three users while two uses are left
+	if _, err := promo.Activate(db, third, "TWICE"); err != nil {
+		t.Fatalf("Activate for user %d: %v", third.ID, err)
+	}
+
+	if err := promo.Redeem(db, code, first.ID, nil, 1000, 0); err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+	if err := promo.Redeem(db, code, first.ID, nil, 1000, 0); !errors.Is(err, promo.ErrAlreadyUsed) {
+		t.Errorf("second Redeem by the same user error = %v, want ErrAlreadyUsed", err)
+	}
+	if err := promo.Redeem(db, code, second.ID, nil, 1000, 0); err != nil {
+		t.Fatalf("Redeem: %v", err)
+	}
+
+	// The third user's code became invalid and is detached
+	pending, err := promo.Pending(db, third.ID)
+	if err != nil || pending != nil {
+		t.Errorf("Pending = %v, %v; want nil", pending, err)
+	}
+	if err := promo.Redeem(db, code, third.ID, nil, 1000, 0); !errors.Is(err, promo.ErrExhausted) {
+		t.Errorf("Redeem over the limit error = %v, want ErrExhausted", err)
+	}
+
+	var redemptions int64
+	db.Model(&models.PromoRedemption{}).Count(&redemptions)
+	if redemptions != 2 {
+		t.Errorf("%d redemptions recorded, want 2", redemptions)
+	}
+}
+
+func TestApply(t *testing.T) {
+	plan := &models.Plan{ID: 2, Price: 30000}
+
+	percent := &models.PromoCode{Type: models.PromoTypePercent, Value: 20}
+	if q := promo.Apply(percent, plan); q.Price != 24000 || q.Discount != 6000 || q.Code != percent {
+		t.Errorf("percent quote = %+v, want price 24000", q)
+	}
+
+	days := &models.PromoCode{Type: models.PromoTypeDays, Value: 5, PlanIDs: "1, 2"}
+	if q := promo.Apply(days, plan); q.Price != 30000 || q.BonusDays != 5 || q.Code != days {
+		t.Errorf("days quote = %+v, want 5 bonus days", q)
+	}
+
+	otherPlan := &models.PromoCode{Type: models.PromoTypePercent, Value: 20, PlanIDs: "3"}
+	credit := &models.PromoCode{Type: models.PromoTypeCredit, Value: 5000}
+	for _, code := range []*models.PromoCode{otherPlan, credit, nil} {
+		if q := promo.Apply(code, plan); q.Price != 30000 || q.Code != nil {
+			t.Errorf("quote with %+v = %+v, want full price", code, q)
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package remnawave
+
+import (
+	"context"
+	"time"
+)
+
+// API is the part of the Remnawave panel the bot relies on. *Client
+// implements it against a real panel; tests point a Client at the fake
+// panel from the remnawavetest package.
+type API interface {
+	CreateUser(ctx context.Context, telegramID int64, username string, durationDays int, squadIDs []string, trafficLimitBytes int64, deviceLimit int) (*UserResponse, error)
+	ExtendSubscription(ctx context.Context, remnawaveID string, durationDays int) error
+	SetExpiration(ctx context.Context, remnawaveID string, expireAt time.Time) error
+	SetTrafficLimit(ctx context.Context, remnawaveID string, trafficLimitBytes int64) error
+	SetDeviceLimit(ctx context.Context, remnawaveID string, deviceLimit int) error
+	SetSquads(ctx context.Context, remnawaveID string, squadIDs []string) error
+	DeleteUser(ctx context.Context, remnawaveID string) error
+	DisableUser(ctx context.Context, remnawaveID string) error
+	EnableUser(ctx context.Context, remnawaveID string) error
+	GetUser(ctx context.Context, remnawaveID string) (*UserResponse, error)
+	GetUserByUsername(ctx context.Context, username string) (*UserResponse, error)
+	GetDevices(ctx context.Context, remnawaveID string) ([]Device, error)
+	DeleteDevice(ctx context.Context, remnawaveID, hwid string) error
+	// Available is false while the panel is known to be down
+	Available() bool
+}
+
+var _ API = (*Client)(nil)
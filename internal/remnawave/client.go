@@ -2,10 +2,14 @@ package remnawave
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -13,6 +17,13 @@ type Client struct {
 	BaseURL    string
 	APIKey     string
 	HTTPClient *http.Client
+
+	// Idempotent calls failing with a transient error are retried with
+	// jittered exponential backoff starting at RetryBaseDelay
+	MaxRetries     int
+	RetryBaseDelay time.Duration
+
+	breaker *breaker
 }
 
 func NewClient(baseURL, apiKey string) *Client {
@@ -22,21 +33,106 @@ func NewClient(baseURL, apiKey string) *Client {
 		HTTPClient: &http.Client{
 			Timeout: 10 * time.Second,
 		},
+		MaxRetries:     3,
+		RetryBaseDelay: 300 * time.Millisecond,
+		breaker:        newBreaker(5, 30*time.Second),
 	}
 }
 
-func (c *Client) doRequest(method, endpoint string, body interface{}) ([]byte, error) {
-	var bodyReader io.Reader
+// Available reports whether the panel is considered reachable. It is false
+// while the circuit breaker is open and calls fail with ErrUnavailable.
+func (c *Client) Available() bool {
+	return !c.breaker.open()
+}
+
+func (c *Client) doRequest(ctx context.Context, method, endpoint string, body interface{}) ([]byte, error) {
+	var jsonBody []byte
 	if body != nil {
-		jsonBody, err := json.Marshal(body)
-		if err != nil {
+		var err error
+		if jsonBody, err = json.Marshal(body); err != nil {
 			return nil, fmt.Errorf("failed to marshal request body: %w", err)
 		}
-		bodyReader = bytes.NewBuffer(jsonBody)
+	}
+
+	if !c.breaker.allow() {
+		return nil, ErrUnavailable
+	}
+
+	attempts := 1
+	if isIdempotent(method, endpoint) {
+		attempts += c.MaxRetries
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, c.backoff(attempt)); err != nil {
+				c.breaker.abort()
+				return nil, err
+			}
+		}
+
+		var respBody []byte
+		respBody, err = c.send(ctx, method, endpoint, jsonBody)
+		if err == nil {
+			c.breaker.success()
+			return respBody, nil
+		}
+		if ctx.Err() != nil {
+			// Our own deadline or shutdown says nothing about the panel
+			c.breaker.abort()
+			return nil, err
+		}
+		if !IsTransient(err) {
+			// The panel answered, so it is up even if the request was wrong
+			c.breaker.success()
+			return nil, err
+		}
+	}
+
+	c.breaker.failure()
+	return nil, err
+}
+
+// isIdempotent reports whether repeating the request cannot apply it twice.
+// Only user creation is not: a retry after a lost response would create a
+// conflicting user.
+func isIdempotent(method, endpoint string) bool {
+	return method != http.MethodPost || strings.Contains(endpoint, "/actions/") || strings.HasSuffix(endpoint, "/extend") ||
+		strings.HasSuffix(endpoint, "/devices/delete")
+}
+
+// backoff returns the delay before the given retry: exponential with
+// "equal jitter", so replicas retrying together spread out
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.RetryBaseDelay << (attempt - 1)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// send performs a single HTTP request
+func (c *Client) send(ctx context.Context, method, endpoint string, jsonBody []byte) ([]byte, error) {
+	var bodyReader io.Reader
+	if jsonBody != nil {
+		bodyReader = bytes.NewReader(jsonBody)
 	}
 
 	url := fmt.Sprintf("%s%s", c.BaseURL, endpoint)
-	req, err := http.NewRequest(method, url, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
@@ -56,32 +152,42 @@ func (c *Client) doRequest(method, endpoint string, body interface{}) ([]byte, e
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, fmt.Errorf("api error: %s (status: %d)", string(respBody), resp.StatusCode)
+		return nil, newAPIError(resp.StatusCode, respBody)
 	}
 
 	return respBody, nil
 }
 
-func (c *Client) CreateUser(telegramID int64, username string, durationDays int, squadID string) (*UserResponse, error) {
+// Username is the panel username of a Telegram user
+func Username(telegramID int64) string {
+	return fmt.Sprintf("tg_%d", telegramID)
+}
+
+// CreateUser creates an active user. deviceLimit caps the HWIDs that may
+// connect; 0 leaves the panel default.
+func (c *Client) CreateUser(ctx context.Context, telegramID int64, username string, durationDays int, squadIDs []string, trafficLimitBytes int64, deviceLimit int) (*UserResponse, error) {
 	// Calculate expiration date
 	expireAt := time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
 
 	squads := []string{}
-	if squadID != "" {
-		squads = append(squads, squadID)
+	for _, squadID := range squadIDs {
+		if squadID != "" {
+			squads = append(squads, squadID)
+		}
 	}
 
 	reqBody := CreateUserRequest{
-		Username:             fmt.Sprintf("tg_%d", telegramID),
-		Status:               "ACTIVE",
-		TrafficLimitBytes:    0,
+		Username:             Username(telegramID),
+		Status:               UserStatusActive,
+		TrafficLimitBytes:    trafficLimitBytes,
 		TrafficLimitStrategy: "NO_RESET",
 		ExpireAt:             expireAt.Format(time.RFC3339),
 		Description:          fmt.Sprintf("Telegram User: %s (ID: %d)", username, telegramID),
 		ActiveInternalSquads: squads,
+		HwidDeviceLimit:      deviceLimit,
 	}
 
-	resp, err := c.doRequest("POST", "/api/users/", reqBody)
+	resp, err := c.doRequest(ctx, "POST", "/api/users/", reqBody)
 	if err != nil {
 		return nil, err
 	}
@@ -91,13 +197,10 @@ func (c *Client) CreateUser(telegramID int64, username string, durationDays int,
 		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
 	}
 
-	// Debug logging
-	fmt.Printf("DEBUG Remnawave CreateUser response: UUID='%s', Username='%s', Status='%s'\n", apiResp.Response.UUID, apiResp.Response.Username, apiResp.Response.Status)
-
 	return &apiResp.Response, nil
 }
 
-func (c *Client) ExtendSubscription(remnawaveID string, durationDays int) error {
+func (c *Client) ExtendSubscription(ctx context.Context, remnawaveID string, durationDays int) error {
 	// Calculate new expiration date
 	expireAt := time.Now().Add(time.Duration(durationDays) * 24 * time.Hour)
 
@@ -105,22 +208,112 @@ func (c *Client) ExtendSubscription(remnawaveID string, durationDays int) error
 		ExpireAt: expireAt.Format(time.RFC3339),
 	}
 
-	_, err := c.doRequest("POST", fmt.Sprintf("/api/users/%s/extend", remnawaveID), reqBody)
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/api/users/%s/extend", remnawaveID), reqBody)
 	return err
 }
 
-func (c *Client) DeleteUser(remnawaveID string) error {
-	_, err := c.doRequest("DELETE", fmt.Sprintf("/users/%s", remnawaveID), nil)
+// SetExpiration moves the user's expiration date to an exact point in time
+func (c *Client) SetExpiration(ctx context.Context, remnawaveID string, expireAt time.Time) error {
+	reqBody := UpdateUserRequest{
+		UUID:     remnawaveID,
+		ExpireAt: expireAt.UTC().Format(time.RFC3339),
+	}
+
+	_, err := c.doRequest(ctx, "PATCH", "/api/users", reqBody)
 	return err
 }
 
-func (c *Client) DisableUser(remnawaveID string) error {
-	_, err := c.doRequest("POST", fmt.Sprintf("/users/%s/actions/disable", remnawaveID), nil)
+// SetTrafficLimit changes the user's traffic limit; 0 means unlimited
+func (c *Client) SetTrafficLimit(ctx context.Context, remnawaveID string, trafficLimitBytes int64) error {
+	reqBody := UpdateUserRequest{
+		UUID:              remnawaveID,
+		TrafficLimitBytes: &trafficLimitBytes,
+	}
+
+	_, err := c.doRequest(ctx, "PATCH", "/api/users", reqBody)
 	return err
 }
 
-func (c *Client) GetUser(remnawaveID string) (*UserResponse, error) {
-	resp, err := c.doRequest("GET", fmt.Sprintf("/api/users/%s", remnawaveID), nil)
+// SetDeviceLimit changes how many devices (HWIDs) may use the user's link
+func (c *Client) SetDeviceLimit(ctx context.Context, remnawaveID string, deviceLimit int) error {
+	reqBody := UpdateUserRequest{
+		UUID:            remnawaveID,
+		HwidDeviceLimit: &deviceLimit,
+	}
+
+	_, err := c.doRequest(ctx, "PATCH", "/api/users", reqBody)
+	return err
+}
+
+// SetSquads replaces the internal squads the user has access to
+func (c *Client) SetSquads(ctx context.Context, remnawaveID string, squadIDs []string) error {
+	reqBody := UpdateUserRequest{
+		UUID:                 remnawaveID,
+		ActiveInternalSquads: squadIDs,
+	}
+
+	_, err := c.doRequest(ctx, "PATCH", "/api/users", reqBody)
+	return err
+}
+
+// GetDevices lists the devices that have connected with the user's link
+func (c *Client) GetDevices(ctx context.Context, remnawaveID string) ([]Device, error) {
+	resp, err := c.doRequest(ctx, "GET", fmt.Sprintf("/api/hwid/devices/%s", remnawaveID), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiResp DevicesResponse
+	if err := json.Unmarshal(resp, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return apiResp.Response.Devices, nil
+}
+
+// DeleteDevice removes a device from the user, freeing its slot
+func (c *Client) DeleteDevice(ctx context.Context, remnawaveID, hwid string) error {
+	reqBody := DeleteDeviceRequest{
+		UserUUID: remnawaveID,
+		HWID:     hwid,
+	}
+
+	_, err := c.doRequest(ctx, "POST", "/api/hwid/devices/delete", reqBody)
+	return err
+}
+
+func (c *Client) DeleteUser(ctx context.Context, remnawaveID string) error {
+	_, err := c.doRequest(ctx, "DELETE", fmt.Sprintf("/api/users/%s", remnawaveID), nil)
+	return err
+}
+
+func (c *Client) DisableUser(ctx context.Context, remnawaveID string) error {
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/api/users/%s/actions/disable", remnawaveID), nil)
+	return err
+}
+
+// EnableUser re-activates a user disabled by DisableUser
+func (c *Client) EnableUser(ctx context.Context, remnawaveID string) error {
+	_, err := c.doRequest(ctx, "POST", fmt.Sprintf("/api/users/%s/actions/enable", remnawaveID), nil)
+	return err
+}
+
+// GetUserByUsername looks a user up by the username set on creation
+func (c *Client) GetUserByUsername(ctx context.Context, username string) (*UserResponse, error) {
+	resp, err := c.doRequest(ctx, "GET", fmt.Sprintf("/api/users/by-username/%s", url.PathEscape(username)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiResp APIResponse
+	if err := json.Unmarshal(resp, &apiResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+
+	return &apiResp.Response, nil
+}
+
+func (c *Client) GetUser(ctx context.Context, remnawaveID string) (*UserResponse, error) {
+	resp, err := c.doRequest(ctx, "GET", fmt.Sprintf("/api/users/%s", remnawaveID), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,143 @@
+package remnawave_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/remnawave/remnawavetest"
+)
+
+func newPanel(t *testing.T) (*remnawavetest.Server, *remnawave.Client) {
+	t.Helper()
+
+	panel := remnawavetest.NewServer()
+	t.Cleanup(panel.Close)
+
+	client := panel.Client()
+	client.RetryBaseDelay = time.Millisecond
+	return panel, client
+}
+
+func TestTypedErrors(t *testing.T) {
+	panel, client := newPanel(t)
+	ctx := context.Background()
+
+	_, err := client.GetUser(ctx, "00000000-0000-0000-0000-000000000000")
+	if !errors.Is(err, remnawave.ErrNotFound) {
+		t.Errorf("GetUser of unknown user: %v, want ErrNotFound", err)
+	}
+	if remnawave.IsTransient(err) {
+		t.Errorf("not found reported as transient")
+	}
+
+	if _, err := client.CreateUser(ctx, 1, "user", 30, nil, 0, 0); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := client.CreateUser(ctx, 1, "user", 30, nil, 0, 0); !errors.Is(err, remnawave.ErrConflict) {
+		t.Errorf("second CreateUser: %v, want ErrConflict", err)
+	}
+
+	wrongKey := remnawave.NewClient(panel.URL, "wrong")
+	if _, err := wrongKey.GetUser(ctx, "x"); !errors.Is(err, remnawave.ErrUnauthorized) {
+		t.Errorf("GetUser with a wrong key: %v, want ErrUnauthorized", err)
+	}
+}
+
+func TestIdempotentCallsAreRetried(t *testing.T) {
+	panel, client := newPanel(t)
+	ctx := context.Background()
+
+	created, err := client.CreateUser(ctx, 2, "user", 30, nil, 0, 0)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+
+	panel.Fail(2, http.StatusBadGateway)
+	before := panel.Requests()
+	if _, err := client.GetUser(ctx, created.UUID); err != nil {
+		t.Fatalf("GetUser after two 502s: %v", err)
+	}
+	if n := panel.Requests() - before; n != 3 {
+		t.Errorf("GetUser made %d requests, want 3", n)
+	}
+}
+
+func TestCreateUserIsNotRetried(t *testing.T) {
+	panel, client := newPanel(t)
+
+	panel.Fail(1, http.StatusServiceUnavailable)
+	before := panel.Requests()
+	_, err := client.CreateUser(context.Background(), 3, "user", 30, nil, 0, 0)
+	if !remnawave.IsTransient(err) {
+		t.Errorf("CreateUser on 503: %v, want a transient error", err)
+	}
+	if n := panel.Requests() - before; n != 1 {
+		t.Errorf("CreateUser made %d requests, want 1", n)
+	}
+}
+
+func TestCircuitBreakerOpens(t *testing.T) {
+	panel, client := newPanel(t)
+	client.MaxRetries = 0
+	ctx := context.Background()
+
+	panel.Fail(100, http.StatusInternalServerError)
+	for i := 0; i < 5; i++ {
+		if _, err := client.GetUser(ctx, "x"); !remnawave.IsTransient(err) {
+			t.Fatalf("call %d: %v, want a transient error", i, err)
+		}
+	}
+
+	if client.Available() {
+		t.Error("panel reported available after 5 failed calls")
+	}
+	before := panel.Requests()
+	if _, err := client.GetUser(ctx, "x"); !errors.Is(err, remnawave.ErrUnavailable) {
+		t.Errorf("call with the breaker open: %v, want ErrUnavailable", err)
+	}
+	if panel.Requests() != before {
+		t.Error("request reached the panel while the breaker was open")
+	}
+}
+
+func TestDevices(t *testing.T) {
+	panel, client := newPanel(t)
+	ctx := context.Background()
+
+	user, err := client.CreateUser(ctx, 4, "user", 30, nil, 0, 2)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if user.HwidDeviceLimit == nil || *user.HwidDeviceLimit != 2 {
+		t.Errorf("device limit = %v, want 2", user.HwidDeviceLimit)
+	}
+
+	panel.AddDevice(user.UUID, remnawave.Device{HWID: "hwid-1", Platform: "iOS"})
+	panel.AddDevice(user.UUID, remnawave.Device{HWID: "hwid-2", Platform: "Windows"})
+
+	devices, err := client.GetDevices(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("GetDevices: %v", err)
+	}
+	if len(devices) != 2 || devices[0].HWID != "hwid-1" || devices[1].Platform != "Windows" {
+		t.Errorf("devices = %+v, want hwid-1 and hwid-2", devices)
+	}
+
+	if err := client.DeleteDevice(ctx, user.UUID, "hwid-1"); err != nil {
+		t.Fatalf("DeleteDevice: %v", err)
+	}
+	if devices := panel.Devices(user.UUID); len(devices) != 1 || devices[0].HWID != "hwid-2" {
+		t.Errorf("devices after delete = %+v, want hwid-2", devices)
+	}
+
+	if err := client.SetDeviceLimit(ctx, user.UUID, 5); err != nil {
+		t.Fatalf("SetDeviceLimit: %v", err)
+	}
+	if rwUser, _ := panel.User(user.UUID); rwUser.HwidDeviceLimit == nil || *rwUser.HwidDeviceLimit != 5 {
+		t.Errorf("device limit = %v, want 5", rwUser.HwidDeviceLimit)
+	}
+}
@@ -0,0 +1,79 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Sentinel errors callers can match with errors.Is
+var (
+	ErrNotFound     = errors.New("remnawave: not found")
+	ErrConflict     = errors.New("remnawave: conflict")
+	ErrUnauthorized = errors.New("remnawave: unauthorized")
+	// ErrUnavailable is returned without calling the panel while the circuit
+	// breaker is open after repeated failures
+	ErrUnavailable = errors.New("remnawave: panel temporarily unavailable")
+)
+
+// APIError is a non-2xx response from the panel
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func newAPIError(statusCode int, body []byte) *APIError {
+	var payload struct {
+		Message string `json:"message"`
+	}
+	message := string(body)
+	if json.Unmarshal(body, &payload) == nil && payload.Message != "" {
+		message = payload.Message
+	}
+	return &APIError{StatusCode: statusCode, Message: message}
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error: %s (status: %d)", e.Message, e.StatusCode)
+}
+
+// Is maps status codes to the sentinel errors
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrConflict:
+		return e.StatusCode == http.StatusConflict
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Transient reports whether the same request may succeed later
+func (e *APIError) Transient() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsTransient reports whether err is a temporary failure (panel down,
+// overloaded or unreachable) rather than a problem with the request itself
+func IsTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, ErrUnavailable) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Transient()
+	}
+
+	// Connection refused, reset, timeouts
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
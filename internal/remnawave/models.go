@@ -1,5 +1,13 @@
 package remnawave
 
+// User statuses reported by the panel
+const (
+	UserStatusActive   = "ACTIVE"
+	UserStatusDisabled = "DISABLED"
+	UserStatusLimited  = "LIMITED"
+	UserStatusExpired  = "EXPIRED"
+)
+
 type CreateUserRequest struct {
 	Username             string   `json:"username"`
 	Status               string   `json:"status"`
@@ -8,6 +16,7 @@ type CreateUserRequest struct {
 	ExpireAt             string   `json:"expireAt"` // ISO 8601 format
 	Description          string   `json:"description,omitempty"`
 	ActiveInternalSquads []string `json:"activeInternalSquads"`
+	HwidDeviceLimit      int      `json:"hwidDeviceLimit,omitempty"` // Omitted to use the panel default
 }
 
 type UserResponse struct {
@@ -22,6 +31,21 @@ type UserResponse struct {
 	Description          string  `json:"description"`
 	SubscriptionURL      string  `json:"subscriptionUrl"`
 	ActiveInternalSquads []Squad `json:"activeInternalSquads"`
+	HwidDeviceLimit      *int    `json:"hwidDeviceLimit"` // Nil means the panel default
+
+	// Usage reported by the nodes
+	UsedTrafficBytes         int64          `json:"usedTrafficBytes"`
+	LifetimeUsedTrafficBytes int64          `json:"lifetimeUsedTrafficBytes"`
+	OnlineAt                 *string        `json:"onlineAt"` // Last time seen connected, ISO 8601; nil if never
+	SubLastOpenedAt          *string        `json:"subLastOpenedAt"`
+	SubLastUserAgent         string         `json:"subLastUserAgent"`
+	LastConnectedNode        *ConnectedNode `json:"lastConnectedNode"`
+}
+
+type ConnectedNode struct {
+	ConnectedAt string `json:"connectedAt"`
+	NodeName    string `json:"nodeName"`
+	CountryCode string `json:"countryCode"`
 }
 
 type Squad struct {
@@ -34,6 +58,39 @@ type APIResponse struct {
 	Response UserResponse `json:"response"`
 }
 
+type UpdateUserRequest struct {
+	UUID              string `json:"uuid"`
+	ExpireAt          string `json:"expireAt,omitempty"` // ISO 8601 format
+	TrafficLimitBytes *int64 `json:"trafficLimitBytes,omitempty"`
+	HwidDeviceLimit   *int   `json:"hwidDeviceLimit,omitempty"`
+
+	ActiveInternalSquads []string `json:"activeInternalSquads,omitempty"`
+}
+
+// Device is a client device (HWID) that has connected with the user's link
+type Device struct {
+	HWID        string `json:"hwid"`
+	UserUUID    string `json:"userUuid"`
+	Platform    string `json:"platform"`
+	OSVersion   string `json:"osVersion"`
+	DeviceModel string `json:"deviceModel"`
+	UserAgent   string `json:"userAgent"`
+	CreatedAt   string `json:"createdAt"`
+	UpdatedAt   string `json:"updatedAt"`
+}
+
+type DevicesResponse struct {
+	Response struct {
+		Total   int      `json:"total"`
+		Devices []Device `json:"devices"`
+	} `json:"response"`
+}
+
+type DeleteDeviceRequest struct {
+	UserUUID string `json:"userUuid"`
+	HWID     string `json:"hwid"`
+}
+
 type ExtendSubscriptionRequest struct {
 	ExpireAt string `json:"expireAt"` // ISO 8601 format
 }
@@ -0,0 +1,359 @@
+// Package remnawavetest provides an in-process fake Remnawave panel for tests.
+package remnawavetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"popovka-bot/internal/remnawave"
+
+	"github.com/google/uuid"
+)
+
+// APIKey is the bearer token the fake panel accepts
+const APIKey = "test-api-key"
+
+// Server is a fake panel keeping users in memory. It implements the user
+// endpoints used by remnawave.Client.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	users      map[string]*remnawave.UserResponse
+	devices    map[string][]remnawave.Device // By user UUID
+	seq        int
+	failures   int
+	failStatus int
+	requests   int
+}
+
+// NewServer starts a fake panel. Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		users:   make(map[string]*remnawave.UserResponse),
+		devices: make(map[string][]remnawave.Device),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/users/{$}", s.createUser)
+	mux.HandleFunc("PATCH /api/users", s.updateUser)
+	mux.HandleFunc("GET /api/users/{uuid}", s.getUser)
+	mux.HandleFunc("GET /api/users/by-username/{username}", s.getUserByUsername)
+	mux.HandleFunc("DELETE /api/users/{uuid}", s.deleteUser)
+	mux.HandleFunc("POST /api/users/{uuid}/extend", s.extendUser)
+	mux.HandleFunc("POST /api/users/{uuid}/actions/{action}", s.userAction)
+	mux.HandleFunc("GET /api/hwid/devices/{uuid}", s.getDevices)
+	mux.HandleFunc("POST /api/hwid/devices/delete", s.deleteDevice)
+
+	s.Server = httptest.NewServer(s.authorize(mux))
+	return s
+}
+
+// Client returns a Remnawave client talking to the fake panel
+func (s *Server) Client() *remnawave.Client {
+	return remnawave.NewClient(s.URL, APIKey)
+}
+
+// User returns a copy of the panel user with the given UUID
+func (s *Server) User(id string) (remnawave.UserResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return remnawave.UserResponse{}, false
+	}
+	return *user, true
+}
+
+// SetUsage sets the traffic used by a user and when they were last online
+func (s *Server) SetUsage(id string, usedTrafficBytes int64, onlineAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[id]; ok {
+		user.UsedTrafficBytes = usedTrafficBytes
+		online := onlineAt.UTC().Format(time.RFC3339)
+		user.OnlineAt = &online
+	}
+}
+
+// AddDevice registers a device connected with the user's link
+func (s *Server) AddDevice(id string, device remnawave.Device) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	device.UserUUID = id
+	s.devices[id] = append(s.devices[id], device)
+}
+
+// Devices returns the devices of a user
+func (s *Server) Devices(id string) []remnawave.Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]remnawave.Device(nil), s.devices[id]...)
+}
+
+// Fail makes the next n requests fail with the given HTTP status
+func (s *Server) Fail(n, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = n
+	s.failStatus = status
+}
+
+// Requests returns the number of requests the panel has received
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Users returns the number of users on the panel
+func (s *Server) Users() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.users)
+}
+
+// authorize checks the API key; it also injects failures set up by Fail
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests++
+		fail := s.failures > 0
+		if fail {
+			s.failures--
+		}
+		status := s.failStatus
+		s.mu.Unlock()
+
+		if fail {
+			writeError(w, status, http.StatusText(status))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+APIKey {
+			writeError(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req remnawave.CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == req.Username {
+			writeError(w, http.StatusConflict, "User username already exists")
+			return
+		}
+	}
+
+	s.seq++
+	id := uuid.New().String()
+	shortUUID := strings.ReplaceAll(id, "-", "")[:16]
+
+	squads := make([]remnawave.Squad, 0, len(req.ActiveInternalSquads))
+	for _, squadID := range req.ActiveInternalSquads {
+		squads = append(squads, remnawave.Squad{UUID: squadID})
+	}
+
+	user := &remnawave.UserResponse{
+		UUID:                 id,
+		ID:                   s.seq,
+		ShortUUID:            shortUUID,
+		Username:             req.Username,
+		Status:               req.Status,
+		TrafficLimitBytes:    req.TrafficLimitBytes,
+		TrafficLimitStrategy: req.TrafficLimitStrategy,
+		ExpireAt:             req.ExpireAt,
+		Description:          req.Description,
+		SubscriptionURL:      fmt.Sprintf("%s/sub/%s", s.URL, shortUUID),
+		ActiveInternalSquads: squads,
+	}
+	if req.HwidDeviceLimit > 0 {
+		limit := req.HwidDeviceLimit
+		user.HwidDeviceLimit = &limit
+	}
+	s.users[id] = user
+
+	writeUser(w, user)
+}
+
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request) {
+	s.withUser(w, r.PathValue("uuid"), func(user *remnawave.UserResponse) {})
+}
+
+func (s *Server) getUserByUsername(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == r.PathValue("username") {
+			writeUser(w, user)
+			return
+		}
+	}
+	writeError(w, http.StatusNotFound, "User not found")
+}
+
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request) {
+	var req remnawave.UpdateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.withUser(w, req.UUID, func(user *remnawave.UserResponse) {
+		if req.ExpireAt != "" {
+			user.ExpireAt = req.ExpireAt
+		}
+		if req.TrafficLimitBytes != nil {
+			user.TrafficLimitBytes = *req.TrafficLimitBytes
+		}
+		if req.HwidDeviceLimit != nil {
+			user.HwidDeviceLimit = req.HwidDeviceLimit
+		}
+		if req.ActiveInternalSquads != nil {
+			user.ActiveInternalSquads = make([]remnawave.Squad, 0, len(req.ActiveInternalSquads))
+			for _, squadID := range req.ActiveInternalSquads {
+				user.ActiveInternalSquads = append(user.ActiveInternalSquads, remnawave.Squad{UUID: squadID})
+			}
+		}
+	})
+}
+
+func (s *Server) extendUser(w http.ResponseWriter, r *http.Request) {
+	var req remnawave.ExtendSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.withUser(w, r.PathValue("uuid"), func(user *remnawave.UserResponse) {
+		user.ExpireAt = req.ExpireAt
+	})
+}
+
+func (s *Server) userAction(w http.ResponseWriter, r *http.Request) {
+	var status string
+	switch r.PathValue("action") {
+	case "enable":
+		status = remnawave.UserStatusActive
+	case "disable":
+		status = remnawave.UserStatusDisabled
+	default:
+		writeError(w, http.StatusNotFound, "Unknown action")
+		return
+	}
+
+	s.withUser(w, r.PathValue("uuid"), func(user *remnawave.UserResponse) {
+		user.Status = status
+	})
+}
+
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("uuid")
+	if _, ok := s.users[id]; !ok {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	delete(s.users, id)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"response": map[string]bool{"isDeleted": true},
+	})
+}
+
+func (s *Server) getDevices(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := r.PathValue("uuid")
+	if _, ok := s.users[id]; !ok {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	var resp remnawave.DevicesResponse
+	resp.Response.Devices = append([]remnawave.Device{}, s.devices[id]...)
+	resp.Response.Total = len(resp.Response.Devices)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) deleteDevice(w http.ResponseWriter, r *http.Request) {
+	var req remnawave.DeleteDeviceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[req.UserUUID]; !ok {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	devices := s.devices[req.UserUUID][:0]
+	for _, device := range s.devices[req.UserUUID] {
+		if device.HWID != req.HWID {
+			devices = append(devices, device)
+		}
+	}
+	s.devices[req.UserUUID] = devices
+
+	var resp remnawave.DevicesResponse
+	resp.Response.Devices = append([]remnawave.Device{}, devices...)
+	resp.Response.Total = len(devices)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// withUser applies update to an existing user and responds with its new state
+func (s *Server) withUser(w http.ResponseWriter, id string, update func(user *remnawave.UserResponse)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		writeError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	update(user)
+	writeUser(w, user)
+}
+
+func writeUser(w http.ResponseWriter, user *remnawave.UserResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(remnawave.APIResponse{Response: *user})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    message,
+		"statusCode": status,
+	})
+}
@@ -0,0 +1,102 @@
+package remnawave
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// OnlineWindow is how recently a user must have been seen to count as online
+const OnlineWindow = 3 * time.Minute
+
+// Usage is the traffic and connection state of a panel user
+type Usage struct {
+	UsedTrafficBytes  int64      `json:"used_traffic_bytes"`
+	TrafficLimitBytes int64      `json:"traffic_limit_bytes"` // 0 means unlimited
+	OnlineAt          *time.Time `json:"online_at"`           // Nil if never connected
+	LastNode          string     `json:"last_node"`
+}
+
+// Usage extracts the usage fields of the user
+func (u *UserResponse) Usage() Usage {
+	usage := Usage{
+		UsedTrafficBytes:  u.UsedTrafficBytes,
+		TrafficLimitBytes: u.TrafficLimitBytes,
+	}
+	if u.OnlineAt != nil {
+		if onlineAt, err := time.Parse(time.RFC3339, *u.OnlineAt); err == nil {
+			usage.OnlineAt = &onlineAt
+		}
+	}
+	if u.LastConnectedNode != nil {
+		usage.LastNode = u.LastConnectedNode.NodeName
+	}
+	return usage
+}
+
+// RemainingBytes returns the traffic left, or -1 if it is unlimited
+func (u Usage) RemainingBytes() int64 {
+	if u.TrafficLimitBytes <= 0 {
+		return -1
+	}
+	return max(u.TrafficLimitBytes-u.UsedTrafficBytes, 0)
+}
+
+// Online reports whether the user was connected within OnlineWindow of now
+func (u Usage) Online(now time.Time) bool {
+	return u.OnlineAt != nil && now.Sub(*u.OnlineAt) < OnlineWindow
+}
+
+// UsageCache keeps users' usage in Redis for a short time, so opening the
+// profile repeatedly doesn't hit the panel every time
+type UsageCache struct {
+	Client API
+	Redis  *redis.Client
+	TTL    time.Duration
+	Prefix string
+}
+
+func NewUsageCache(client API, rdb *redis.Client, ttl time.Duration) *UsageCache {
+	return &UsageCache{
+		Client: client,
+		Redis:  rdb,
+		TTL:    ttl,
+		Prefix: "remnawave:usage",
+	}
+}
+
+func (c *UsageCache) key(remnawaveID string) string {
+	return fmt.Sprintf("%s:%s", c.Prefix, remnawaveID)
+}
+
+// Get returns the cached usage, fetching it from the panel on a miss. A
+// Redis failure falls back to the panel.
+func (c *UsageCache) Get(ctx context.Context, remnawaveID string) (*Usage, error) {
+	data, err := c.Redis.Get(ctx, c.key(remnawaveID)).Bytes()
+	if err == nil {
+		var usage Usage
+		if err := json.Unmarshal(data, &usage); err == nil {
+			return &usage, nil
+		}
+	} else if !errors.Is(err, redis.Nil) {
+		log.Printf("Failed to read usage cache of %s: %v", remnawaveID, err)
+	}
+
+	user, err := c.Client.GetUser(ctx, remnawaveID)
+	if err != nil {
+		return nil, err
+	}
+	usage := user.Usage()
+
+	if data, err := json.Marshal(usage); err == nil {
+		if err := c.Redis.Set(ctx, c.key(remnawaveID), data, c.TTL).Err(); err != nil {
+			log.Printf("Failed to cache usage of %s: %v", remnawaveID, err)
+		}
+	}
+	return &usage, nil
+}
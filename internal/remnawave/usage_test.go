@@ -0,0 +1,58 @@
+package remnawave_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/remnawave"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestUsageCache(t *testing.T) {
+	panel, client := newPanel(t)
+	ctx := context.Background()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = rdb.Close() })
+	cache := remnawave.NewUsageCache(client, rdb, time.Minute)
+
+	user, err := client.CreateUser(ctx, 42, "", 30, nil, 10<<30, 0)
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	onlineAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	panel.SetUsage(user.UUID, 4<<30, onlineAt)
+
+	usage, err := cache.Get(ctx, user.UUID)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	if usage.UsedTrafficBytes != 4<<30 || usage.RemainingBytes() != 6<<30 {
+		t.Errorf("usage = %d used, %d remaining; want 4 GiB used, 6 GiB remaining", usage.UsedTrafficBytes, usage.RemainingBytes())
+	}
+	if usage.OnlineAt == nil || !usage.OnlineAt.Equal(onlineAt) || !usage.Online(time.Now()) {
+		t.Errorf("online at %v, want %v and online", usage.OnlineAt, onlineAt)
+	}
+
+	// Served from Redis until the TTL runs out
+	requests := panel.Requests()
+	panel.SetUsage(user.UUID, 5<<30, onlineAt)
+	if usage, err = cache.Get(ctx, user.UUID); err != nil || usage.UsedTrafficBytes != 4<<30 {
+		t.Errorf("cached Get = %+v, %v; want the first figures", usage, err)
+	}
+	if panel.Requests() != requests {
+		t.Errorf("cached Get hit the panel")
+	}
+
+	mr.FastForward(time.Minute)
+	if usage, err = cache.Get(ctx, user.UUID); err != nil || usage.UsedTrafficBytes != 5<<30 {
+		t.Errorf("Get after TTL = %+v, %v; want fresh figures", usage, err)
+	}
+	if usage.Online(time.Now().Add(remnawave.OnlineWindow)) {
+		t.Errorf("user is online %s after the last connection", remnawave.OnlineWindow+time.Minute)
+	}
+}
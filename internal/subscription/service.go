@@ -0,0 +1,507 @@
+package subscription
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/tariff"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrTrialUnavailable is returned when the user has already used the trial
+// or has had a subscription
+var ErrTrialUnavailable = errors.New("trial is not available")
+
+// Device slot purchase errors
+var (
+	ErrNoActiveSubscription = errors.New("no active subscription")
+	ErrNoDeviceLimit        = errors.New("plan has no device limit")
+	ErrDeviceSlotsExhausted = errors.New("no more device slots can be bought")
+)
+
+// Service keeps the subscriptions table and the Remnawave panel in sync.
+// Every method takes the caller's transaction so the panel call and the
+// balance/payment changes commit or roll back together.
+type Service struct {
+	Remnawave remnawave.API
+	Tariffs   *tariff.Service
+}
+
+func NewService(remnawaveClient remnawave.API, tariffs *tariff.Service) *Service {
+	return &Service{
+		Remnawave: remnawaveClient,
+		Tariffs:   tariffs,
+	}
+}
+
+// Purchase pays for plan from the user's balance and activates it, applying
+// the user's pending promo code. expected is the quote shown to the user; if
+// the code stopped applying since, it fails with promo.ErrChanged rather than
+// charge a different price. The debit, the activation and the promo
+// redemption share one transaction, so a failed panel call never leaves the
+// user charged. It returns ledger.ErrInsufficientFunds if the balance is too
+// low.
+func (s *Service) Purchase(ctx context.Context, db *gorm.DB, user *models.User, plan *models.Plan, expected promo.Quote) (*models.Subscription, error) {
+	// Don't charge and roll back over and over while the panel is down
+	if !s.Remnawave.Available() {
+		return nil, remnawave.ErrUnavailable
+	}
+
+	var sub *models.Subscription
+	err := db.Transaction(func(tx *gorm.DB) error {
+		quote, err := promo.QuotePlan(tx, user.ID, plan)
+		if err != nil {
+			return err
+		}
+		if !quote.Same(expected) {
+			return promo.ErrChanged
+		}
+
+		comment := plan.Name
+		if quote.Code != nil {
+			comment += ", промокод " + quote.Code.Code
+		}
+		// A 100% code leaves nothing to charge, but is still redeemed below
+		if quote.Price > 0 {
+			if _, err := ledger.Post(tx, ledger.Entry{
+				UserID:        user.ID,
+				Amount:        -quote.Price,
+				Kind:          models.LedgerKindPurchase,
+				ReferenceType: "plan",
+				ReferenceID:   strconv.FormatUint(uint64(plan.ID), 10),
+				Comment:       comment,
+			}); err != nil {
+				return err
+			}
+		}
+
+		if quote.Code != nil {
+			if err := promo.Redeem(tx, quote.Code, user.ID, &plan.ID, quote.Discount, quote.BonusDays); err != nil {
+				return err
+			}
+		}
+
+		// The panel call goes last so nothing after it can roll back
+		sub, err = s.Extend(ctx, tx, user, plan.DurationDays+quote.BonusDays, plan)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Extend creates the user's subscription, or extends the existing one by
+// days counting from its current expiration (or from now if it has already
+// expired). plan may be nil for legacy payments without a plan.
+func (s *Service) Extend(ctx context.Context, tx *gorm.DB, user *models.User, days int, plan *models.Plan) (*models.Subscription, error) {
+	var sub models.Subscription
+	err := tx.Where("user_id = ?", user.ID).First(&sub).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return s.create(ctx, tx, user, days, plan)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("db error checking subscription: %w", err)
+	}
+
+	log.Printf("Extending subscription for RemnawaveID: %s", sub.RemnawaveID)
+
+	base := time.Now()
+	if sub.ExpirationDate.After(base) {
+		base = sub.ExpirationDate
+	}
+	expireDate := base.Add(time.Duration(days) * 24 * time.Hour)
+
+	// The checker disables expired users: bring them back before moving the
+	// date, so the panel never holds a paid period on a disabled user
+	rwUser, err := s.syncStatus(ctx, user, sub.RemnawaveID)
+	if errors.Is(err, remnawave.ErrNotFound) {
+		// Deleted on the panel: give the user a new panel account
+		log.Printf("Remnawave user %s not found, recreating", sub.RemnawaveID)
+		created, err := s.createPanelUser(ctx, user, days, s.Tariffs.Squads(plan), trafficLimit(plan), DeviceLimit(plan, &sub))
+		if err != nil {
+			return nil, err
+		}
+		// An existing user taken over by username may be disabled
+		if rwUser, err = s.syncStatus(ctx, user, created.UUID); err != nil {
+			return nil, err
+		}
+		sub.RemnawaveID = rwUser.UUID
+		sub.SubscriptionURL = rwUser.SubscriptionURL
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := s.Remnawave.SetExpiration(ctx, sub.RemnawaveID, expireDate); err != nil {
+		return nil, fmt.Errorf("remnawave extend error: %w", err)
+	}
+	sub.ExpirationDate = expireDate
+
+	// A paid period replaces the trial on the same panel user: lift its
+	// traffic cap and move it to the plan's squads. Without a plan (legacy
+	// payment, admin extension, gift of a removed plan) it becomes a
+	// standard subscription.
+	if sub.PlanType == models.PlanTypeTrial {
+		if err := s.Remnawave.SetTrafficLimit(ctx, sub.RemnawaveID, trafficLimit(plan)); err != nil {
+			return nil, fmt.Errorf("remnawave set traffic limit error: %w", err)
+		}
+		if err := s.Remnawave.SetSquads(ctx, sub.RemnawaveID, s.Tariffs.Squads(plan)); err != nil {
+			return nil, fmt.Errorf("remnawave set squads error: %w", err)
+		}
+		sub.PlanType = "standard"
+	}
+	if plan != nil {
+		sub.PlanID = &plan.ID
+		sub.PlanType = plan.Name
+	}
+
+	if user.Status == "expired" {
+		if err := tx.Model(user).Update("status", "active").Error; err != nil {
+			return nil, fmt.Errorf("failed to reactivate user: %w", err)
+		}
+	}
+
+	// Plans differ in device limits; paid slots stay on top
+	if plan != nil {
+		if limit := DeviceLimit(plan, &sub); deviceLimitOf(rwUser) != limit {
+			if err := s.Remnawave.SetDeviceLimit(ctx, sub.RemnawaveID, limit); err != nil {
+				return nil, fmt.Errorf("remnawave set device limit error: %w", err)
+			}
+		}
+	}
+
+	// Fill in the link if missing (legacy record)
+	if sub.SubscriptionURL == "" {
+		sub.SubscriptionURL = rwUser.SubscriptionURL
+	}
+
+	if err := tx.Save(&sub).Error; err != nil {
+		return nil, fmt.Errorf("failed to update subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+// syncStatus enables the panel user, or keeps it disabled if the user is
+// banned; unbanning enables it again
+func (s *Service) syncStatus(ctx context.Context, user *models.User, remnawaveID string) (*remnawave.UserResponse, error) {
+	if !user.Banned {
+		return s.ensureEnabled(ctx, remnawaveID)
+	}
+
+	rwUser, err := s.Remnawave.GetUser(ctx, remnawaveID)
+	if err != nil {
+		return nil, fmt.Errorf("remnawave get user error: %w", err)
+	}
+	if rwUser.Status != remnawave.UserStatusDisabled {
+		if err := s.Remnawave.DisableUser(ctx, remnawaveID); err != nil {
+			return nil, fmt.Errorf("remnawave disable user error: %w", err)
+		}
+	}
+	return rwUser, nil
+}
+
+// ensureEnabled re-enables a disabled or expired panel user and checks
+// against the panel that the user is active afterwards
+func (s *Service) ensureEnabled(ctx context.Context, remnawaveID string) (*remnawave.UserResponse, error) {
+	rwUser, err := s.Remnawave.GetUser(ctx, remnawaveID)
+	if err != nil {
+		return nil, fmt.Errorf("remnawave get user error: %w", err)
+	}
+	if rwUser.Status != remnawave.UserStatusDisabled && rwUser.Status != remnawave.UserStatusExpired {
+		return rwUser, nil
+	}
+
+	log.Printf("Enabling Remnawave user %s (status: %s)", remnawaveID, rwUser.Status)
+	if err := s.Remnawave.EnableUser(ctx, remnawaveID); err != nil {
+		return nil, fmt.Errorf("remnawave enable user error: %w", err)
+	}
+
+	rwUser, err = s.Remnawave.GetUser(ctx, remnawaveID)
+	if err != nil {
+		return nil, fmt.Errorf("remnawave get user error: %w", err)
+	}
+	if rwUser.Status != remnawave.UserStatusActive {
+		return nil, fmt.Errorf("remnawave user %s is still %s after enabling", remnawaveID, rwUser.Status)
+	}
+	return rwUser, nil
+}
+
+func (s *Service) create(ctx context.Context, tx *gorm.DB, user *models.User, days int, plan *models.Plan) (*models.Subscription, error) {
+	log.Printf("Creating new Remnawave user for TelegramID: %d", user.TelegramID)
+
+	planType := "standard"
+	var planID *uint
+	if plan != nil {
+		planType = plan.Name
+		planID = &plan.ID
+	}
+
+	rwUser, err := s.createPanelUser(ctx, user, days, s.Tariffs.Squads(plan), trafficLimit(plan), DeviceLimit(plan, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	sub := models.Subscription{
+		UserID:          user.ID,
+		RemnawaveID:     rwUser.UUID,
+		SubscriptionURL: rwUser.SubscriptionURL,
+		ExpirationDate:  time.Now().Add(time.Duration(days) * 24 * time.Hour),
+		PlanID:          planID,
+		PlanType:        planType,
+	}
+	if err := tx.Create(&sub).Error; err != nil {
+		return nil, fmt.Errorf("failed to save subscription: %w", err)
+	}
+	return &sub, nil
+}
+
+// createPanelUser creates the user on the panel. If the panel already has
+// the user (e.g. a previous attempt timed out after creating it), that user
+// is reused with the requested expiration.
+func (s *Service) createPanelUser(ctx context.Context, user *models.User, days int, squads []string, trafficLimit int64, deviceLimit int) (*remnawave.UserResponse, error) {
+	rwUser, err := s.Remnawave.CreateUser(ctx, user.TelegramID, fmt.Sprintf("user_%d", user.TelegramID), days, squads, trafficLimit, deviceLimit)
+	if !errors.Is(err, remnawave.ErrConflict) {
+		if err != nil {
+			return nil, fmt.Errorf("remnawave create user error: %w", err)
+		}
+		return rwUser, nil
+	}
+
+	username := remnawave.Username(user.TelegramID)
+	log.Printf("Remnawave user %s already exists, reusing it", username)
+	if rwUser, err = s.Remnawave.GetUserByUsername(ctx, username); err != nil {
+		return nil, fmt.Errorf("remnawave get user by username error: %w", err)
+	}
+	if err := s.Remnawave.SetExpiration(ctx, rwUser.UUID, time.Now().Add(time.Duration(days)*24*time.Hour)); err != nil {
+		return nil, fmt.Errorf("remnawave set expiration error: %w", err)
+	}
+	if rwUser.TrafficLimitBytes != trafficLimit {
+		if err := s.Remnawave.SetTrafficLimit(ctx, rwUser.UUID, trafficLimit); err != nil {
+			return nil, fmt.Errorf("remnawave set traffic limit error: %w", err)
+		}
+	}
+	if deviceLimit > 0 && deviceLimitOf(rwUser) != deviceLimit {
+		if err := s.Remnawave.SetDeviceLimit(ctx, rwUser.UUID, deviceLimit); err != nil {
+			return nil, fmt.Errorf("remnawave set device limit error: %w", err)
+		}
+	}
+	return s.ensureEnabled(ctx, rwUser.UUID)
+}
+
+// trafficLimit returns the traffic limit of a plan; plan may be nil
+func trafficLimit(plan *models.Plan) int64 {
+	if plan == nil {
+		return 0
+	}
+	return plan.TrafficLimitBytes
+}
+
+// DeviceLimit returns how many devices the subscription allows: the plan
+// limit plus paid extra slots, or 0 (unlimited) if the plan has no limit.
+// plan and sub may be nil.
+func DeviceLimit(plan *models.Plan, sub *models.Subscription) int {
+	if plan == nil || plan.DeviceLimit <= 0 {
+		return 0
+	}
+	if sub == nil {
+		return plan.DeviceLimit
+	}
+	return plan.DeviceLimit + sub.ExtraDevices
+}
+
+// CurrentDeviceLimit returns how many devices the subscription allows right
+// now, 0 if unlimited. Without a plan (trials, legacy subscriptions) this is
+// the limit set on the panel. plan may be nil.
+func (s *Service) CurrentDeviceLimit(ctx context.Context, sub *models.Subscription, plan *models.Plan) (int, error) {
+	if plan != nil {
+		return DeviceLimit(plan, sub), nil
+	}
+	rwUser, err := s.Remnawave.GetUser(ctx, sub.RemnawaveID)
+	if err != nil {
+		return 0, fmt.Errorf("remnawave get user error: %w", err)
+	}
+	return deviceLimitOf(rwUser), nil
+}
+
+// deviceLimitOf returns the panel user's device limit, 0 if unset
+func deviceLimitOf(rwUser *remnawave.UserResponse) int {
+	if rwUser.HwidDeviceLimit == nil {
+		return 0
+	}
+	return *rwUser.HwidDeviceLimit
+}
+
+// StartTrial gives the user a free trial of days with the given traffic
+// limit. Each user gets it at most once, and only before any subscription:
+// otherwise ErrTrialUnavailable is returned. Buying a plan later extends the
+// same panel user.
+func (s *Service) StartTrial(ctx context.Context, db *gorm.DB, user *models.User, days int, trafficLimitBytes int64) (*models.Subscription, error) {
+	if !s.Remnawave.Available() {
+		return nil, remnawave.ErrUnavailable
+	}
+
+	var sub *models.Subscription
+	err := db.Transaction(func(tx *gorm.DB) error {
+		// Claiming the flag is the lock: concurrent clicks get zero rows
+		now := time.Now()
+		result := tx.Model(&models.User{}).
+			Where("id = ? AND trial_used_at IS NULL", user.ID).
+			Update("trial_used_at", now)
+		if result.Error != nil {
+			return fmt.Errorf("failed to claim trial: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrTrialUnavailable
+		}
+
+		var count int64
+		if err := tx.Model(&models.Subscription{}).Where("user_id = ?", user.ID).Count(&count).Error; err != nil {
+			return fmt.Errorf("db error checking subscription: %w", err)
+		}
+		if count > 0 {
+			return ErrTrialUnavailable
+		}
+
+		log.Printf("Starting %d-day trial for TelegramID: %d", days, user.TelegramID)
+		rwUser, err := s.createPanelUser(ctx, user, days, s.Tariffs.Squads(nil), trafficLimitBytes, 0)
+		if err != nil {
+			return err
+		}
+
+		sub = &models.Subscription{
+			UserID:          user.ID,
+			RemnawaveID:     rwUser.UUID,
+			SubscriptionURL: rwUser.SubscriptionURL,
+			ExpirationDate:  now.Add(time.Duration(days) * 24 * time.Hour),
+			PlanType:        models.PlanTypeTrial,
+		}
+		if err := tx.Create(sub).Error; err != nil {
+			return fmt.Errorf("failed to save subscription: %w", err)
+		}
+		user.TrialUsedAt = &now
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+// Shorten moves the subscription expiration back by days, e.g. after a refund
+func (s *Service) Shorten(ctx context.Context, tx *gorm.DB, sub *models.Subscription, days int) error {
+	expireDate := sub.ExpirationDate.Add(-time.Duration(days) * 24 * time.Hour)
+
+	if sub.RemnawaveID != "" {
+		if err := s.Remnawave.SetExpiration(ctx, sub.RemnawaveID, expireDate); err != nil {
+			return fmt.Errorf("remnawave set expiration error: %w", err)
+		}
+	}
+
+	if err := tx.Model(sub).Update("expiration_date", expireDate).Error; err != nil {
+		return fmt.Errorf("failed to shorten subscription: %w", err)
+	}
+	sub.ExpirationDate = expireDate
+	return nil
+}
+
+// Revoke ends the subscription immediately and disables the panel user
+func (s *Service) Revoke(ctx context.Context, tx *gorm.DB, user *models.User, sub *models.Subscription) error {
+	now := time.Now()
+
+	if sub.RemnawaveID != "" {
+		err := s.Remnawave.SetExpiration(ctx, sub.RemnawaveID, now)
+		if err == nil {
+			err = s.Remnawave.DisableUser(ctx, sub.RemnawaveID)
+		}
+		if err != nil && !errors.Is(err, remnawave.ErrNotFound) {
+			return fmt.Errorf("remnawave revoke error: %w", err)
+		}
+	}
+
+	if err := tx.Model(sub).Update("expiration_date", now).Error; err != nil {
+		return fmt.Errorf("failed to revoke subscription: %w", err)
+	}
+	sub.ExpirationDate = now
+
+	// Already handled, the checker must not disable and notify again
+	if err := tx.Model(user).Update("status", "expired").Error; err != nil {
+		return fmt.Errorf("failed to update user status: %w", err)
+	}
+	return nil
+}
+
+// AddDeviceSlot charges price from the user's balance for one more device on
+// their active subscription, up to maxExtra paid slots. The slot stays with
+// the subscription across renewals. It returns ledger.ErrInsufficientFunds if
+// the balance is too low.
+func (s *Service) AddDeviceSlot(ctx context.Context, db *gorm.DB, user *models.User, price int64, maxExtra int) (*models.Subscription, error) {
+	if !s.Remnawave.Available() {
+		return nil, remnawave.ErrUnavailable
+	}
+
+	var sub models.Subscription
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("user_id = ?", user.ID).First(&sub).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrNoActiveSubscription
+		}
+		if err != nil {
+			return fmt.Errorf("db error checking subscription: %w", err)
+		}
+		if sub.ExpirationDate.Before(time.Now()) || sub.RemnawaveID == "" {
+			return ErrNoActiveSubscription
+		}
+		var plan *models.Plan
+		if sub.PlanID != nil {
+			if plan, err = s.Tariffs.GetPlan(*sub.PlanID); err != nil {
+				return err
+			}
+		}
+		limit, err := s.CurrentDeviceLimit(ctx, &sub, plan)
+		if err != nil {
+			return err
+		}
+		if limit <= 0 {
+			return ErrNoDeviceLimit
+		}
+		if sub.ExtraDevices >= maxExtra {
+			return ErrDeviceSlotsExhausted
+		}
+
+		if _, err := ledger.Post(tx, ledger.Entry{
+			UserID:        user.ID,
+			Amount:        -price,
+			Kind:          models.LedgerKindPurchase,
+			ReferenceType: "device_slot",
+			ReferenceID:   strconv.FormatUint(uint64(sub.ID), 10),
+			Comment:       "Дополнительное устройство",
+		}); err != nil {
+			return err
+		}
+
+		sub.ExtraDevices++
+		if err := tx.Model(&sub).Update("extra_devices", sub.ExtraDevices).Error; err != nil {
+			return fmt.Errorf("failed to save device slots: %w", err)
+		}
+
+		// The panel call goes last so nothing after it can roll back
+		if err := s.Remnawave.SetDeviceLimit(ctx, sub.RemnawaveID, limit+1); err != nil {
+			return fmt.Errorf("remnawave set device limit error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sub, nil
+}
@@ -0,0 +1,584 @@
+package subscription_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/remnawave/remnawavetest"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/testutil"
+
+	"gorm.io/gorm"
+)
+
+const testSquadID = "squad-default"
+
+type env struct {
+	db     *gorm.DB
+	panel  *remnawavetest.Server
+	client *remnawave.Client
+	subs   *subscription.Service
+	plan30 *models.Plan
+}
+
+func newEnv(t *testing.T) *env {
+	t.Helper()
+
+	db := testutil.DB(t)
+	panel := remnawavetest.NewServer()
+	t.Cleanup(panel.Close)
+
+	tariffs, plan30 := testutil.Plans(t, db, testSquadID)
+
+	client := panel.Client()
+	client.RetryBaseDelay = time.Millisecond
+
+	return &env{
+		db:     db,
+		panel:  panel,
+		client: client,
+		subs:   subscription.NewService(client, tariffs),
+		plan30: plan30,
+	}
+}
+
+// purchase buys the 30-day plan at the price the user is shown, like the bot
+func (e *env) purchase(t *testing.T, user *models.User) (*models.Subscription, error) {
+	t.Helper()
+
+	quote, err := promo.QuotePlan(e.db, user.ID, e.plan30)
+	if err != nil {
+		t.Fatalf("QuotePlan: %v", err)
+	}
+	return e.subs.Purchase(context.Background(), e.db, user, e.plan30, quote)
+}
+
+func assertExpiresIn(t *testing.T, expireAt string, want time.Duration) {
+	t.Helper()
+
+	parsed, err := time.Parse(time.RFC3339, expireAt)
+	if err != nil {
+		t.Fatalf("panel expireAt %q: %v", expireAt, err)
+	}
+	if got := time.Until(parsed); got < want-time.Hour || got > want+time.Hour {
+		t.Errorf("panel user expires in %s, want about %s", got, want)
+	}
+}
+
+func TestPurchaseCreatesPanelUser(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1001, 30000)
+
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+
+	rwUser, ok := e.panel.User(sub.RemnawaveID)
+	if !ok {
+		t.Fatalf("panel user %s was not created", sub.RemnawaveID)
+	}
+	if rwUser.Status != remnawave.UserStatusActive {
+		t.Errorf("panel status = %s, want %s", rwUser.Status, remnawave.UserStatusActive)
+	}
+	if len(rwUser.ActiveInternalSquads) != 1 || rwUser.ActiveInternalSquads[0].UUID != testSquadID {
+		t.Errorf("panel squads = %+v, want [%s]", rwUser.ActiveInternalSquads, testSquadID)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 30*24*time.Hour)
+
+	if sub.SubscriptionURL != rwUser.SubscriptionURL || sub.SubscriptionURL == "" {
+		t.Errorf("subscription URL = %q, want %q", sub.SubscriptionURL, rwUser.SubscriptionURL)
+	}
+	if sub.PlanID == nil || *sub.PlanID != e.plan30.ID {
+		t.Errorf("subscription plan = %v, want %d", sub.PlanID, e.plan30.ID)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 30000-e.plan30.Price {
+		t.Errorf("balance = %d, want %d", got, 30000-e.plan30.Price)
+	}
+}
+
+func TestPurchaseExtendsExistingUser(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1002, 2*e.plan30.Price)
+
+	first, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("first Purchase: %v", err)
+	}
+	second, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("second Purchase: %v", err)
+	}
+
+	if second.RemnawaveID != first.RemnawaveID {
+		t.Errorf("renewal created a new panel user %s, want %s", second.RemnawaveID, first.RemnawaveID)
+	}
+	if n := e.panel.Users(); n != 1 {
+		t.Errorf("panel has %d users, want 1", n)
+	}
+
+	rwUser, _ := e.panel.User(first.RemnawaveID)
+	assertExpiresIn(t, rwUser.ExpireAt, 60*24*time.Hour)
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
+
+func TestPurchaseAppliesPromoCode(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1010, e.plan30.Price)
+
+	discount := models.PromoCode{Code: "HALF", Type: models.PromoTypePercent, Value: 50, MaxUsesPerUser: 1, IsActive: true}
+	bonus := models.PromoCode{Code: "WEEK", Type: models.PromoTypeDays, Value: 7, MaxUsesPerUser: 1, IsActive: true}
+	for _, code := range []*models.PromoCode{&discount, &bonus} {
+		if err := e.db.Create(code).Error; err != nil {
+			t.Fatalf("create promo code: %v", err)
+		}
+	}
+
+	if _, err := promo.Activate(e.db, user, "half"); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	if got, want := testutil.Balance(t, e.db, user.ID), e.plan30.Price/2; got != want {
+		t.Errorf("balance after discounted purchase = %d, want %d", got, want)
+	}
+
+	// The code is used up: the next purchase pays full price
+	if _, err := promo.Activate(e.db, user, "half"); !errors.Is(err, promo.ErrAlreadyUsed) {
+		t.Errorf("second Activate error = %v, want ErrAlreadyUsed", err)
+	}
+
+	if _, err := promo.Activate(e.db, user, "week"); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	if err := e.db.Transaction(func(tx *gorm.DB) error {
+		_, err := ledger.Post(tx, ledger.Entry{UserID: user.ID, Amount: e.plan30.Price, Kind: models.LedgerKindTopUp})
+		return err
+	}); err != nil {
+		t.Fatalf("top up: %v", err)
+	}
+	if _, err := e.purchase(t, user); err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	assertExpiresIn(t, rwUser.ExpireAt, (60+7)*24*time.Hour)
+	if got, want := testutil.Balance(t, e.db, user.ID), e.plan30.Price/2; got != want {
+		t.Errorf("balance after bonus purchase = %d, want %d", got, want)
+	}
+
+	var redemptions []models.PromoRedemption
+	e.db.Order("id").Find(&redemptions)
+	if len(redemptions) != 2 || redemptions[0].Amount != e.plan30.Price/2 || redemptions[1].Days != 7 {
+		t.Errorf("redemptions = %+v, want a %d discount and 7 days", redemptions, e.plan30.Price/2)
+	}
+}
+
+func TestPurchaseWithFullDiscount(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1011, 0)
+
+	free := models.PromoCode{Code: "FREE", Type: models.PromoTypePercent, Value: 100, MaxUsesPerUser: 1, IsActive: true}
+	if err := e.db.Create(&free).Error; err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	if _, err := promo.Activate(e.db, user, "free"); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	assertExpiresIn(t, rwUser.ExpireAt, 30*24*time.Hour)
+
+	var redemptions []models.PromoRedemption
+	e.db.Find(&redemptions)
+	if len(redemptions) != 1 || redemptions[0].Amount != e.plan30.Price {
+		t.Errorf("redemptions = %+v, want one of %d", redemptions, e.plan30.Price)
+	}
+	if _, err := promo.Activate(e.db, user, "free"); !errors.Is(err, promo.ErrAlreadyUsed) {
+		t.Errorf("second Activate error = %v, want ErrAlreadyUsed", err)
+	}
+}
+
+func TestPurchaseFailsWhenPromoCodeChanged(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1012, e.plan30.Price)
+
+	code := models.PromoCode{Code: "HALF", Type: models.PromoTypePercent, Value: 50, IsActive: true}
+	if err := e.db.Create(&code).Error; err != nil {
+		t.Fatalf("create promo code: %v", err)
+	}
+	if _, err := promo.Activate(e.db, user, "half"); err != nil {
+		t.Fatalf("Activate: %v", err)
+	}
+	quote, err := promo.QuotePlan(e.db, user.ID, e.plan30)
+	if err != nil {
+		t.Fatalf("QuotePlan: %v", err)
+	}
+
+	// The code expires between showing the price and buying
+	e.db.Model(&code).Update("valid_until", time.Now().Add(-time.Minute))
+
+	_, err = e.subs.Purchase(context.Background(), e.db, user, e.plan30, quote)
+	if !errors.Is(err, promo.ErrChanged) || !promo.IsInvalid(err) {
+		t.Fatalf("Purchase error = %v, want ErrChanged", err)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != e.plan30.Price {
+		t.Errorf("balance = %d, want %d (not charged)", got, e.plan30.Price)
+	}
+	if n := e.panel.Users(); n != 0 {
+		t.Errorf("panel has %d users, want 0", n)
+	}
+}
+
+func TestPurchaseInsufficientFunds(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1003, e.plan30.Price-1)
+
+	_, err := e.purchase(t, user)
+	if !errors.Is(err, ledger.ErrInsufficientFunds) {
+		t.Fatalf("Purchase error = %v, want ErrInsufficientFunds", err)
+	}
+	if n := e.panel.Users(); n != 0 {
+		t.Errorf("panel has %d users, want 0", n)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != e.plan30.Price-1 {
+		t.Errorf("balance = %d, want %d", got, e.plan30.Price-1)
+	}
+}
+
+func TestPurchaseRollsBackWhenPanelIsDown(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1004, e.plan30.Price)
+	e.panel.Close()
+
+	if _, err := e.purchase(t, user); err == nil {
+		t.Fatal("Purchase succeeded with the panel down")
+	}
+
+	if got := testutil.Balance(t, e.db, user.ID); got != e.plan30.Price {
+		t.Errorf("balance = %d, want %d (debit must be rolled back)", got, e.plan30.Price)
+	}
+	var count int64
+	e.db.Model(&models.Subscription{}).Count(&count)
+	if count != 0 {
+		t.Errorf("%d subscriptions saved, want 0", count)
+	}
+}
+
+func TestPurchaseWhenPanelIsUnavailable(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1005, e.plan30.Price)
+
+	// Trip the circuit breaker
+	e.panel.Fail(100, http.StatusBadGateway)
+	for i := 0; i < 5; i++ {
+		_, _ = e.client.GetUser(context.Background(), "x")
+	}
+
+	before := e.panel.Requests()
+	_, err := e.purchase(t, user)
+	if !errors.Is(err, remnawave.ErrUnavailable) {
+		t.Fatalf("Purchase error = %v, want ErrUnavailable", err)
+	}
+	if e.panel.Requests() != before {
+		t.Error("Purchase called the panel while it was marked unavailable")
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != e.plan30.Price {
+		t.Errorf("balance = %d, want %d", got, e.plan30.Price)
+	}
+}
+
+func TestExtendRecreatesUserDeletedOnPanel(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1006, 2*e.plan30.Price)
+
+	first, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("first Purchase: %v", err)
+	}
+	if err := e.client.DeleteUser(context.Background(), first.RemnawaveID); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	second, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("second Purchase: %v", err)
+	}
+	if second.RemnawaveID == first.RemnawaveID {
+		t.Fatal("subscription still points at the deleted panel user")
+	}
+	rwUser, ok := e.panel.User(second.RemnawaveID)
+	if !ok {
+		t.Fatalf("panel user %s does not exist", second.RemnawaveID)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 60*24*time.Hour)
+}
+
+func TestExtendKeepsBannedUserDisabled(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1014, e.plan30.Price)
+
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+
+	// Banned by an admin, then extended, e.g. by an admin or a late payment
+	user.Banned = true
+	if err := e.db.Model(user).Update("banned", true).Error; err != nil {
+		t.Fatalf("ban user: %v", err)
+	}
+	if err := e.client.DisableUser(context.Background(), sub.RemnawaveID); err != nil {
+		t.Fatalf("DisableUser: %v", err)
+	}
+	if err := e.db.Transaction(func(tx *gorm.DB) error {
+		_, err := e.subs.Extend(context.Background(), tx, user, 30, nil)
+		return err
+	}); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	if rwUser.Status != remnawave.UserStatusDisabled {
+		t.Errorf("panel status = %s, want %s", rwUser.Status, remnawave.UserStatusDisabled)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 60*24*time.Hour)
+}
+
+func TestRevokeDisablesPanelUser(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1007, e.plan30.Price)
+
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+
+	if err := e.subs.Revoke(context.Background(), e.db, user, sub); err != nil {
+		t.Fatalf("Revoke: %v", err)
+	}
+
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	if rwUser.Status != remnawave.UserStatusDisabled {
+		t.Errorf("panel status = %s, want %s", rwUser.Status, remnawave.UserStatusDisabled)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 0)
+
+	var stored models.Subscription
+	if err := e.db.First(&stored, sub.ID).Error; err != nil {
+		t.Fatalf("reload subscription: %v", err)
+	}
+	if stored.ExpirationDate.After(time.Now()) {
+		t.Errorf("subscription still expires at %s", stored.ExpirationDate)
+	}
+
+	// Extending afterwards brings the same panel user back
+	renewed, err := e.subs.Extend(context.Background(), e.db, user, 7, nil)
+	if err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	if renewed.RemnawaveID != sub.RemnawaveID {
+		t.Errorf("extension created panel user %s, want %s", renewed.RemnawaveID, sub.RemnawaveID)
+	}
+	rwUser, _ = e.panel.User(sub.RemnawaveID)
+	if rwUser.Status != remnawave.UserStatusActive {
+		t.Errorf("panel status after extension = %s, want %s", rwUser.Status, remnawave.UserStatusActive)
+	}
+}
+
+func TestTrialIsGrantedOnceAndConvertsToPaid(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1008, e.plan30.Price)
+	const trafficLimit = 10 << 30
+
+	trial, err := e.subs.StartTrial(context.Background(), e.db, user, 3, trafficLimit)
+	if err != nil {
+		t.Fatalf("StartTrial: %v", err)
+	}
+	if trial.PlanType != models.PlanTypeTrial || trial.PlanID != nil {
+		t.Errorf("trial plan = %q %v, want %q without plan ID", trial.PlanType, trial.PlanID, models.PlanTypeTrial)
+	}
+	rwUser, ok := e.panel.User(trial.RemnawaveID)
+	if !ok {
+		t.Fatalf("panel user %s does not exist", trial.RemnawaveID)
+	}
+	if rwUser.TrafficLimitBytes != trafficLimit {
+		t.Errorf("trial traffic limit = %d, want %d", rwUser.TrafficLimitBytes, trafficLimit)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 3*24*time.Hour)
+
+	// Never twice, even with a fresh copy of the user
+	var reloaded models.User
+	if err := e.db.First(&reloaded, user.ID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	if reloaded.TrialUsedAt == nil {
+		t.Error("trial is not recorded on the user")
+	}
+	reloaded.TrialUsedAt = nil
+	if _, err := e.subs.StartTrial(context.Background(), e.db, &reloaded, 3, trafficLimit); !errors.Is(err, subscription.ErrTrialUnavailable) {
+		t.Errorf("second StartTrial error = %v, want ErrTrialUnavailable", err)
+	}
+
+	// Paying extends the same panel user, lifts the trial cap and moves it
+	// to the plan's squads
+	e.plan30.Squads = "squad-premium"
+	if err := e.db.Save(e.plan30).Error; err != nil {
+		t.Fatalf("save plan: %v", err)
+	}
+	paid, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	if paid.RemnawaveID != trial.RemnawaveID {
+		t.Errorf("purchase created panel user %s, want trial user %s", paid.RemnawaveID, trial.RemnawaveID)
+	}
+	if e.panel.Users() != 1 {
+		t.Errorf("panel has %d users, want 1", e.panel.Users())
+	}
+	if paid.PlanType != e.plan30.Name {
+		t.Errorf("plan type after purchase = %q, want %q", paid.PlanType, e.plan30.Name)
+	}
+	rwUser, _ = e.panel.User(paid.RemnawaveID)
+	if rwUser.TrafficLimitBytes != e.plan30.TrafficLimitBytes {
+		t.Errorf("traffic limit after purchase = %d, want %d", rwUser.TrafficLimitBytes, e.plan30.TrafficLimitBytes)
+	}
+	if len(rwUser.ActiveInternalSquads) != 1 || rwUser.ActiveInternalSquads[0].UUID != "squad-premium" {
+		t.Errorf("panel squads after purchase = %+v, want [squad-premium]", rwUser.ActiveInternalSquads)
+	}
+	assertExpiresIn(t, rwUser.ExpireAt, 33*24*time.Hour)
+}
+
+func TestTrialExtendedWithoutPlanLosesTrialCap(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1013, 0)
+
+	trial, err := e.subs.StartTrial(context.Background(), e.db, user, 3, 10<<30)
+	if err != nil {
+		t.Fatalf("StartTrial: %v", err)
+	}
+
+	// E.g. an admin extension, which carries no plan
+	var sub *models.Subscription
+	if err := e.db.Transaction(func(tx *gorm.DB) error {
+		sub, err = e.subs.Extend(context.Background(), tx, user, 30, nil)
+		return err
+	}); err != nil {
+		t.Fatalf("Extend: %v", err)
+	}
+	if sub.PlanType == models.PlanTypeTrial {
+		t.Errorf("plan type = %q, want it to no longer be a trial", sub.PlanType)
+	}
+	rwUser, _ := e.panel.User(trial.RemnawaveID)
+	if rwUser.TrafficLimitBytes != 0 {
+		t.Errorf("traffic limit = %d, want 0 (unlimited)", rwUser.TrafficLimitBytes)
+	}
+	if len(rwUser.ActiveInternalSquads) != 1 || rwUser.ActiveInternalSquads[0].UUID != testSquadID {
+		t.Errorf("panel squads = %+v, want [%s]", rwUser.ActiveInternalSquads, testSquadID)
+	}
+}
+
+func TestTrialUnavailableAfterPurchase(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1009, e.plan30.Price)
+
+	if _, err := e.purchase(t, user); err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	if _, err := e.subs.StartTrial(context.Background(), e.db, user, 3, 0); !errors.Is(err, subscription.ErrTrialUnavailable) {
+		t.Errorf("StartTrial error = %v, want ErrTrialUnavailable", err)
+	}
+}
+
+func TestDeviceLimitAndExtraSlots(t *testing.T) {
+	e := newEnv(t)
+	e.db.Model(e.plan30).Update("device_limit", 2)
+	e.plan30.DeviceLimit = 2
+	user := testutil.NewUser(t, e.db, 1011, 2*e.plan30.Price+100)
+
+	if _, err := e.subs.AddDeviceSlot(context.Background(), e.db, user, 100, 1); !errors.Is(err, subscription.ErrNoActiveSubscription) {
+		t.Errorf("AddDeviceSlot without subscription error = %v, want ErrNoActiveSubscription", err)
+	}
+
+	sub, err := e.purchase(t, user)
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	if rwUser.HwidDeviceLimit == nil || *rwUser.HwidDeviceLimit != 2 {
+		t.Errorf("panel device limit = %v, want 2", rwUser.HwidDeviceLimit)
+	}
+
+	sub, err = e.subs.AddDeviceSlot(context.Background(), e.db, user, 100, 1)
+	if err != nil {
+		t.Fatalf("AddDeviceSlot: %v", err)
+	}
+	if sub.ExtraDevices != 1 {
+		t.Errorf("extra devices = %d, want 1", sub.ExtraDevices)
+	}
+	if _, err := e.subs.AddDeviceSlot(context.Background(), e.db, user, 100, 1); !errors.Is(err, subscription.ErrDeviceSlotsExhausted) {
+		t.Errorf("AddDeviceSlot over the maximum error = %v, want ErrDeviceSlotsExhausted", err)
+	}
+
+	// Renewing keeps the paid slot on top of the plan limit
+	if _, err := e.purchase(t, user); err != nil {
+		t.Fatalf("second Purchase: %v", err)
+	}
+	rwUser, _ = e.panel.User(sub.RemnawaveID)
+	if rwUser.HwidDeviceLimit == nil || *rwUser.HwidDeviceLimit != 3 {
+		t.Errorf("panel device limit after renewal = %v, want 3", rwUser.HwidDeviceLimit)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
+
+func TestExtraSlotWithoutPlanUsesPanelLimit(t *testing.T) {
+	e := newEnv(t)
+	user := testutil.NewUser(t, e.db, 1012, 100)
+
+	sub, err := e.subs.StartTrial(context.Background(), e.db, user, 3, 0)
+	if err != nil {
+		t.Fatalf("StartTrial: %v", err)
+	}
+	if _, err := e.subs.AddDeviceSlot(context.Background(), e.db, user, 100, 1); !errors.Is(err, subscription.ErrNoDeviceLimit) {
+		t.Errorf("AddDeviceSlot without any limit error = %v, want ErrNoDeviceLimit", err)
+	}
+
+	// Limited by hand on the panel
+	if err := e.client.SetDeviceLimit(context.Background(), sub.RemnawaveID, 2); err != nil {
+		t.Fatalf("SetDeviceLimit: %v", err)
+	}
+	sub, err = e.subs.AddDeviceSlot(context.Background(), e.db, user, 100, 1)
+	if err != nil {
+		t.Fatalf("AddDeviceSlot: %v", err)
+	}
+	if sub.ExtraDevices != 1 {
+		t.Errorf("extra devices = %d, want 1", sub.ExtraDevices)
+	}
+	rwUser, _ := e.panel.User(sub.RemnawaveID)
+	if rwUser.HwidDeviceLimit == nil || *rwUser.HwidDeviceLimit != 3 {
+		t.Errorf("panel device limit = %v, want 3", rwUser.HwidDeviceLimit)
+	}
+	if got := testutil.Balance(t, e.db, user.ID); got != 0 {
+		t.Errorf("balance = %d, want 0", got)
+	}
+}
@@ -0,0 +1,114 @@
+package tariff
+
+import (
+	"errors"
+	"fmt"
+	"log"
+
+	"popovka-bot/internal/models"
+
+	"gorm.io/gorm"
+)
+
+// ErrPlanNotFound is returned when a plan does not exist or is disabled
+var ErrPlanNotFound = errors.New("plan not found")
+
+// defaultPlans are inserted on first start so the bot has something to sell.
+// After that prices are managed directly in the plans table.
+var defaultPlans = []models.Plan{
+	{Name: "7 дней", Price: 7900, DurationDays: 7, SortOrder: 10},
+	{Name: "30 дней", Price: 25500, DurationDays: 30, SortOrder: 20},
+	{Name: "90 дней", Price: 69000, DurationDays: 90, SortOrder: 30},
+	{Name: "365 дней", Price: 249000, DurationDays: 365, SortOrder: 40},
+}
+
+type Service struct {
+	DB             *gorm.DB
+	DefaultSquadID string
+}
+
+func NewService(db *gorm.DB, defaultSquadID string) *Service {
+	return &Service{
+		DB:             db,
+		DefaultSquadID: defaultSquadID,
+	}
+}
+
+// SeedDefaults fills the plans table with the default catalog if it is empty
+func (s *Service) SeedDefaults() error {
+	var count int64
+	if err := s.DB.Model(&models.Plan{}).Count(&count).Error; err != nil {
+		return fmt.Errorf("failed to count plans: %w", err)
+	}
+	if count > 0 {
+		return nil
+	}
+
+	plans := make([]models.Plan, len(defaultPlans))
+	copy(plans, defaultPlans)
+	if err := s.DB.Create(&plans).Error; err != nil {
+		return fmt.Errorf("failed to seed plans: %w", err)
+	}
+
+	log.Printf("Seeded %d default plans", len(plans))
+	return nil
+}
+
+// ActivePlans returns plans available for purchase in display order
+func (s *Service) ActivePlans() ([]models.Plan, error) {
+	var plans []models.Plan
+	if err := s.DB.Where("is_active = ?", true).Order("sort_order, duration_days").Find(&plans).Error; err != nil {
+		return nil, fmt.Errorf("failed to load plans: %w", err)
+	}
+	return plans, nil
+}
+
+// GetPlan returns a plan by ID, including disabled ones
+func (s *Service) GetPlan(id uint) (*models.Plan, error) {
+	var plan models.Plan
+	err := s.DB.First(&plan, id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPlanNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plan %d: %w", id, err)
+	}
+	return &plan, nil
+}
+
+// GetActivePlan returns an active plan by ID
+func (s *Service) GetActivePlan(id uint) (*models.Plan, error) {
+	var plan models.Plan
+	err := s.DB.Where("id = ? AND is_active = ?", id, true).First(&plan).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrPlanNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load plan %d: %w", id, err)
+	}
+	return &plan, nil
+}
+
+// RenewalPlan returns the plan to auto-renew a subscription with: only its
+// own plan, and only while it is still sold. Subscriptions without a plan,
+// such as trials, get ErrPlanNotFound.
+func (s *Service) RenewalPlan(planID *uint) (*models.Plan, error) {
+	if planID == nil {
+		return nil, ErrPlanNotFound
+	}
+	return s.GetActivePlan(*planID)
+}
+
+// Squads returns the squads a plan grants, falling back to the configured
+// default squad. plan may be nil.
+func (s *Service) Squads(plan *models.Plan) []string {
+	if plan != nil {
+		if squads := plan.SquadIDs(); len(squads) > 0 {
+			return squads
+		}
+	}
+	if s.DefaultSquadID != "" {
+		return []string{s.DefaultSquadID}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package testutil
+
+import (
+	"fmt"
+	"testing"
+
+	"popovka-bot/internal/ledger"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/tariff"
+
+	"gorm.io/gorm"
+)
+
+// Plans seeds the default plans and returns the tariff service along with
+// the 30-day plan
+func Plans(t *testing.T, db *gorm.DB, defaultSquadID string) (*tariff.Service, *models.Plan) {
+	t.Helper()
+
+	tariffs := tariff.NewService(db, defaultSquadID)
+	if err := tariffs.SeedDefaults(); err != nil {
+		t.Fatalf("seed plans: %v", err)
+	}
+	var plan models.Plan
+	if err := db.Where("duration_days = ?", 30).First(&plan).Error; err != nil {
+		t.Fatalf("load plan: %v", err)
+	}
+	return tariffs, &plan
+}
+
+// NewUser creates an active user with the given balance in kopecks, credited
+// through the ledger like a top-up
+func NewUser(t *testing.T, db *gorm.DB, telegramID int64, balance int64) *models.User {
+	t.Helper()
+
+	user := models.User{
+		TelegramID:   telegramID,
+		Status:       "active",
+		ReferralCode: fmt.Sprintf("ref_%d", telegramID),
+	}
+	if err := db.Create(&user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	if balance > 0 {
+		if err := db.Transaction(func(tx *gorm.DB) error {
+			_, err := ledger.Post(tx, ledger.Entry{UserID: user.ID, Amount: balance, Kind: models.LedgerKindTopUp})
+			return err
+		}); err != nil {
+			t.Fatalf("top up: %v", err)
+		}
+	}
+	if err := db.First(&user, user.ID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	return &user
+}
+
+// Balance returns the user's current balance in kopecks
+func Balance(t *testing.T, db *gorm.DB, userID uint) int64 {
+	t.Helper()
+
+	var user models.User
+	if err := db.First(&user, userID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	return user.Balance
+}
@@ -0,0 +1,181 @@
+// Package testutil holds shared helpers for tests: an SQLite database with
+// the bot's schema, seeded plans and users, and a fake Telegram Bot API
+// recording sent messages.
+package testutil
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"popovka-bot/internal/models"
+
+	"github.com/glebarez/sqlite"
+	"github.com/mymmrac/telego"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// DB opens a fresh SQLite database with all tables migrated
+func DB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	dsn := filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+
+	if err := db.AutoMigrate(
+		&models.User{},
+		&models.Subscription{},
+		&models.Payment{},
+		&models.ReferralTransaction{},
+		&models.Plan{},
+		&models.LedgerEntry{},
+		&models.Refund{},
+		&models.Broadcast{},
+		&models.PromoCode{},
+		&models.PromoRedemption{},
+		&models.Gift{},
+	); err != nil {
+		t.Fatalf("failed to migrate test database: %v", err)
+	}
+
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			_ = sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// Message is a message sent through the fake Telegram API
+type Message struct {
+	ChatID int64
+	Text   string
+}
+
+// Telegram is a fake Bot API that accepts every call and records sendMessage
+// and sendPhoto (by caption)
+type Telegram struct {
+	Bot *telego.Bot
+
+	mu       sync.Mutex
+	messages []Message
+	calls    map[string]int
+	blocked  map[int64]bool
+	flood    map[int64]int
+}
+
+// NewTelegram starts a fake Bot API and a bot talking to it
+func NewTelegram(t *testing.T) *Telegram {
+	t.Helper()
+
+	tg := &Telegram{
+		calls:   make(map[string]int),
+		blocked: make(map[int64]bool),
+		flood:   make(map[int64]int),
+	}
+	server := httptest.NewServer(http.HandlerFunc(tg.serve))
+	t.Cleanup(server.Close)
+
+	bot, err := telego.NewBot("123456:TEST-TOKEN-0123456789abcdefghijklmn", telego.WithAPIServer(server.URL), telego.WithDiscardLogger())
+	if err != nil {
+		t.Fatalf("failed to create test bot: %v", err)
+	}
+	tg.Bot = bot
+	return tg
+}
+
+// Calls returns how many times the Bot API method was called
+func (tg *Telegram) Calls(method string) int {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	return tg.calls[method]
+}
+
+// Block makes sending to chatID fail as if the user blocked the bot
+func (tg *Telegram) Block(chatID int64) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.blocked[chatID] = true
+}
+
+// Flood makes the next message to chatID fail with 429 and retry_after
+func (tg *Telegram) Flood(chatID int64, retryAfter int) {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+	tg.flood[chatID] = retryAfter
+}
+
+// Messages returns the messages sent to chatID
+func (tg *Telegram) Messages(chatID int64) []string {
+	tg.mu.Lock()
+	defer tg.mu.Unlock()
+
+	var texts []string
+	for _, msg := range tg.messages {
+		if msg.ChatID == chatID {
+			texts = append(texts, msg.Text)
+		}
+	}
+	return texts
+}
+
+func (tg *Telegram) serve(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		ChatID  int64  `json:"chat_id"`
+		Text    string `json:"text"`
+		Caption string `json:"caption"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&params)
+
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	tg.mu.Lock()
+	tg.calls[method]++
+	blocked := tg.blocked[params.ChatID]
+	retryAfter, flood := tg.flood[params.ChatID]
+	delete(tg.flood, params.ChatID)
+	tg.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if method == "sendMessage" || method == "sendPhoto" {
+		switch {
+		case blocked:
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error_code": 403, "description": "Forbidden: bot was blocked by the user"})
+			return
+		case flood:
+			w.WriteHeader(http.StatusTooManyRequests)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"ok": false, "error_code": 429, "description": "Too Many Requests: retry later",
+				"parameters": map[string]int{"retry_after": retryAfter},
+			})
+			return
+		}
+	}
+
+	result := json.RawMessage("true")
+	if method == "sendMessage" || method == "sendPhoto" {
+		if method == "sendPhoto" {
+			params.Text = params.Caption
+		}
+		tg.mu.Lock()
+		tg.messages = append(tg.messages, Message{ChatID: params.ChatID, Text: params.Text})
+		messageID := len(tg.messages)
+		tg.mu.Unlock()
+
+		result, _ = json.Marshal(telego.Message{
+			MessageID: messageID,
+			Chat:      telego.Chat{ID: params.ChatID, Type: telego.ChatTypePrivate},
+			Text:      params.Text,
+		})
+	}
+
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": result})
+}
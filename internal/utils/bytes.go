@@ -0,0 +1,14 @@
+package utils
+
+import "fmt"
+
+// FormatBytes formats a traffic amount in binary units, e.g. 1610612736 -> "1.50 ГБ"
+func FormatBytes(bytes int64) string {
+	switch {
+	case bytes >= 1<<30:
+		return fmt.Sprintf("%.2f ГБ", float64(bytes)/(1<<30))
+	case bytes >= 1<<20:
+		return fmt.Sprintf("%.1f МБ", float64(bytes)/(1<<20))
+	}
+	return fmt.Sprintf("%d КБ", bytes>>10)
+}
@@ -2,9 +2,12 @@ package utils
 
 import (
 	"net"
+	"net/http"
+	"strings"
 )
 
-// IsAllowedIP checking if the IP address enters the allowed CIDR subnetwork
+// IsAllowedIP checking if the IP address enters the allowed CIDR subnetwork.
+// Entries without a prefix length are treated as single addresses.
 func IsAllowedIP(ip string, allowedCIDRs []string) bool {
 	parsed := net.ParseIP(ip)
 	if parsed == nil {
@@ -12,6 +15,12 @@ func IsAllowedIP(ip string, allowedCIDRs []string) bool {
 	}
 
 	for _, cidr := range allowedCIDRs {
+		if single := net.ParseIP(cidr); single != nil {
+			if single.Equal(parsed) {
+				return true
+			}
+			continue
+		}
 		_, netblock, err := net.ParseCIDR(cidr)
 		if err != nil {
 			// Skip invalid CIDR
@@ -23,3 +32,37 @@ func IsAllowedIP(ip string, allowedCIDRs []string) bool {
 	}
 	return false
 }
+
+// ClientIP returns the address of the client that sent the request.
+// X-Forwarded-For is only honoured when the direct peer is a trusted proxy;
+// the header is then walked right to left and the first untrusted hop wins,
+// so a client cannot spoof its address by prepending entries.
+func ClientIP(r *http.Request, trustedProxies []string) string {
+	remoteIP := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = host
+	}
+
+	if !IsAllowedIP(remoteIP, trustedProxies) {
+		return remoteIP
+	}
+
+	xff := r.Header.Get("X-Forwarded-For")
+	if xff == "" {
+		return remoteIP
+	}
+
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !IsAllowedIP(hop, trustedProxies) {
+			return hop
+		}
+		remoteIP = hop
+	}
+
+	return remoteIP
+}
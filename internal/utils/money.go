@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FormatRub formats kopecks as rubles with two decimals, e.g. 25500 -> "255.00".
+// The result is also accepted by YooKassa as an amount value.
+func FormatRub(kopecks int64) string {
+	sign := ""
+	if kopecks < 0 {
+		sign = "-"
+		kopecks = -kopecks
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, kopecks/100, kopecks%100)
+}
+
+// ParseRub parses a ruble amount ("255", "255.5", "255,50") into kopecks
+func ParseRub(value string) (int64, error) {
+	value = strings.TrimSpace(strings.Replace(value, ",", ".", 1))
+	if value == "" {
+		return 0, fmt.Errorf("empty amount")
+	}
+
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+
+	rubles, fraction, _ := strings.Cut(value, ".")
+	if rubles == "" || len(fraction) > 2 {
+		return 0, fmt.Errorf("invalid amount: %q", value)
+	}
+	for len(fraction) < 2 {
+		fraction += "0"
+	}
+
+	rub, err := strconv.ParseInt(rubles, 10, 64)
+	if err != nil || rub < 0 {
+		return 0, fmt.Errorf("invalid amount: %q", value)
+	}
+	kop, err := strconv.ParseInt(fraction, 10, 64)
+	if err != nil || kop < 0 {
+		return 0, fmt.Errorf("invalid amount: %q", value)
+	}
+
+	amount := rub*100 + kop
+	if negative {
+		amount = -amount
+	}
+	return amount, nil
+}
@@ -0,0 +1,147 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"popovka-bot/internal/broadcast"
+	"popovka-bot/internal/models"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"gorm.io/gorm"
+)
+
+// Broadcaster sends queued broadcasts one message at a time. Any number of
+// replicas may run it; the queue and the rate limit live in Redis.
+type Broadcaster struct {
+	DB         *gorm.DB
+	Broadcasts *broadcast.Service
+	Bot        *telego.Bot
+
+	current *models.Broadcast // Cached message of the broadcast being sent
+}
+
+func NewBroadcaster(db *gorm.DB, broadcasts *broadcast.Service, bot *telego.Bot) *Broadcaster {
+	return &Broadcaster{
+		DB:         db,
+		Broadcasts: broadcasts,
+		Bot:        bot,
+	}
+}
+
+const (
+	broadcastIdle        = 2 * time.Second  // Poll interval while nothing is queued
+	broadcastSendTimeout = 10 * time.Second // Bounds a single message
+)
+
+// Start sends queued messages until ctx is canceled
+func (w *Broadcaster) Start(ctx context.Context) {
+	log.Println("Background broadcast worker started")
+
+	for {
+		busy, err := w.step(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Broadcast worker error: %v", err)
+		}
+		if ctx.Err() != nil {
+			log.Println("Background broadcast worker stopped")
+			return
+		}
+		if busy && err == nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			log.Println("Background broadcast worker stopped")
+			return
+		case <-time.After(broadcastIdle):
+		}
+	}
+}
+
+// step sends one message of the current broadcast, or finishes it when its
+// queue is empty. It reports whether there was anything to do.
+func (w *Broadcaster) step(ctx context.Context) (bool, error) {
+	id, err := w.Broadcasts.Current(ctx)
+	if err != nil || id == 0 {
+		return false, err
+	}
+
+	if err := w.Broadcasts.Throttle(ctx); err != nil {
+		return false, err
+	}
+
+	// From here on the recipient is ours: finish with it even on shutdown
+	ctx = context.WithoutCancel(ctx)
+
+	chatID, ok, err := w.Broadcasts.Pop(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		bc, err := w.Broadcasts.Finish(ctx, id)
+		if err != nil {
+			return false, err
+		}
+		if bc == nil {
+			return false, nil // Still in flight elsewhere, or finished by another sender
+		}
+		w.report(ctx, bc)
+		return true, nil
+	}
+
+	bc, err := w.load(id)
+	if err != nil {
+		_ = w.Broadcasts.Requeue(ctx, id, chatID)
+		return false, err
+	}
+
+	sendCtx, cancel := context.WithTimeout(ctx, broadcastSendTimeout)
+	sendErr := broadcast.Send(sendCtx, w.Bot, bc, chatID)
+	cancel()
+
+	if retryAfter := broadcast.RetryAfter(sendErr); retryAfter > 0 {
+		log.Printf("Broadcast %d hit flood control, pausing for %s", id, retryAfter)
+		if err := w.Broadcasts.Pause(ctx, retryAfter); err != nil {
+			log.Printf("Failed to pause broadcasts: %v", err)
+		}
+		return true, w.Broadcasts.Requeue(ctx, id, chatID)
+	}
+	if sendErr != nil && !broadcast.IsBlocked(sendErr) {
+		log.Printf("Failed to send broadcast %d to %d: %v", id, chatID, sendErr)
+	}
+
+	recordErr := w.Broadcasts.Record(id, chatID, sendErr)
+	if err := w.Broadcasts.Release(ctx, id); err != nil {
+		return true, err
+	}
+	return true, recordErr
+}
+
+func (w *Broadcaster) load(id uint) (*models.Broadcast, error) {
+	if w.current != nil && w.current.ID == id {
+		return w.current, nil
+	}
+
+	var bc models.Broadcast
+	if err := w.DB.First(&bc, id).Error; err != nil {
+		return nil, fmt.Errorf("failed to load broadcast %d: %w", id, err)
+	}
+	w.current = &bc
+	return w.current, nil
+}
+
+// report tells the author how the broadcast went
+func (w *Broadcaster) report(ctx context.Context, bc *models.Broadcast) {
+	log.Printf("Broadcast %d finished: %d sent, %d blocked, %d failed of %d", bc.ID, bc.Sent, bc.Blocked, bc.Failed, bc.Total)
+
+	msg := fmt.Sprintf("📣 Рассылка #%d завершена\n\n👥 Получателей: %d\n✅ Доставлено: %d\n🚫 Заблокировали бота: %d\n❌ Ошибки: %d",
+		bc.ID, bc.Total, bc.Sent, bc.Blocked, bc.Failed)
+	if _, err := w.Bot.SendMessage(ctx, tu.Message(tu.ID(bc.AdminID), msg)); err != nil {
+		log.Printf("Failed to send broadcast report to %d: %v", bc.AdminID, err)
+	}
+}
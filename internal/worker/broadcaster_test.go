@@ -0,0 +1,90 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/broadcast"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/testutil"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestBroadcastDeliveryReport(t *testing.T) {
+	db := testutil.DB(t)
+	tg := testutil.NewTelegram(t)
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer rdb.Close()
+
+	const adminID = 1
+	recipients := []int64{4001, 4002, 4003}
+	for _, id := range recipients {
+		if err := db.Create(&models.User{TelegramID: id, ReferralCode: fmt.Sprintf("ref_%d", id)}).Error; err != nil {
+			t.Fatalf("create user: %v", err)
+		}
+	}
+	tg.Block(4002)
+	tg.Flood(4003, 1)
+
+	bc := models.Broadcast{
+		AdminID: adminID,
+		Text:    "Новости",
+		Buttons: `[{"text":"Открыть","url":"https://example.com"}]`,
+		Segment: string(broadcast.SegmentAll),
+		Status:  models.BroadcastStatusDraft,
+	}
+	if err := db.Create(&bc).Error; err != nil {
+		t.Fatalf("create broadcast: %v", err)
+	}
+
+	broadcasts := broadcast.NewService(db, rdb, 30)
+	if err := broadcasts.Launch(context.Background(), &bc); err != nil {
+		t.Fatalf("Launch: %v", err)
+	}
+	if err := broadcasts.Launch(context.Background(), &bc); err != broadcast.ErrNotDraft {
+		t.Errorf("second Launch error = %v, want ErrNotDraft", err)
+	}
+
+	// miniredis keeps TTLs until told otherwise: expire the flood pause by hand
+	w := NewBroadcaster(db, broadcasts, tg.Bot)
+	for i := 0; i < 10; i++ {
+		if _, err := w.step(context.Background()); err != nil {
+			t.Fatalf("step: %v", err)
+		}
+		mr.FastForward(time.Minute)
+	}
+
+	for _, id := range []int64{4001, 4003} {
+		if msgs := tg.Messages(id); len(msgs) != 1 || msgs[0] != "Новости" {
+			t.Errorf("messages to %d = %q, want the broadcast once", id, msgs)
+		}
+	}
+
+	if err := db.First(&bc, bc.ID).Error; err != nil {
+		t.Fatalf("reload broadcast: %v", err)
+	}
+	if bc.Status != models.BroadcastStatusDone || bc.Total != 3 || bc.Sent != 2 || bc.Blocked != 1 || bc.Failed != 0 {
+		t.Errorf("broadcast = %s total %d sent %d blocked %d failed %d, want done 3/2/1/0", bc.Status, bc.Total, bc.Sent, bc.Blocked, bc.Failed)
+	}
+
+	var blocked models.User
+	if err := db.Where("telegram_id = ?", 4002).First(&blocked).Error; err != nil {
+		t.Fatalf("load user: %v", err)
+	}
+	if !blocked.BlockedBot {
+		t.Error("user who blocked the bot is not marked")
+	}
+
+	// 3 recipients, a retry after the flood error and the report
+	if calls := tg.Calls("sendMessage"); calls != 5 {
+		t.Errorf("sendMessage called %d times, want 5", calls)
+	}
+	if msgs := tg.Messages(adminID); len(msgs) != 1 {
+		t.Errorf("sent %d reports to the admin, want 1", len(msgs))
+	}
+}
@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -18,11 +19,11 @@ import (
 type Checker struct {
 	DB        *gorm.DB
 	Redis     *redis.Client
-	Remnawave *remnawave.Client
+	Remnawave remnawave.API
 	Bot       *telego.Bot
 }
 
-func NewChecker(db *gorm.DB, rdb *redis.Client, rm *remnawave.Client, bot *telego.Bot) *Checker {
+func NewChecker(db *gorm.DB, rdb *redis.Client, rm remnawave.API, bot *telego.Bot) *Checker {
 	return &Checker{
 		DB:        db,
 		Redis:     rdb,
@@ -31,20 +32,35 @@ func NewChecker(db *gorm.DB, rdb *redis.Client, rm *remnawave.Client, bot *teleg
 	}
 }
 
-func (c *Checker) Start() {
+// checkTimeout bounds a single check cycle
+const checkTimeout = 10 * time.Minute
+
+// Start runs a check every hour until ctx is canceled
+func (c *Checker) Start(ctx context.Context) {
 	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
 	log.Println("Background subscription worker started")
 
 	// Run once at start
-	c.checkSubscriptions()
-
-	for range ticker.C {
-		c.checkSubscriptions()
+	c.checkSubscriptions(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Background subscription worker stopped")
+			return
+		case <-ticker.C:
+			c.checkSubscriptions(ctx)
+		}
 	}
 }
 
-func (c *Checker) checkSubscriptions() {
-	ctx := context.Background()
+// checkSubscriptions runs one cycle. Once ctx is canceled no further
+// subscription is started, but the current one is finished, so a shutdown
+// never leaves it half done.
+func (c *Checker) checkSubscriptions(ctx context.Context) {
+	work, cancel := context.WithTimeout(context.WithoutCancel(ctx), checkTimeout)
+	defer cancel()
 	now := time.Now()
 
 	log.Println("Running subscription check cycle...")
@@ -60,15 +76,18 @@ func (c *Checker) checkSubscriptions() {
 	}
 
 	for _, sub := range expiringSoon {
+		if ctx.Err() != nil || work.Err() != nil {
+			return
+		}
 		key := fmt.Sprintf("notified_24h_%d", sub.UserID)
-		exists, _ := c.Redis.Exists(ctx, key).Result()
+		exists, _ := c.Redis.Exists(work, key).Result()
 		if exists == 0 {
-			_, err := c.Bot.SendMessage(ctx, tu.Message(
+			_, err := c.Bot.SendMessage(work, tu.Message(
 				tu.ID(sub.User.TelegramID),
 				"⚠️ Ваша подписка истекает через сутки! Пожалуйста, продлите её, чтобы не потерять доступ.",
 			))
 			if err == nil {
-				c.Redis.Set(ctx, key, "true", 48*time.Hour)
+				c.Redis.Set(work, key, "true", 48*time.Hour)
 				log.Printf("Sent 24h notification to user %d", sub.User.TelegramID)
 			} else {
 				log.Printf("Failed to send 24h notification to %d: %v", sub.User.TelegramID, err)
@@ -83,11 +102,17 @@ func (c *Checker) checkSubscriptions() {
 	}
 
 	for _, sub := range expired {
+		if ctx.Err() != nil || work.Err() != nil {
+			return
+		}
 		if sub.User.Status != "expired" {
 			log.Printf("Blocking user %d due to expired subscription (expire date: %s)", sub.User.TelegramID, sub.ExpirationDate)
 
-			err := c.Remnawave.DisableUser(sub.RemnawaveID)
-			if err != nil {
+			err := c.Remnawave.DisableUser(work, sub.RemnawaveID)
+			if errors.Is(err, remnawave.ErrNotFound) {
+				// Already gone from the panel, nothing to disable
+				log.Printf("User %s not found in Remnawave, marking expired", sub.RemnawaveID)
+			} else if err != nil {
 				log.Printf("Failed to disable user %s in Remnawave: %v", sub.RemnawaveID, err)
 				continue
 			}
@@ -97,7 +122,7 @@ func (c *Checker) checkSubscriptions() {
 				log.Printf("Failed to update user status in DB for %d: %v", sub.User.TelegramID, err)
 			}
 
-			_, err = c.Bot.SendMessage(ctx, tu.Message(
+			_, err = c.Bot.SendMessage(work, tu.Message(
 				tu.ID(sub.User.TelegramID),
 				"❌ Ваша подписка истекла. Доступ к VPN заблокирован. Продлите подписку в меню 'Купить VPN'.",
 			))
@@ -0,0 +1,80 @@
+package worker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/promo"
+	"popovka-bot/internal/remnawave"
+	"popovka-bot/internal/remnawave/remnawavetest"
+	"popovka-bot/internal/subscription"
+	"popovka-bot/internal/testutil"
+)
+
+func TestExpiredSubscriptionIsDisabledAndRenewable(t *testing.T) {
+	db := testutil.DB(t)
+	tg := testutil.NewTelegram(t)
+	panel := remnawavetest.NewServer()
+	defer panel.Close()
+
+	tariffs, plan := testutil.Plans(t, db, "squad-default")
+	subs := subscription.NewService(panel.Client(), tariffs)
+
+	const telegramID = 2001
+	user := testutil.NewUser(t, db, telegramID, 2*plan.Price)
+
+	// Buy, then let the subscription lapse
+	sub, err := subs.Purchase(context.Background(), db, user, plan, promo.Quote{Price: plan.Price})
+	if err != nil {
+		t.Fatalf("Purchase: %v", err)
+	}
+	if err := db.Model(sub).Update("expiration_date", time.Now().Add(-time.Hour)).Error; err != nil {
+		t.Fatalf("expire subscription: %v", err)
+	}
+
+	checker := NewChecker(db, nil, panel.Client(), tg.Bot)
+	checker.checkSubscriptions(context.Background())
+
+	rwUser, _ := panel.User(sub.RemnawaveID)
+	if rwUser.Status != remnawave.UserStatusDisabled {
+		t.Errorf("panel status after expiry = %s, want %s", rwUser.Status, remnawave.UserStatusDisabled)
+	}
+	if err := db.First(user, user.ID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	if user.Status != "expired" {
+		t.Errorf("user status = %q, want expired", user.Status)
+	}
+	if msgs := tg.Messages(telegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages to the user, want 1 expiry notice", len(msgs))
+	}
+
+	// A second cycle must not disable or notify again
+	checker.checkSubscriptions(context.Background())
+	if msgs := tg.Messages(telegramID); len(msgs) != 1 {
+		t.Errorf("sent %d messages after the second cycle, want 1", len(msgs))
+	}
+
+	// Renewing re-enables the same panel user
+	renewed, err := subs.Purchase(context.Background(), db, user, plan, promo.Quote{Price: plan.Price})
+	if err != nil {
+		t.Fatalf("renewal Purchase: %v", err)
+	}
+	if renewed.RemnawaveID != sub.RemnawaveID {
+		t.Errorf("renewal created panel user %s, want %s", renewed.RemnawaveID, sub.RemnawaveID)
+	}
+	rwUser, _ = panel.User(sub.RemnawaveID)
+	if rwUser.Status != remnawave.UserStatusActive {
+		t.Errorf("panel status after renewal = %s, want %s", rwUser.Status, remnawave.UserStatusActive)
+	}
+	if err := db.First(user, user.ID).Error; err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	if user.Status != "active" {
+		t.Errorf("user status after renewal = %q, want active", user.Status)
+	}
+	if !renewed.ExpirationDate.After(time.Now().Add(29 * 24 * time.Hour)) {
+		t.Errorf("renewed until %s, want about 30 days from now", renewed.ExpirationDate)
+	}
+}
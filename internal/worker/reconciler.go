@@ -0,0 +1,111 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/payment"
+
+	"gorm.io/gorm"
+)
+
+// Reconciler polls YooKassa for payments that stayed pending, so a lost
+// webhook never leaves a paid user without credit.
+type Reconciler struct {
+	DB            *gorm.DB
+	PaymentClient *payment.Client
+	Payments      *payment.Handler
+	After         time.Duration
+	ExpireAfter   time.Duration
+}
+
+func NewReconciler(db *gorm.DB, paymentClient *payment.Client, payments *payment.Handler, after, expireAfter time.Duration) *Reconciler {
+	return &Reconciler{
+		DB:            db,
+		PaymentClient: paymentClient,
+		Payments:      payments,
+		After:         after,
+		ExpireAfter:   expireAfter,
+	}
+}
+
+// reconcileTimeout bounds a single reconciliation cycle
+const reconcileTimeout = 4 * time.Minute
+
+// Start reconciles pending payments every 5 minutes until ctx is canceled
+func (r *Reconciler) Start(ctx context.Context) {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	log.Println("Background payment reconciler started")
+
+	// Run once at start
+	r.reconcilePayments(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Background payment reconciler stopped")
+			return
+		case <-ticker.C:
+			r.reconcilePayments(ctx)
+		}
+	}
+}
+
+// reconcilePayments runs one cycle. Once ctx is canceled no further payment
+// is started, but the current one is finished.
+func (r *Reconciler) reconcilePayments(ctx context.Context) {
+	work, cancel := context.WithTimeout(context.WithoutCancel(ctx), reconcileTimeout)
+	defer cancel()
+	now := time.Now()
+
+	var pending []models.Payment
+	if err := r.DB.Where("status = ? AND yoo_kassa_id <> '' AND created_at < ?", models.PaymentStatusPending, now.Add(-r.After)).
+		// Least recently checked first, so a backlog doesn't starve newer payments
+		Order("COALESCE(checked_at, created_at)").
+		Limit(100).
+		Find(&pending).Error; err != nil {
+		log.Printf("Error querying pending payments: %v", err)
+		return
+	}
+
+	if len(pending) > 0 {
+		log.Printf("Reconciling %d pending payments...", len(pending))
+	}
+
+	for _, p := range pending {
+		if ctx.Err() != nil || work.Err() != nil {
+			return
+		}
+
+		remote, err := r.PaymentClient.GetPayment(work, p.YooKassaID)
+		if err := r.DB.Model(&models.Payment{}).Where("id = ?", p.ID).Update("checked_at", time.Now()).Error; err != nil {
+			log.Printf("Failed to mark payment %s checked: %v", p.YooKassaID, err)
+		}
+		if err != nil {
+			log.Printf("Failed to fetch payment %s: %v", p.YooKassaID, err)
+			continue
+		}
+
+		if remote.Status == "succeeded" || remote.Status == "canceled" {
+			// Same code path as the webhook
+			if err := r.Payments.ProcessPayment(work, remote); err != nil {
+				log.Printf("Failed to apply payment %s: %v", p.YooKassaID, err)
+			}
+			continue
+		}
+
+		// Still pending on the YooKassa side: give up after ExpireAfter
+		if p.CreatedAt.Before(now.Add(-r.ExpireAfter)) {
+			if err := r.DB.Model(&models.Payment{}).
+				Where("id = ? AND status = ?", p.ID, models.PaymentStatusPending).
+				Update("status", models.PaymentStatusExpired).Error; err != nil {
+				log.Printf("Failed to expire payment %s: %v", p.YooKassaID, err)
+				continue
+			}
+			log.Printf("Payment %s expired (status on YooKassa: %s)", p.YooKassaID, remote.Status)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/payment/yookassatest"
+	"popovka-bot/internal/testutil"
+)
+
+func TestReconcilerRotatesThroughBacklog(t *testing.T) {
+	db := testutil.DB(t)
+	yookassa := yookassatest.NewServer()
+	defer yookassa.Close()
+
+	user := testutil.NewUser(t, db, 5001, 0)
+
+	// One more than a cycle takes, all unknown to YooKassa and never expiring
+	created := time.Now().Add(-time.Hour)
+	for i := 0; i <= 100; i++ {
+		p := models.Payment{
+			UserID:     user.ID,
+			Amount:     10000,
+			Status:     models.PaymentStatusPending,
+			YooKassaID: fmt.Sprintf("missing-%d", i),
+			CreatedAt:  created.Add(time.Duration(i) * time.Second),
+		}
+		if err := db.Create(&p).Error; err != nil {
+			t.Fatalf("create payment: %v", err)
+		}
+	}
+
+	r := NewReconciler(db, yookassa.Client(), nil, time.Minute, 24*time.Hour)
+	r.reconcilePayments(context.Background())
+
+	var newest models.Payment
+	if err := db.Where("yoo_kassa_id = ?", "missing-100").First(&newest).Error; err != nil {
+		t.Fatalf("load payment: %v", err)
+	}
+	if newest.CheckedAt != nil {
+		t.Fatal("the newest payment was checked in the first cycle, want the 100 oldest")
+	}
+
+	r.reconcilePayments(context.Background())
+
+	if err := db.First(&newest, newest.ID).Error; err != nil {
+		t.Fatalf("reload payment: %v", err)
+	}
+	if newest.CheckedAt == nil {
+		t.Error("the newest payment was not checked in the second cycle")
+	}
+}
@@ -0,0 +1,163 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"popovka-bot/internal/config"
+	"popovka-bot/internal/models"
+	"popovka-bot/internal/payment"
+	"popovka-bot/internal/tariff"
+	"popovka-bot/internal/utils"
+
+	"github.com/mymmrac/telego"
+	tu "github.com/mymmrac/telego/telegoutil"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+// Renewer charges saved payment methods shortly before a subscription
+// expires. A failed charge is not retried for the same expiration date: the
+// user gets the usual 24h expiry notice from the Checker instead. Only the
+// subscription's own plan is charged for; trials are never renewed.
+type Renewer struct {
+	DB            *gorm.DB
+	Redis         *redis.Client
+	PaymentClient *payment.Client
+	Payments      *payment.Handler
+	Tariffs       *tariff.Service
+	Config        *config.Config
+	Bot           *telego.Bot
+}
+
+func NewRenewer(db *gorm.DB, rdb *redis.Client, paymentClient *payment.Client, payments *payment.Handler, tariffs *tariff.Service, cfg *config.Config, bot *telego.Bot) *Renewer {
+	return &Renewer{
+		DB:            db,
+		Redis:         rdb,
+		PaymentClient: paymentClient,
+		Payments:      payments,
+		Tariffs:       tariffs,
+		Config:        cfg,
+		Bot:           bot,
+	}
+}
+
+// renewTimeout bounds a single renewal cycle
+const renewTimeout = 10 * time.Minute
+
+// Start charges due subscriptions every hour until ctx is canceled
+func (r *Renewer) Start(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	log.Println("Background auto-renewal worker started")
+
+	// Run once at start
+	r.renewSubscriptions(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Background auto-renewal worker stopped")
+			return
+		case <-ticker.C:
+			r.renewSubscriptions(ctx)
+		}
+	}
+}
+
+// renewSubscriptions runs one cycle. Once ctx is canceled no further
+// subscription is charged, but the current one is finished, so no charge is
+// left without its pending payment record.
+func (r *Renewer) renewSubscriptions(ctx context.Context) {
+	work, cancel := context.WithTimeout(context.WithoutCancel(ctx), renewTimeout)
+	defer cancel()
+	now := time.Now()
+
+	var due []models.Subscription
+	if err := r.DB.Preload("User").
+		Joins("JOIN users ON users.id = subscriptions.user_id").
+		Where("users.auto_renew = ? AND users.payment_method_id <> '' AND users.banned = ?", true, false).
+		Where("subscriptions.expiration_date BETWEEN ? AND ?", now, now.Add(r.Config.AutoRenewBefore)).
+		Where("subscriptions.plan_type IS NULL OR subscriptions.plan_type <> ?", models.PlanTypeTrial).
+		Find(&due).Error; err != nil {
+		log.Printf("Error querying subscriptions due for renewal: %v", err)
+		return
+	}
+
+	for _, sub := range due {
+		if ctx.Err() != nil || work.Err() != nil {
+			return
+		}
+
+		// One attempt per expiration date, even across restarts and replicas
+		key := fmt.Sprintf("autorenew_%d_%d", sub.ID, sub.ExpirationDate.Unix())
+		acquired, err := r.Redis.SetNX(work, key, "true", r.Config.AutoRenewBefore+24*time.Hour).Result()
+		if err != nil {
+			log.Printf("Failed to acquire renewal lock for subscription %d: %v", sub.ID, err)
+			continue
+		}
+		if !acquired {
+			continue
+		}
+
+		if err := r.renew(work, &sub); err != nil {
+			log.Printf("Failed to auto-renew subscription of user %d: %v", sub.User.TelegramID, err)
+		}
+	}
+}
+
+func (r *Renewer) renew(ctx context.Context, sub *models.Subscription) error {
+	user := sub.User
+
+	plan, err := r.Tariffs.RenewalPlan(sub.PlanID)
+	if errors.Is(err, tariff.ErrPlanNotFound) {
+		// Never charge for a plan the user did not choose
+		if _, err := r.Bot.SendMessage(ctx, tu.Message(
+			tu.ID(user.TelegramID),
+			"⚠️ Автопродление не выполнено: ваш тариф больше не доступен. Средства не списаны. Выберите новый тариф в меню 'Купить VPN'.",
+		)); err != nil {
+			log.Printf("Failed to send auto-renewal notice to %d: %v", user.TelegramID, err)
+		}
+		return fmt.Errorf("plan of subscription %d is no longer sold", sub.ID)
+	}
+	if err != nil {
+		return fmt.Errorf("no plan to renew with: %w", err)
+	}
+
+	metadata := map[string]string{
+		"telegram_id": strconv.FormatInt(user.TelegramID, 10),
+		"type":        "subscription",
+		"plan_id":     strconv.FormatUint(uint64(plan.ID), 10),
+		"duration":    fmt.Sprintf("%dd", plan.DurationDays),
+		"auto_renew":  "true",
+	}
+
+	description := fmt.Sprintf("Автопродление подписки VPN: %s", plan.Name)
+	receipt := payment.NewReceipt(r.Config, &user, description, plan.Price)
+	resp, err := r.PaymentClient.ChargeSavedMethod(ctx, user.PaymentMethodID, utils.FormatRub(plan.Price), "RUB", description, metadata, receipt)
+	if err != nil {
+		return fmt.Errorf("failed to charge saved method: %w", err)
+	}
+
+	// Track the payment so the reconciler picks it up if it stays pending
+	if err := r.DB.Create(&models.Payment{
+		UserID:       user.ID,
+		Amount:       plan.Price,
+		Status:       models.PaymentStatusPending,
+		Type:         "subscription",
+		Provider:     models.PaymentProviderYooKassa,
+		YooKassaID:   resp.ID,
+		DurationDays: plan.DurationDays,
+	}).Error; err != nil {
+		log.Printf("Failed to save pending payment %s: %v", resp.ID, err)
+	}
+
+	log.Printf("Auto-renewal payment %s for user %d is %s", resp.ID, user.TelegramID, resp.Status)
+
+	// Same code path as the webhook; pending payments are finished by it
+	return r.Payments.ProcessPayment(ctx, resp)
+}
@@ -0,0 +1,13 @@
+-- Remove duplicate payment records created by retried YooKassa webhooks,
+-- keeping the earliest one, so the unique index can be built.
+-- The bot runs the same cleanup on startup before AutoMigrate; this file is
+-- for applying it by hand.
+-- Balances already credited twice are NOT corrected here; review them manually:
+--   SELECT yoo_kassa_id, COUNT(*) FROM payments WHERE yoo_kassa_id <> '' GROUP BY yoo_kassa_id HAVING COUNT(*) > 1;
+DELETE FROM payments p
+USING payments d
+WHERE p.yoo_kassa_id = d.yoo_kassa_id
+  AND p.yoo_kassa_id <> ''
+  AND p.id > d.id;
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_payments_yoo_kassa_id ON payments (yoo_kassa_id) WHERE yoo_kassa_id <> '';